@@ -0,0 +1,535 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Exporting snapshots as archives and importing them again
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// archiveFormats are the possible arguments to export -format.
+var archiveFormats = []string{"tar", "tar.gz", "tar.zst"}
+
+// zstdCommand compresses and decompresses tar.zst archives, the standard
+// library has no zstd support.
+var zstdCommand = "zstd"
+
+// The PAX records in the global header of exported archives.
+const (
+	// paxSnapshot is the name of the exported snapshot
+	paxSnapshot = "SNAPRD.snapshot"
+	// paxPath is the exported directory within the snapshot, if it was not
+	// exported as a whole
+	paxPath = "SNAPRD.path"
+)
+
+// validArchiveFormat returns true if format is one of archiveFormats.
+func validArchiveFormat(format string) bool {
+	for _, f := range archiveFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// nopWriteCloser is an io.WriteCloser that does nothing on Close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// zstdWriter compresses everything written to it with zstdCommand.
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close waits until all data is compressed.
+func (zw *zstdWriter) Close() error {
+	err := zw.WriteCloser.Close()
+	if werr := zw.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// zstdReader decompresses the output of zstdCommand.
+type zstdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close reads the rest of the output, so zstdCommand does not fail on a
+// closed pipe, and returns its exit status.
+func (zr *zstdReader) Close() error {
+	io.Copy(ioutil.Discard, zr.ReadCloser)
+	return zr.cmd.Wait()
+}
+
+// newCompressor returns a writer compressing to w as needed for format.
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "tar":
+		return nopWriteCloser{w}, nil
+	case "tar.gz":
+		return gzip.NewWriter(w), nil
+	case "tar.zst":
+		cmd := exec.Command(zstdCommand, "-q", "-c")
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("could not run %s: %s", zstdCommand, err)
+		}
+		return &zstdWriter{in, cmd}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format: %s, use one of %s", format, strings.Join(archiveFormats, ","))
+}
+
+// newDecompressor returns a reader for the tar archive read from rd, which
+// is decompressed if it starts like a gzip or zstd stream.
+func newDecompressor(rd io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(rd)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		cmd := exec.Command(zstdCommand, "-d", "-q", "-c")
+		cmd.Stdin = br
+		cmd.Stderr = os.Stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("could not run %s: %s", zstdCommand, err)
+		}
+		return &zstdReader{out, cmd}, nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// fileID identifies a file on disk.
+type fileID struct {
+	dev, ino uint64
+}
+
+// archiver writes files to a tar archive.
+type archiver struct {
+	tw  *tar.Writer
+	log *structLogger
+	// links are the names regular files with more than one link were
+	// archived with first. Later links to them are archived as hard links.
+	links map[fileID]string
+}
+
+// add writes the file path to the archive, called name there.
+func (a *archiver) add(path, name string, fi os.FileInfo) error {
+	if fi.Mode()&os.ModeSocket != 0 {
+		a.log.warnf("not archiving socket %s", path)
+		return nil
+	}
+	var target string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if target, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// only the modification time is kept, so exporting the same snapshot
+	// again gives the same archive, and PAX keeps it to the nanosecond
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.Format = tar.FormatPAX
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		id := fileID{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := a.links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return a.tw.WriteHeader(hdr)
+		}
+		a.links[id] = name
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(a.tw, f, hdr.Size)
+	return err
+}
+
+// exportSnapshot writes the directory sub of sn, or all of it if sub is
+// empty, to w as an archive in format. Names in the archive are relative to
+// the snapshot, and files are archived in lexical order.
+func (r *Repository) exportSnapshot(ctx context.Context, w io.Writer, sn snapshot, sub, format string) error {
+	root := r.snapshotPath(sn)
+	sub = filepath.Clean("/" + sub)[1:]
+	cw, err := newCompressor(w, format)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	records := map[string]string{paxSnapshot: sn.Name()}
+	if sub != "" {
+		records[paxPath] = sub
+	}
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: records})
+	a := &archiver{tw: tw, log: r.log, links: make(map[fileID]string)}
+	if err == nil {
+		err = filepath.Walk(filepath.Join(root, sub), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			return a.add(path, name, fi)
+		})
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// extractor recreates the files of a tar archive below root.
+type extractor struct {
+	root string
+	log  *structLogger
+	// owner is set if files can be given to their owners
+	owner bool
+	// dirs get their metadata after everything in them was extracted
+	dirs []*tar.Header
+	// symlinks are the cleaned names of the symlinks extracted so far,
+	// nothing is extracted below them
+	symlinks map[string]bool
+}
+
+// path returns where the file called name in the archive is extracted to.
+// Names leading out of root, directly or through a symlink, are refused.
+func (e *extractor) path(name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("invalid name in archive: %s", name)
+		}
+	}
+	clean := filepath.Clean("/" + name)
+	for dir := filepath.Dir(clean); dir != "/"; dir = filepath.Dir(dir) {
+		if e.symlinks[dir] {
+			return "", fmt.Errorf("invalid name in archive, %s is a symlink: %s", dir[1:], name)
+		}
+	}
+	return filepath.Join(e.root, clean), nil
+}
+
+// extract recreates the file hdr describes, with its contents read from rd.
+func (e *extractor) extract(hdr *tar.Header, rd io.Reader) error {
+	path, err := e.path(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+		e.dirs = append(e.dirs, hdr)
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, rd)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		e.symlinks[filepath.Clean("/"+hdr.Name)] = true
+		if e.owner {
+			if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		return lutimes(path, hdr.ModTime)
+	case tar.TypeLink:
+		target, err := e.path(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeFifo:
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+		}
+	default:
+		e.log.warnf("not extracting %s, files of type %q are not supported", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+	return e.setMeta(path, hdr)
+}
+
+// setMeta gives path the ownership, permissions and modification time from
+// hdr.
+func (e *extractor) setMeta(path string, hdr *tar.Header) error {
+	if e.owner {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// after chown, which clears the setuid bit
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// finish sets the metadata of all directories, the deepest first.
+func (e *extractor) finish() error {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		path, _ := e.path(e.dirs[i].Name)
+		if err := e.setMeta(path, e.dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkEmptyDir returns an error if dir contains anything.
+func checkEmptyDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if names, _ := f.Readdirnames(1); len(names) != 0 {
+		return fmt.Errorf("will not import into %s, it is not empty", dir)
+	}
+	return nil
+}
+
+// importSnapshot creates a complete snapshot from the archive read from rd.
+// If the archive was exported by snaprd from a whole snapshot, and there is
+// no snapshot with the same start time, the new snapshot gets the name of
+// the exported one. Otherwise it is named like a snapshot started now. If
+// the import fails, the incomplete snapshot is left for reuse.
+//
+// The archive is extracted into the target of the new snapshot, which must be
+// a fresh directory. Storages that make snapshots from a directory in use,
+// like zfs does with the dataset, are not supported.
+func (r *Repository) importSnapshot(ctx context.Context, rd io.Reader) (snapshot, error) {
+	sn := newIncompleteSnapshot(r.cl)
+	if r.store.target(sn.Name()) != r.store.path(sn.Name()) {
+		return snapshot{}, errors.New("import is not supported by this storage, it does not make snapshots from a new directory")
+	}
+	dr, err := newDecompressor(&ctxReader{ctx, rd})
+	if err != nil {
+		return snapshot{}, err
+	}
+	defer dr.Close()
+	if err := r.store.prepare(sn.Name(), ""); err != nil {
+		return sn, err
+	}
+	e := &extractor{
+		root:     r.store.target(sn.Name()),
+		log:      r.log,
+		owner:    os.Geteuid() == 0,
+		symlinks: make(map[string]bool),
+	}
+	if err := os.MkdirAll(e.root, 0755); err != nil {
+		return sn, err
+	}
+	if err := checkEmptyDir(e.root); err != nil {
+		return sn, err
+	}
+	r.snapLog(sn).infof("importing into %s", sn.Name())
+	var exported snapshot
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sn, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if hdr.PAXRecords[paxPath] == "" {
+				if stime, etime, _, err := parseSnapshotName(hdr.PAXRecords[paxSnapshot]); err == nil {
+					exported = newSnapshot(stime, etime, stateComplete)
+				}
+			}
+			continue
+		}
+		if err := e.extract(hdr, tr); err != nil {
+			return sn, err
+		}
+	}
+	if err := e.finish(); err != nil {
+		return sn, err
+	}
+	if err := dr.Close(); err != nil {
+		return sn, err
+	}
+	if exported.isZero() {
+		return r.transComplete(sn)
+	}
+	if cur, ok := r.onDisk(exported); ok {
+		r.snapLog(sn).infof("%s exists already as %s, using a new name", exported.Name(), cur.Name())
+		return r.transComplete(sn)
+	}
+	err = r.mutate(func() error {
+		if err := r.store.complete(sn.Name(), exported.Name()); err != nil {
+			return err
+		}
+		r.updateSymlinks()
+		return nil
+	})
+	if err != nil {
+		return sn, err
+	}
+	r.updateLatest(r.lastGoodFromDisk())
+	return exported, nil
+}
+
+// findSnapshot returns the complete snapshot called spec, or the youngest
+// complete snapshot started at or before the time spec stands for, see
+// parseSince.
+func (r *Repository) findSnapshot(spec string) (snapshot, error) {
+	snapshots, err := r.findSnapshots()
+	if err != nil {
+		return snapshot{}, err
+	}
+	complete := snapshots.state(stateComplete, none)
+	if _, _, _, err := parseSnapshotName(spec); err == nil {
+		for _, sn := range complete {
+			if sn.Name() == spec {
+				return sn, nil
+			}
+		}
+		return snapshot{}, fmt.Errorf("no complete snapshot %s", spec)
+	}
+	t, err := parseSince(spec, r.cl.Now())
+	if err != nil {
+		return snapshot{}, fmt.Errorf("-snapshot must be a snapshot name or a time: %s", spec)
+	}
+	var found snapshot
+	for _, sn := range complete {
+		if !sn.startTime.After(t) {
+			found = sn
+		}
+	}
+	if found.isZero() {
+		return found, fmt.Errorf("no complete snapshot started before %s", t.Format("2006-01-02 15:04:05"))
+	}
+	return found, nil
+}
+
+// subcmdExport writes the configured snapshot as an archive to the
+// configured file, or to w for "-".
+func subcmdExport(r *Repository, w io.Writer) error {
+	sn, err := r.findSnapshot(r.config.archiveSnap)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := r.cancelOnSignal()
+	defer cancel()
+	r.snapLog(sn).infof("exporting %s", sn.Name())
+	file := r.config.archiveFile
+	if file == "-" {
+		return r.exportSnapshot(ctx, w, sn, r.config.archivePath, r.config.archiveFormat)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = r.exportSnapshot(ctx, f, sn, r.config.archivePath, r.config.archiveFormat)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
+
+// subcmdImport creates a snapshot from the archive in the configured file,
+// or read from rd for "-".
+func subcmdImport(r *Repository, rd io.Reader) error {
+	pl := newPidLocker(r.path(".pid"))
+	if err := pl.Lock(); err != nil {
+		return err
+	}
+	defer pl.Unlock()
+	ctx, cancel := r.cancelOnSignal()
+	defer cancel()
+	if file := r.config.archiveFile; file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rd = f
+	}
+	sn, err := r.importSnapshot(ctx, rd)
+	if err != nil {
+		return err
+	}
+	r.snapLog(sn).infof("imported %s", sn.Name())
+	return nil
+}
@@ -0,0 +1,178 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveNames returns the names of the files in the tar archive b.
+func archiveNames(t *testing.T, b []byte) []string {
+	tr := tar.NewReader(bytes.NewReader(b))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, hdr.Name)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer removeTestDir(r.path())
+	sn := mustParseSnapshot(t, "1400337721-1400337722-complete")
+	os.Remove(r.snapshotPath(sn))
+	os.Rename(mockOrigin(t, r.path()), r.snapshotPath(sn))
+	os.Link(r.snapshotPath(sn)+"/a", r.snapshotPath(sn)+"/sub/a-link")
+	for _, format := range archiveFormats {
+		if _, err := exec.LookPath(zstdCommand); err != nil && format == "tar.zst" {
+			t.Logf("skipping %s, %s not available", format, zstdCommand)
+			continue
+		}
+		var b, again bytes.Buffer
+		if err := r.exportSnapshot(context.Background(), &b, sn, "", format); err != nil {
+			t.Fatalf("exportSnapshot() gave error %v", err)
+		}
+		r.exportSnapshot(context.Background(), &again, sn, "", format)
+		if !bytes.Equal(b.Bytes(), again.Bytes()) {
+			t.Errorf("%s archives of the same snapshot differ", format)
+		}
+
+		r2 := mockConfig()
+		defer removeTestDir(r2.path())
+		os.MkdirAll(r2.path(dataSubdir), 0755)
+		imported, err := r2.importSnapshot(context.Background(), &b)
+		if err != nil {
+			t.Fatalf("importSnapshot() of %s gave error %v", format, err)
+		}
+		if imported != sn {
+			t.Errorf("%s imported as %s", format, imported.Name())
+		}
+		compareTrees(t, r.snapshotPath(sn), r2.snapshotPath(imported))
+		fa, _ := os.Stat(r2.snapshotPath(imported) + "/a")
+		fb, _ := os.Stat(r2.snapshotPath(imported) + "/sub/a-link")
+		if !os.SameFile(fa, fb) {
+			t.Errorf("hard link was not preserved")
+		}
+		if latest, _ := os.Readlink(r2.path("latest")); latest != r2.snapshotLink(imported) {
+			t.Errorf("latest points to %s", latest)
+		}
+
+		// the name is taken now
+		r.exportSnapshot(context.Background(), &b, sn, "", format)
+		imported, err = r2.importSnapshot(context.Background(), &b)
+		if err != nil || imported == sn || imported.state != stateComplete {
+			t.Errorf("second import gave %s, %v", imported.Name(), err)
+		}
+	}
+}
+
+func TestExportPath(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer removeTestDir(r.path())
+	sn := mustParseSnapshot(t, "1400337721-1400337722-complete")
+	os.Remove(r.snapshotPath(sn))
+	os.Rename(mockOrigin(t, r.path()), r.snapshotPath(sn))
+	var b bytes.Buffer
+	if err := r.exportSnapshot(context.Background(), &b, sn, "/sub/../sub", "tar"); err != nil {
+		t.Fatalf("exportSnapshot() gave error %v", err)
+	}
+	want := "sub/ sub/b sub/deep/ sub/deep/c"
+	if got := strings.Join(archiveNames(t, b.Bytes()), " "); got != want {
+		t.Errorf("archive contains %s, wanted %s", got, want)
+	}
+	imported, err := r.importSnapshot(context.Background(), &b)
+	if err != nil {
+		t.Fatalf("importSnapshot() gave error %v", err)
+	}
+	if imported.startTime.Unix() != startAt {
+		t.Errorf("part of a snapshot was imported as %s", imported.Name())
+	}
+	compareTrees(t, filepath.Join(r.snapshotPath(sn), "sub"), filepath.Join(r.snapshotPath(imported), "sub"))
+}
+
+func TestImportZfs(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer removeTestDir(r.path())
+	sn := mustParseSnapshot(t, "1400337721-1400337722-complete")
+	var b bytes.Buffer
+	if err := r.exportSnapshot(context.Background(), &b, sn, "", "tar"); err != nil {
+		t.Fatalf("exportSnapshot() gave error %v", err)
+	}
+	// the dataset still contains the latest snapshot
+	root := mockOrigin(t, r.path())
+	before, _ := ioutil.ReadDir(root)
+	r.store = &zfsStorage{command: "false", root: root}
+	if sn, err := r.importSnapshot(context.Background(), &b); err == nil {
+		t.Errorf("archive was imported into the dataset as %s", sn.Name())
+	}
+	if after, _ := ioutil.ReadDir(root); len(after) != len(before) {
+		t.Errorf("dataset was changed by the import, it contains %d files instead of %d", len(after), len(before))
+	}
+}
+
+func TestImportUnsafe(t *testing.T) {
+	for _, hdrs := range [][]*tar.Header{
+		{{Name: "../escaped", Typeflag: tar.TypeReg}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, {Name: "link/escaped", Typeflag: tar.TypeReg}},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+	} {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		for _, hdr := range hdrs {
+			hdr.Mode = 0644
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+		r := mockConfig()
+		os.MkdirAll(r.path(dataSubdir), 0755)
+		if sn, err := r.importSnapshot(context.Background(), &b); err == nil {
+			t.Errorf("%s was imported as %s", hdrs[len(hdrs)-1].Name, sn.Name())
+		}
+		os.RemoveAll(r.path())
+	}
+	if _, err := os.Stat("/tmp/escaped"); err == nil {
+		t.Errorf("file was extracted outside of the snapshot")
+	}
+}
+
+func TestFindSnapshot(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"1400337531-1400337532-complete", "1400337531-1400337532-complete"},
+		{"1400337531-1400337533-complete", ""},
+		{"2014-05-17T14:41:50Z", "1400337706-1400337707-complete"},
+		{"10s", "1400337711-1400337712-complete"},
+		{"2014-05-17", ""},
+		{"yesterday", ""},
+	} {
+		sn, err := r.findSnapshot(tc.spec)
+		if (err == nil) != (tc.want != "") || (err == nil && sn.Name() != tc.want) {
+			t.Errorf("findSnapshot(%q) gave %s, %v", tc.spec, sn.Name(), err)
+		}
+	}
+}
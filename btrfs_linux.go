@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// from linux/magic.h
+const btrfsSuperMagic = 0x9123683e
+
+// btrfsSubvolumeIno is the inode number of the root of every subvolume.
+const btrfsSubvolumeIno = 256
+
+// isSubvolume returns true if path is the root of a btrfs subvolume.
+func isSubvolume(path string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Ino != btrfsSubvolumeIno {
+		return false
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return false
+	}
+	return fs.Type == btrfsSuperMagic
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+// isSubvolume is always false, btrfs is only supported on linux.
+func isSubvolume(path string) bool {
+	return false
+}
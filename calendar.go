@@ -0,0 +1,182 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Calculate the start time of the next snapshot, optionally anchored to the
+// time of day and avoiding blackout windows
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// calendarRef is the day anchored snapshots with periods of one day or more
+// are aligned to. It is a Monday, so weekly snapshots happen on Mondays.
+var calendarRef = time.Date(2000, 1, 3, 0, 0, 0, 0, time.UTC)
+
+// timeWindow is a daily recurring time span, given as offsets from midnight.
+// If to is smaller than from, the window spans midnight.
+type timeWindow struct {
+	from, to time.Duration
+}
+
+// contains returns true if the time of day of t lies within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	off := timeOfDay(t)
+	if w.from <= w.to {
+		return off >= w.from && off < w.to
+	}
+	return off >= w.from || off < w.to
+}
+
+// end returns the point in time when the window containing t is over.
+func (w timeWindow) end(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if w.from > w.to && timeOfDay(t) >= w.from {
+		d++
+	}
+	return atTimeOfDay(y, m, d, w.to, t.Location())
+}
+
+// calendar decides when the next snapshot is due. Without an anchor, the
+// next snapshot is due one period after the previous one started. With an
+// anchor, snapshots are aligned to the wall clock, e. g. daily at 02:00 or
+// every 6h starting at 00:00.
+type calendar struct {
+	period   time.Duration
+	anchored bool
+	anchor   time.Duration
+	blackout []timeWindow
+}
+
+// newCalendar creates a calendar for the given period. anchor is a time of
+// day like "02:00" or empty, blackout is a comma separated list of windows
+// like "08:00-18:00" or empty.
+func newCalendar(period time.Duration, anchor, blackout string) (*calendar, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("invalid snapshot period: %s", period)
+	}
+	c := &calendar{period: period}
+	if anchor != "" {
+		a, err := parseTimeOfDay(anchor)
+		if err != nil {
+			return nil, err
+		}
+		c.anchored = true
+		c.anchor = a
+		// Anchored slots of a day or more are counted in whole days.
+		if period > day && period%day != 0 {
+			return nil, fmt.Errorf("anchored snapshot period is not a whole number of days: %s", period)
+		}
+	}
+	if blackout != "" {
+		for _, s := range strings.Split(blackout, ",") {
+			se := strings.Split(strings.TrimSpace(s), "-")
+			if len(se) != 2 {
+				return nil, fmt.Errorf("malformed blackout window: %s", s)
+			}
+			from, err := parseTimeOfDay(se[0])
+			if err != nil {
+				return nil, err
+			}
+			to, err := parseTimeOfDay(se[1])
+			if err != nil {
+				return nil, err
+			}
+			if from == to {
+				return nil, fmt.Errorf("empty blackout window: %s", s)
+			}
+			c.blackout = append(c.blackout, timeWindow{from, to})
+		}
+	}
+	return c, nil
+}
+
+// next returns the time when the snapshot after one started at last is due.
+// A zero last means there is no previous snapshot. The result is never
+// before now and never within a blackout window.
+func (c *calendar) next(last, now time.Time) time.Time {
+	var t time.Time
+	switch {
+	case last.IsZero():
+		t = now
+	case c.anchored:
+		t = c.slotAfter(last)
+	default:
+		t = last.Add(c.period)
+	}
+	if t.Before(now) {
+		t = now
+	}
+	return c.avoidBlackout(t)
+}
+
+// slotAfter returns the first anchored slot after t.
+func (c *calendar) slotAfter(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if c.period < day {
+		// Slots restart at the anchor every day, so periods that do not
+		// divide a day evenly stay aligned to the wall clock.
+		first := c.anchor % c.period
+		for ; ; d++ {
+			for off := first; off < day; off += c.period {
+				if s := atTimeOfDay(y, m, d, off, t.Location()); s.After(t) {
+					return s
+				}
+			}
+		}
+	}
+	days := int64(c.period / day)
+	for ; ; d++ {
+		n := int64(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(calendarRef) / day)
+		if n%days != 0 {
+			continue
+		}
+		if s := atTimeOfDay(y, m, d, c.anchor, t.Location()); s.After(t) {
+			return s
+		}
+	}
+}
+
+// avoidBlackout moves t to the end of any blackout window it falls into.
+func (c *calendar) avoidBlackout(t time.Time) time.Time {
+	// Windows may overlap, so try again after each move. Each window can
+	// move t at most once.
+	for i := 0; i <= len(c.blackout); i++ {
+		moved := false
+		for _, w := range c.blackout {
+			if w.contains(t) {
+				debugf("%s is within blackout window", t)
+				t = w.end(t)
+				moved = true
+			}
+		}
+		if !moved {
+			break
+		}
+	}
+	return t
+}
+
+// timeOfDay returns the wall clock time of t as an offset from midnight.
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*hour + time.Duration(m)*minute + time.Duration(s)*second
+}
+
+// atTimeOfDay returns the time when the wall clock shows the offset off from
+// midnight on the given day. On days with a DST change, this is not the same
+// as adding off to midnight.
+func atTimeOfDay(y int, m time.Month, d int, off time.Duration, loc *time.Location) time.Time {
+	return time.Date(y, m, d, int(off/hour), int(off%hour/minute), int(off%minute/second), 0, loc)
+}
+
+// parseTimeOfDay parses "HH:MM" into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("malformed time of day (want HH:MM): %s", s)
+	}
+	return timeOfDay(t), nil
+}
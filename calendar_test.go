@@ -0,0 +1,163 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func at(day, h, m int) time.Time {
+	return time.Date(2014, 5, day, h, m, 0, 0, time.Local)
+}
+
+type calendarTestPair struct {
+	last, now, want time.Time
+}
+
+func TestCalendarNext(t *testing.T) {
+	var tests = []struct {
+		period   time.Duration
+		anchor   string
+		blackout string
+		pairs    []calendarTestPair
+	}{
+		{hour * 6, "", "", []calendarTestPair{
+			{at(17, 1, 10), at(17, 2, 0), at(17, 7, 10)},
+			{at(17, 1, 10), at(17, 9, 0), at(17, 9, 0)},
+			{time.Time{}, at(17, 9, 0), at(17, 9, 0)},
+		}},
+		{hour * 6, "00:00", "", []calendarTestPair{
+			{at(17, 1, 10), at(17, 2, 0), at(17, 6, 0)},
+			{at(17, 19, 0), at(17, 19, 5), at(18, 0, 0)},
+			{at(17, 1, 10), at(17, 9, 0), at(17, 9, 0)},
+		}},
+		{day, "02:00", "", []calendarTestPair{
+			{at(17, 2, 0), at(17, 2, 1), at(18, 2, 0)},
+			{at(17, 1, 0), at(17, 1, 1), at(17, 2, 0)},
+		}},
+		// 2014-05-17 is a Saturday, weekly snapshots happen on Mondays
+		{week, "03:30", "", []calendarTestPair{
+			{at(17, 2, 0), at(17, 2, 1), at(19, 3, 30)},
+		}},
+		{hour, "", "08:00-18:00", []calendarTestPair{
+			{at(17, 7, 30), at(17, 7, 31), at(17, 18, 0)},
+			{at(17, 6, 0), at(17, 6, 1), at(17, 7, 0)},
+		}},
+		{hour, "00:15", "22:00-02:00,01:30-03:00", []calendarTestPair{
+			{at(17, 21, 30), at(17, 21, 31), at(18, 3, 0)},
+		}},
+	}
+	for _, tt := range tests {
+		cal, err := newCalendar(tt.period, tt.anchor, tt.blackout)
+		if err != nil {
+			t.Fatalf("newCalendar() gave error %v", err)
+		}
+		for _, pair := range tt.pairs {
+			if got := cal.next(pair.last, pair.now); !got.Equal(pair.want) {
+				t.Errorf("next(%v, %v) with anchor %q and blackout %q got %v, expected %v",
+					pair.last, pair.now, tt.anchor, tt.blackout, got, pair.want)
+			}
+		}
+	}
+}
+
+// TestCalendarDST checks that anchors and blackout windows follow the wall
+// clock on the days DST begins and ends in Germany.
+func TestCalendarDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	at := func(month time.Month, day, h, m int) time.Time {
+		return time.Date(2014, month, day, h, m, 0, 0, loc)
+	}
+	var tests = []struct {
+		period   time.Duration
+		anchor   string
+		blackout string
+		pairs    []calendarTestPair
+	}{
+		{day, "04:00", "", []calendarTestPair{
+			{at(3, 29, 4, 0), at(3, 29, 4, 1), at(3, 30, 4, 0)},
+			{at(10, 25, 4, 0), at(10, 25, 4, 1), at(10, 26, 4, 0)},
+		}},
+		// 02:30 does not exist on 2014-03-30, the clock jumps to 03:00
+		{day, "02:30", "", []calendarTestPair{
+			{at(3, 29, 2, 30), at(3, 29, 2, 31), at(3, 30, 3, 30)},
+		}},
+		{hour * 6, "00:00", "", []calendarTestPair{
+			{at(3, 30, 0, 10), at(3, 30, 0, 11), at(3, 30, 6, 0)},
+			{at(10, 26, 0, 10), at(10, 26, 0, 11), at(10, 26, 6, 0)},
+		}},
+		{hour, "", "08:00-18:00", []calendarTestPair{
+			{at(3, 30, 7, 30), at(3, 30, 7, 31), at(3, 30, 18, 0)},
+			{at(10, 26, 7, 30), at(10, 26, 7, 31), at(10, 26, 18, 0)},
+		}},
+		{hour, "", "22:00-08:00", []calendarTestPair{
+			{at(3, 29, 21, 30), at(3, 29, 21, 31), at(3, 30, 8, 0)},
+			{at(10, 25, 21, 30), at(10, 25, 21, 31), at(10, 26, 8, 0)},
+		}},
+	}
+	for _, tt := range tests {
+		cal, err := newCalendar(tt.period, tt.anchor, tt.blackout)
+		if err != nil {
+			t.Fatalf("newCalendar() gave error %v", err)
+		}
+		for _, pair := range tt.pairs {
+			if got := cal.next(pair.last, pair.now); !got.Equal(pair.want) {
+				t.Errorf("next(%v, %v) with anchor %q and blackout %q got %v, expected %v",
+					pair.last, pair.now, tt.anchor, tt.blackout, got, pair.want)
+			}
+		}
+	}
+}
+
+func TestNewCalendarBad(t *testing.T) {
+	var tests = [][2]string{
+		{"2:00pm", ""},
+		{"", "08:00"},
+		{"", "08:00-08:00"},
+		{"", "08:00-25:00"},
+	}
+	for _, tt := range tests {
+		if _, err := newCalendar(hour, tt[0], tt[1]); err == nil {
+			t.Errorf("newCalendar(%q, %q) did not fail, but it should", tt[0], tt[1])
+		}
+	}
+	if _, err := newCalendar(36*hour, "02:00", ""); err == nil {
+		t.Errorf("newCalendar(36h, \"02:00\", \"\") did not fail, but it should")
+	}
+	if _, err := newCalendar(36*hour, "", ""); err != nil {
+		t.Errorf("newCalendar(36h, \"\", \"\") failed: %v", err)
+	}
+	if _, err := newCalendar(2*day, "02:00", ""); err != nil {
+		t.Errorf("newCalendar(48h, \"02:00\", \"\") failed: %v", err)
+	}
+}
+
+func TestLastGoodTickerAnchored(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	cl := newSkewClock(startAt)
+	r.cl = cl
+	cal, _ := newCalendar(time.Minute, "00:00", "")
+	in := make(chan snapshot)
+	out := make(chan snapshot)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.lastGoodTicker(ctx, in, out, cal)
+	sn := <-out
+	if got := sn.String(); got != lastGood {
+		t.Errorf("ticker started with %v, wanted %v", got, lastGood)
+	}
+	// lastGood started at 16:42:01, so the next slot is at 16:43:00
+	in <- sn
+	<-out
+	if got, want := cl.Now().Unix(), int64(1400337780); got != want {
+		t.Errorf("ticker fired at %v, wanted %v", got, want)
+	}
+}
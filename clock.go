@@ -6,11 +6,13 @@
 package main
 
 import (
+	"sync"
 	"time"
 )
 
 type clock interface {
 	Now() time.Time
+	After(d time.Duration) <-chan time.Time
 }
 
 type realClock struct{}
@@ -19,19 +21,38 @@ func (realClock) Now() time.Time {
 	return time.Now()
 }
 
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// skewClock is safe for use by multiple goroutines.
 type skewClock struct {
+	mu   sync.Mutex
 	skew time.Duration
 }
 
 func (cl *skewClock) Now() time.Time {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	return time.Now().Add(-cl.skew)
 }
 
+// After does not actually wait, it moves the clock forward by d and fires
+// immediately.
+func (cl *skewClock) After(d time.Duration) <-chan time.Time {
+	cl.forward(d)
+	c := make(chan time.Time, 1)
+	c <- cl.Now()
+	return c
+}
+
 func newSkewClock(i int64) *skewClock {
 	d := time.Now().Sub(time.Unix(i, 0))
 	return &skewClock{skew: d}
 }
 
 func (cl *skewClock) forward(d time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	cl.skew -= d
 }
@@ -1,7 +1,7 @@
 /* See the file "LICENSE.txt" for the full license governing this code. */
 
 // Global configuration with disk caching
-// Parsing of command line flags
+// Parsing of command line flags, environment and configuration files
 
 package main
 
@@ -10,95 +10,354 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	myName               = "snaprd"
 	defaultSchedFileName = "/etc/" + myName + ".schedules"
+	defaultSysConfigFile = "/etc/" + myName + ".conf"
+	repoConfigName       = "." + myName + ".conf"
+	cacheName            = "." + myName + ".settings"
+	envPrefix            = "SNAPRD_"
 	dataSubdir           = ".data"
 	defaultRepository    = "/tmp/snaprd_dest"
+	defaultLogBuffer     = 64 // KiB
 )
 
 type opts []string
 
 // opts getter
 func (o *opts) String() string {
-	return fmt.Sprintf("\"%s\"", strings.Join(*o, ""))
+	return strings.Join(*o, " ")
 }
 
 // opts setter
 func (o *opts) Set(value string) error {
+	if value == "" {
+		*o = nil
+		return nil
+	}
 	*o = strings.Split(value, " ")
 	return nil
 }
 
-// Config is used as a backing store for parsed flags
+// Get implements flag.Getter
+func (o *opts) Get() interface{} {
+	return []string(*o)
+}
+
+// Config is used as a backing store for parsed flags. The json names are the
+// flag names, so they can be used in configuration files.
 type Config struct {
-	RsyncPath    string
-	RsyncOpts    opts
-	Origin       string
-	repository   string
-	Schedule     string
-	verbose      bool
-	showAll      bool
-	MaxKeep      int
-	NoPurge      bool
-	NoWait       bool
-	NoLogDate    bool
-	SchedFile    string
-	MinPercSpace float64
-	MinGiBSpace  int
-	Notify       string
-	noColor      bool
+	RsyncPath     string        `json:"rsyncPath"`
+	RsyncOpts     opts          `json:"rsyncOpts"`
+	Copier        string        `json:"copier"`
+	CopyWorkers   int           `json:"copyWorkers"`
+	MaxRsyncTime  time.Duration `json:"maxRsyncTime"`
+	Origin        string        `json:"origin"`
+	repository    string        // never read from the repository itself
+	Schedule      string        `json:"schedule"`
+	verbose       bool          // list only
+	showAll       bool          // list only
+	MaxKeep       int           `json:"maxKeep"`
+	NoPurge       bool          `json:"noPurge"`
+	Storage       string        `json:"storage"`
+	PurgeWorkers  int           `json:"purgeWorkers"`
+	PurgeWalkers  int           `json:"purgeWalkers"`
+	PurgeRate     int           `json:"purgeRate"`
+	PurgeNice     bool          `json:"purgeNice"`
+	PurgeAttempts int           `json:"purgeAttempts"`
+	NoWait        bool          `json:"noWait"`
+	NoLogDate     bool          `json:"noLogDate"`
+	SchedFile     string        `json:"schedFile"`
+	MinPercSpace  float64       `json:"minPercSpace"`
+	MinGiBSpace   int           `json:"minGbSpace"`
+	Notify        string        `json:"notify"`
+	Anchor        string        `json:"anchor"`
+	Blackout      string        `json:"blackout"`
+	Watch         bool          `json:"watch"`
+	WatchDebounce time.Duration `json:"watchDebounce"`
+	WatchMaxStale time.Duration `json:"watchMaxStale"`
+	SkipUnchanged bool          `json:"skipUnchanged"`
+	LogSize       int           `json:"logSize"`
+	LogKeep       int           `json:"logKeep"`
+	LogFormat     string        `json:"logFormat"`
+	LogLevel      string        `json:"logLevel"`
+	LogTarget     string        `json:"logTarget"`
+	SysFacility   string        `json:"syslogFacility"`
+	LogBuffer     int           `json:"logBuffer"`
+	NotifyLog     time.Duration `json:"notifyLog"`
+	noColor       bool          // list only
+	listFormat    string        // list only
+	tree          bool          // list only
+	logLines      int           // log only
+	logFollow     bool          // log only
+	logSince      string        // log only
+	logSnapshot   string        // log only
+	replicaDest   string        // replicate only
+	replicaSched  string        // replicate only
+	archiveSnap   string        // export only
+	archivePath   string        // export only
+	archiveFormat string        // export only
+	archiveFile   string        // export and import
+	sources       *configSources
+}
+
+// Precedence of the places a setting can come from, lowest first.
+const (
+	rankDefault = iota
+	rankSystem
+	rankCache
+	rankRepository
+	rankEnv
+	rankFlag
+)
+
+// flagAliases maps shorthand flags to the setting they stand for.
+var flagAliases = map[string]string{
+	"r":    "repository",
+	"from": "repository",
+}
+
+// legacyKeys maps keys used in old settings caches to setting names, where
+// they differ by more than case.
+var legacyKeys = map[string]string{
+	"MinGiBSpace": "minGbSpace",
+}
+
+// sysConfigFile returns the path to the system wide configuration file. It
+// can be changed with the SNAPRD_CONFIG environment variable.
+func sysConfigFile() string {
+	if f := os.Getenv(envPrefix + "CONFIG"); f != "" {
+		return f
+	}
+	return defaultSysConfigFile
+}
+
+// configSources keeps track of where each setting in flags came from.
+type configSources struct {
+	flags  *flag.FlagSet
+	rank   map[string]int
+	origin map[string]string
+}
+
+func newConfigSources(flags *flag.FlagSet) *configSources {
+	return &configSources{
+		flags:  flags,
+		rank:   make(map[string]int),
+		origin: make(map[string]string),
+	}
+}
+
+// set applies value to the setting name, unless it has been set from a place
+// with higher precedence already.
+func (cs *configSources) set(name, value string, rank int, origin string) error {
+	if cs.rank[name] > rank {
+		return nil
+	}
+	f := cs.flags.Lookup(name)
+	if f == nil {
+		return nil
+	}
+	if err := f.Value.Set(value); err != nil {
+		return fmt.Errorf("invalid value %q for %s from %s: %s", value, name, origin, err)
+	}
+	cs.rank[name] = rank
+	cs.origin[name] = origin
+	return nil
+}
+
+// source returns a description of where the setting name came from.
+func (cs *configSources) source(name string) string {
+	if o, ok := cs.origin[name]; ok {
+		return o
+	}
+	return "default"
+}
+
+// applyEnv applies all SNAPRD_<NAME> environment variables.
+func (cs *configSources) applyEnv() error {
+	var err error
+	cs.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := flagAliases[f.Name]; ok || err != nil {
+			return
+		}
+		env := envPrefix + strings.ToUpper(f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			err = cs.set(f.Name, v, rankEnv, "env "+env)
+		}
+	})
+	return err
+}
+
+// applyFile applies all settings from the json file at path. A missing file
+// is not an error. Only the system configuration may set the repository.
+func (cs *configSources) applyFile(path string, rank int) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	debugf("reading settings from %s", path)
+	var values map[string]interface{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for k, v := range values {
+		f := lookupSetting(cs.flags, k)
+		if f == nil {
+			debugf("%s: ignoring unknown setting %s", path, k)
+			continue
+		}
+		if f.Name == "repository" && rank > rankSystem {
+			continue
+		}
+		s, ok := settingString(f, v)
+		if !ok {
+			continue
+		}
+		if err := cs.set(f.Name, s, rank, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupSetting finds the flag for a key from a configuration file. Keys are
+// matched case insensitively, so old settings caches can still be read.
+func lookupSetting(flags *flag.FlagSet, key string) *flag.Flag {
+	if name, ok := legacyKeys[key]; ok {
+		key = name
+	}
+	if _, ok := flagAliases[key]; ok {
+		return nil
+	}
+	var found *flag.Flag
+	flags.VisitAll(func(f *flag.Flag) {
+		if found == nil && strings.EqualFold(f.Name, key) {
+			found = f
+		}
+	})
+	return found
+}
+
+// settingString converts a json value for the setting f to the string form
+// used on the command line. Returns false for null values.
+func settingString(f *flag.Flag, v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		// durations from a settings cache are nanoseconds
+		if g, ok := f.Value.(flag.Getter); ok {
+			if _, ok := g.Get().(time.Duration); ok {
+				return time.Duration(v).String(), true
+			}
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case []interface{}:
+		a := make([]string, 0, len(v))
+		for _, e := range v {
+			a = append(a, fmt.Sprint(e))
+		}
+		return strings.Join(a, " "), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// resolve parses args with cli and fills in all settings that were not given
+// on the command line. settings must contain all possible settings and be
+// bound to the same Config as cli. Precedence is: command line, environment,
+// repository configuration, settings of the last run (only if withCache is
+// set), system configuration, defaults.
+func (c *Config) resolve(cli, settings *flag.FlagSet, args []string, withCache bool) error {
+	cs := newConfigSources(settings)
+	if err := cli.Parse(args); err != nil {
+		return err
+	}
+	cli.Visit(func(f *flag.Flag) {
+		name := f.Name
+		if alias, ok := flagAliases[name]; ok {
+			name = alias
+		}
+		cs.rank[name] = rankFlag
+		cs.origin[name] = "flag -" + f.Name
+	})
+	if err := cs.applyEnv(); err != nil {
+		return err
+	}
+	// The location of the repository configuration depends on the
+	// repository, so that one has to be known before.
+	if err := cs.applyFile(sysConfigFile(), rankSystem); err != nil {
+		return err
+	}
+	if withCache {
+		if err := cs.applyFile(filepath.Join(c.repository, cacheName), rankCache); err != nil {
+			return err
+		}
+	}
+	if err := cs.applyFile(filepath.Join(c.repository, repoConfigName), rankRepository); err != nil {
+		return err
+	}
+	c.sources = cs
+	return nil
 }
 
 // WriteCache writes the global configuration to disk as a json file.
 func (c *Config) WriteCache() error {
-	cacheFile := filepath.Join(c.repository, "."+myName+".settings")
+	cacheFile := filepath.Join(c.repository, cacheName)
 	debugf("trying to write cached settings to %s", cacheFile)
 	jsonConfig, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
-		log.Println("could not write config:", err)
+		errorf("could not write config: %s", err)
 		return err
 	}
 	err = ioutil.WriteFile(cacheFile, jsonConfig, 0644)
 	return err
 }
 
-// ReadCache reads from the json configuration cache and resets assorted global
-// configuration values from it.
+// ReadCache reads from the json configuration cache and resets all settings
+// of the last run from it.
 func (c *Config) ReadCache() error {
 	t := new(Config)
-	cacheFile := filepath.Join(c.repository, "."+myName+".settings")
-	debugf("trying to read cached settings from %s", cacheFile)
-	b, err := ioutil.ReadFile(filepath.Join(c.repository, "."+myName+".settings"))
-	if err != nil {
+	cs := newConfigSources(t.settings())
+	cacheFile := filepath.Join(c.repository, cacheName)
+	if _, err := os.Stat(cacheFile); err != nil {
 		return err
 	}
-	err = json.Unmarshal(b, &t)
-	if err != nil {
+	if err := cs.applyFile(cacheFile, rankCache); err != nil {
 		return err
 	}
-	c.RsyncPath = t.RsyncPath
-	c.RsyncOpts = t.RsyncOpts
-	if t.SchedFile != "" {
-		c.SchedFile = t.SchedFile
-		schedules.addFromFile(c.SchedFile)
-	}
-	c.Origin = t.Origin
-	if _, ok := schedules[t.Schedule]; ok == false {
-		return fmt.Errorf("no such schedule: %s", t.Schedule)
-	}
-	c.Schedule = t.Schedule
-	c.MaxKeep = t.MaxKeep
-	c.NoPurge = t.NoPurge
-	c.MinPercSpace = t.MinPercSpace
-	c.MinGiBSpace = t.MinGiBSpace
+	t.repository = c.repository
+	t.verbose = c.verbose
+	t.showAll = c.showAll
+	t.noColor = c.noColor
+	t.listFormat = c.listFormat
+	t.tree = c.tree
+	t.sources = c.sources
+	*c = *t
+	if c.SchedFile != "" {
+		if err := schedules.addFromFile(c.SchedFile); err != nil {
+			return err
+		}
+	}
+	if _, ok := schedules[c.Schedule]; ok == false {
+		return fmt.Errorf("no such schedule: %s", c.Schedule)
+	}
 	return nil
 }
 
@@ -108,15 +367,199 @@ func usage() {
 	fmt.Printf("%s %s\n", myName, version)
 	fmt.Printf(`usage: %[1]s <command> <options>
 Commands:
-    run     Periodically create snapshots
-    list    List snapshots
-    scheds  List schedules
-    help    Show usage instructions
+    run       Periodically create snapshots
+    serve     Receive a snapshot pushed by rsync, as forced command of sshd
+    replicate Copy complete snapshots to another repository
+    export    Write a snapshot to a tar archive
+    import    Create a snapshot from a tar archive
+    list      List snapshots
+    scheds    List schedules
+    config    Show effective configuration ("config show")
+    log       Show the log of the repository
+    help      Show usage instructions
 Use <command> -h to show possible options for <command>.
+Settings not given on the command line are taken from environment variables
+(e. g. %[2]sMAXKEEP for -maxKeep), the repository configuration
+<repository>/%[3]s or the system configuration %[4]s,
+in this order.
 Examples:
     %[1]s run -origin=fileserver:/export/projects -repository=/snapshots/projects
     %[1]s list -repository=/snapshots/projects
-`, myName)
+    command="%[1]s serve -repository=/snapshots/laptop",restrict ssh-ed25519 AAAA... (in authorized_keys)
+    %[1]s replicate -from=/snapshots/projects -to=offsite:/snapshots/projects -targetSchedule=longterm
+    %[1]s export -repository=/snapshots/projects -snapshot=2d -format=tar.zst -o projects.tar.zst
+    %[1]s config show -repository=/snapshots/projects
+    %[1]s log -n 100 -since 1d -repository=/snapshots/projects
+`, myName, envPrefix, repoConfigName, defaultSysConfigFile)
+}
+
+// addRepositoryFlags defines the -repository flag and its shorthand.
+func (c *Config) addRepositoryFlags(flags *flag.FlagSet, usage string) {
+	flags.StringVar(&(c.repository),
+		"repository", defaultRepository,
+		usage)
+	flags.StringVar(&(c.repository),
+		"r", defaultRepository,
+		"(shorthand for -repository)")
+}
+
+// settings returns a flag set containing all settings that can be used with
+// the run command, bound to c.
+func (c *Config) settings() *flag.FlagSet {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.StringVar(&(c.RsyncPath),
+		"rsyncPath", "/usr/bin/rsync",
+		"path to rsync binary")
+	flags.Var(&(c.RsyncOpts),
+		"rsyncOpts",
+		"additional options for rsync")
+	flags.StringVar(&(c.Copier),
+		"copier", "rsync",
+		"how snapshots are copied from the origin, one of "+strings.Join(copierNames, ",")+". native only works with local origins")
+	flags.IntVar(&(c.CopyWorkers),
+		"copyWorkers", 4,
+		"with -copier=native, how many files to copy at the same time")
+	flags.DurationVar(&(c.MaxRsyncTime),
+		"maxRsyncTime", day,
+		"with a systemd watchdog, consider snaprd hanging if making a snapshot takes longer. Use 0 for no limit")
+	flags.StringVar(&(c.Origin),
+		"origin", "/tmp/snaprd_test/",
+		"data source")
+	c.addRepositoryFlags(flags, "where to store snapshots")
+	flags.StringVar(&(c.Schedule),
+		"schedule", "longterm",
+		"one of "+schedules.String())
+	flags.IntVar(&(c.MaxKeep),
+		"maxKeep", 0,
+		"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
+	flags.BoolVar(&(c.NoPurge),
+		"noPurge", false,
+		"if set, obsolete snapshots will not be deleted (minimum space requirements will still be honoured)")
+	flags.StringVar(&(c.Storage),
+		"storage", "hardlink",
+		"how snapshots are stored, one of "+strings.Join(storageNames, ","))
+	flags.IntVar(&(c.PurgeWorkers),
+		"purgeWorkers", 1,
+		"how many obsolete snapshots to delete at the same time")
+	flags.IntVar(&(c.PurgeWalkers),
+		"purgeWalkers", 4,
+		"how many directories of a snapshot to delete from at the same time")
+	flags.IntVar(&(c.PurgeRate),
+		"purgeRate", 0,
+		"maximum number of files deleted per second when purging. Use 0 for no limit")
+	flags.BoolVar(&(c.PurgeNice),
+		"purgeNice", false,
+		"if set, purge with the lowest CPU and I/O priority (linux only)")
+	flags.IntVar(&(c.PurgeAttempts),
+		"purgeAttempts", 3,
+		"how often to try purging a snapshot before it is quarantined")
+	flags.BoolVar(&(c.NoWait),
+		"noWait", false,
+		"if set, skip the initial waiting time before the first snapshot")
+	flags.BoolVar(&(c.NoLogDate),
+		"noLogDate", false,
+		"if set, does not print date and time in the log output. Useful if output is redirected to syslog")
+	flags.StringVar(&(c.SchedFile),
+		"schedFile", defaultSchedFileName,
+		"path to external schedules")
+	flags.Float64Var(&(c.MinPercSpace),
+		"minPercSpace", 0,
+		"if set, keep at least x% of the snapshots filesystem free")
+	flags.IntVar(&(c.MinGiBSpace),
+		"minGbSpace", 0,
+		"if set, keep at least x GiB of the snapshots filesystem free")
+	flags.StringVar(&(c.Notify),
+		"notify", "",
+		"specify an email address to send reports")
+	flags.StringVar(&(c.Anchor),
+		"anchor", "",
+		"if set, align snapshots to this time of day (HH:MM) instead of to the previous snapshot")
+	flags.StringVar(&(c.Blackout),
+		"blackout", "",
+		"comma separated list of time windows (HH:MM-HH:MM) during which no snapshot is started")
+	flags.BoolVar(&(c.Watch),
+		"watch", false,
+		"if set, only make a snapshot when files in the (local) origin have changed")
+	flags.DurationVar(&(c.WatchDebounce),
+		"watchDebounce", time.Second*30,
+		"with -watch, wait until the origin was unchanged for this long before making a snapshot")
+	flags.DurationVar(&(c.WatchMaxStale),
+		"watchMaxStale", day,
+		"with -watch, make a snapshot after this time even if no changes were seen")
+	flags.BoolVar(&(c.SkipUnchanged),
+		"skipUnchanged", false,
+		"if set, discard a new snapshot when rsync found no changes compared to the previous one")
+	flags.IntVar(&(c.LogSize),
+		"logSize", 1,
+		"maximum size in MiB of the log file kept in the repository before it is rotated. Use 0 to disable the log file")
+	flags.IntVar(&(c.LogKeep),
+		"logKeep", 3,
+		"how many rotated log files to keep in the repository")
+	flags.StringVar(&(c.LogFormat),
+		"logFormat", "text",
+		"format of the log output, one of "+strings.Join(logFormats, ","))
+	flags.StringVar(&(c.LogLevel),
+		"logLevel", "info",
+		"minimum level of log messages, one of "+strings.Join(logLevelNames, ","))
+	flags.StringVar(&(c.LogTarget),
+		"logTarget", "stderr",
+		"where to send log messages, one of "+strings.Join(logTargetNames, ","))
+	flags.StringVar(&(c.SysFacility),
+		"syslogFacility", "daemon",
+		"syslog facility to use with -logTarget=syslog")
+	flags.IntVar(&(c.LogBuffer),
+		"logBuffer", defaultLogBuffer,
+		"size in KiB of the recent log output kept in memory for failure mails")
+	flags.DurationVar(&(c.NotifyLog),
+		"notifyLog", time.Minute*15,
+		"with -notify, include the log output of this period in failure mails. Use 0 for everything kept in memory")
+	return flags
+}
+
+// checkPurge verifies the settings for purging.
+func (c *Config) checkPurge() error {
+	if c.PurgeWorkers < 1 {
+		return fmt.Errorf("-purgeWorkers must be at least 1: %d", c.PurgeWorkers)
+	}
+	if c.PurgeWalkers < 1 {
+		return fmt.Errorf("-purgeWalkers must be at least 1: %d", c.PurgeWalkers)
+	}
+	if c.PurgeAttempts < 1 {
+		return fmt.Errorf("-purgeAttempts must be at least 1: %d", c.PurgeAttempts)
+	}
+	if c.PurgeRate < 0 {
+		return fmt.Errorf("-purgeRate must not be negative: %d", c.PurgeRate)
+	}
+	return nil
+}
+
+// loadSchedules adds the schedules from the configured file and verifies the
+// configured schedule exists.
+func (c *Config) loadSchedules() error {
+	if c.SchedFile != "" {
+		err := schedules.addFromFile(c.SchedFile)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := schedules[c.Schedule]; ok == false {
+		return fmt.Errorf("no such schedule: %s\n", c.Schedule)
+	}
+	return nil
+}
+
+// show prints all settings with their values and where they came from.
+func (cs *configSources) show(w io.Writer) {
+	var names []string
+	cs.flags.VisitAll(func(f *flag.Flag) {
+		if _, ok := flagAliases[f.Name]; !ok {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%-14s %q (%s)\n", name, cs.flags.Lookup(name).Value.String(), cs.source(name))
+	}
 }
 
 func loadConfig() (*Config, error) {
@@ -126,64 +569,30 @@ func loadConfig() (*Config, error) {
 	} else {
 		return nil, errors.New("no subcommand given")
 	}
+	settings := config.settings()
 	switch subcmd {
 	case "run":
 		{
-			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
-			flags.StringVar(&(config.RsyncPath),
-				"rsyncPath", "/usr/bin/rsync",
-				"path to rsync binary")
-			flags.Var(&(config.RsyncOpts),
-				"rsyncOpts",
-				"additional options for rsync")
-			flags.StringVar(&(config.Origin),
-				"origin", "/tmp/snaprd_test/",
-				"data source")
-			flags.StringVar(&(config.repository),
-				"repository", defaultRepository,
-				"where to store snapshots")
-			flags.StringVar(&(config.repository),
-				"r", defaultRepository,
-				"(shorthand for -repository)")
-			flags.StringVar(&(config.Schedule),
-				"schedule", "longterm",
-				"one of "+schedules.String())
-			flags.IntVar(&(config.MaxKeep),
-				"maxKeep", 0,
-				"how many snapshots to keep in highest (oldest) interval. Use 0 to keep all")
-			flags.BoolVar(&(config.NoPurge),
-				"noPurge", false,
-				"if set, obsolete snapshots will not be deleted (minimum space requirements will still be honoured)")
-			flags.BoolVar(&(config.NoWait),
-				"noWait", false,
-				"if set, skip the initial waiting time before the first snapshot")
-			flags.BoolVar(&(config.NoLogDate),
-				"noLogDate", false,
-				"if set, does not print date and time in the log output. Useful if output is redirected to syslog")
-			flags.StringVar(&(config.SchedFile),
-				"schedFile", defaultSchedFileName,
-				"path to external schedules")
-			flags.Float64Var(&(config.MinPercSpace),
-				"minPercSpace", 0,
-				"if set, keep at least x% of the snapshots filesystem free")
-			flags.IntVar(&(config.MinGiBSpace),
-				"minGbSpace", 0,
-				"if set, keep at least x GiB of the snapshots filesystem free")
-			flags.StringVar(&(config.Notify),
-				"notify", "",
-				"specify an email address to send reports")
-
-			if err := flags.Parse(os.Args[2:]); err != nil {
+			if err := config.resolve(settings, settings, os.Args[2:], false); err != nil {
 				return nil, err
 			}
-			if config.SchedFile != "" {
-				err := schedules.addFromFile(config.SchedFile)
-				if err != nil {
-					return nil, err
-				}
+			if err := config.loadSchedules(); err != nil {
+				return nil, err
 			}
-			if _, ok := schedules[config.Schedule]; ok == false {
-				return nil, fmt.Errorf("no such schedule: %s\n", config.Schedule)
+			if _, err := newCalendar(schedules[config.Schedule][0], config.Anchor, config.Blackout); err != nil {
+				return nil, err
+			}
+			if config.Watch && !isLocalOrigin(config.Origin) {
+				return nil, fmt.Errorf("-watch only works with local origins: %s", config.Origin)
+			}
+			if err := config.checkPurge(); err != nil {
+				return nil, err
+			}
+			if err := checkStorage(config.Storage); err != nil {
+				return nil, err
+			}
+			if err := config.checkCopier(); err != nil {
+				return nil, err
 			}
 			path := filepath.Join(config.repository, dataSubdir)
 			debugf("creating repository: %s", path)
@@ -193,19 +602,40 @@ func loadConfig() (*Config, error) {
 			}
 			err = config.WriteCache()
 			if err != nil {
-				log.Print("could not write settings cache file:", err)
+				warnf("could not write settings cache file: %s", err)
+			}
+			return config, nil
+		}
+	case "serve":
+		{
+			if err := config.resolve(settings, settings, os.Args[2:], false); err != nil {
+				return nil, err
+			}
+			if err := config.loadSchedules(); err != nil {
+				return nil, err
+			}
+			if err := config.checkPurge(); err != nil {
+				return nil, err
+			}
+			if err := checkStorage(config.Storage); err != nil {
+				return nil, err
+			}
+			if client := strings.Fields(os.Getenv("SSH_CLIENT")); len(client) > 0 {
+				config.Origin = "push from " + client[0]
+			}
+			path := filepath.Join(config.repository, dataSubdir)
+			if err := os.MkdirAll(path, 00755); err != nil {
+				return nil, err
+			}
+			if err := config.WriteCache(); err != nil {
+				warnf("could not write settings cache file: %s", err)
 			}
 			return config, nil
 		}
 	case "list":
 		{
 			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
-			flags.StringVar(&(config.repository),
-				"repository", defaultRepository,
-				"where snapshots are located")
-			flags.StringVar(&(config.repository),
-				"r", defaultRepository,
-				"(shorthand for -repository)")
+			config.addRepositoryFlags(flags, "where snapshots are located")
 			flags.BoolVar(&(config.verbose),
 				"v", false,
 				"show more information")
@@ -221,21 +651,111 @@ func loadConfig() (*Config, error) {
 			flags.BoolVar(&(config.noColor),
 				"noColor", false,
 				"do not colorize list output")
+			flags.StringVar(&(config.listFormat),
+				"format", "text",
+				"output format, one of "+strings.Join(listFormats, ","))
+			flags.BoolVar(&(config.tree),
+				"tree", false,
+				"show snapshots as a tree of intervals, years, months and days")
+
+			if err := config.resolve(flags, settings, os.Args[2:], true); err != nil {
+				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
+			}
+			if err := config.loadSchedules(); err != nil {
+				return nil, err
+			}
+			if !validListFormat(config.listFormat) {
+				return nil, fmt.Errorf("unknown list format: %s", config.listFormat)
+			}
+			if config.tree && config.listFormat != "text" {
+				return nil, errors.New("-tree can only be used with text format")
+			}
+			debugf("cached config: %v", config)
+			return config, nil
+		}
+	case "replicate":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			flags.StringVar(&(config.repository),
+				"from", defaultRepository,
+				"repository to replicate")
+			flags.StringVar(&(config.replicaDest),
+				"to", "",
+				"repository to replicate to, a local path or [user@]host:path")
+			flags.StringVar(&(config.replicaSched),
+				"targetSchedule", "",
+				"prune the target with this schedule, one of "+schedules.String()+". Not pruned if empty")
+			flags.StringVar(&(config.RsyncPath),
+				"rsyncPath", "/usr/bin/rsync",
+				"path to rsync binary")
+			flags.StringVar(&(config.SchedFile),
+				"schedFile", defaultSchedFileName,
+				"path to external schedules")
 
-			if err := flags.Parse(os.Args[2:]); err != nil {
+			if err := config.resolve(flags, settings, os.Args[2:], true); err != nil {
 				return nil, err
 			}
+			if d := config.replicaDest; d == "" || strings.HasSuffix(d, ":") {
+				return nil, errors.New("-to must be the path of the target repository")
+			}
 			if config.SchedFile != "" {
-				err := schedules.addFromFile(config.SchedFile)
-				if err != nil {
+				if err := schedules.addFromFile(config.SchedFile); err != nil {
 					return nil, err
 				}
 			}
-			err := config.ReadCache()
-			if err != nil {
-				return nil, fmt.Errorf("error reading repository settings: %s\n", err)
+			if _, ok := schedules[config.replicaSched]; config.replicaSched != "" && !ok {
+				return nil, fmt.Errorf("no such schedule: %s", config.replicaSched)
+			}
+			return config, nil
+		}
+	case "export":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			config.addRepositoryFlags(flags, "where snapshots are located")
+			flags.StringVar(&(config.archiveSnap),
+				"snapshot", "",
+				"name of the snapshot, or a time like \"2h\" or \"2006-01-02 15:04\" to export the youngest snapshot started before")
+			flags.StringVar(&(config.archivePath),
+				"path", "",
+				"only export this directory within the snapshot")
+			flags.StringVar(&(config.archiveFormat),
+				"format", "tar",
+				"archive format, one of "+strings.Join(archiveFormats, ","))
+			flags.StringVar(&(config.archiveFile),
+				"o", "-",
+				"file to write the archive to, - for the standard output")
+
+			if err := config.resolve(flags, settings, os.Args[2:], true); err != nil {
+				return nil, err
+			}
+			if config.archiveSnap == "" {
+				return nil, errors.New("-snapshot must be given")
+			}
+			if !validArchiveFormat(config.archiveFormat) {
+				return nil, fmt.Errorf("unknown archive format: %s", config.archiveFormat)
+			}
+			return config, nil
+		}
+	case "import":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			config.addRepositoryFlags(flags, "where snapshots are located")
+			flags.StringVar(&(config.archiveFile),
+				"i", "-",
+				"file to read the archive from, - for the standard input")
+
+			if err := config.resolve(flags, settings, os.Args[2:], true); err != nil {
+				return nil, err
+			}
+			if err := checkStorage(config.Storage); err != nil {
+				return nil, err
+			}
+			if config.Storage == "zfs" {
+				return nil, errors.New("import is not supported with -storage=zfs")
+			}
+			if err := os.MkdirAll(filepath.Join(config.repository, dataSubdir), 00755); err != nil {
+				return nil, err
 			}
-			debugf("cached config: %v", config)
 			return config, nil
 		}
 	case "help", "-h", "--help":
@@ -250,11 +770,50 @@ func loadConfig() (*Config, error) {
 				"schedFile", defaultSchedFileName,
 				"path to external schedules")
 
-			if err := flags.Parse(os.Args[2:]); err != nil {
+			if err := config.resolve(flags, settings, os.Args[2:], false); err != nil {
 				return nil, err
 			}
 			if config.SchedFile != "" {
-				schedules.addFromFile(config.SchedFile)
+				if err := schedules.addFromFile(config.SchedFile); err != nil {
+					return nil, err
+				}
+			}
+			return config, nil
+		}
+	case "log":
+		{
+			flags := flag.NewFlagSet(subcmd, flag.ContinueOnError)
+			config.addRepositoryFlags(flags, "where snapshots are located")
+			flags.IntVar(&(config.logLines),
+				"n", 20,
+				"show the last n lines. Use 0 to show all")
+			flags.BoolVar(&(config.logFollow),
+				"follow", false,
+				"wait for new lines and show them as they are written")
+			flags.StringVar(&(config.logSince),
+				"since", "",
+				"only show lines written after this time, either a duration like \"2h\" or a date like \"2006-01-02 15:04\"")
+			flags.StringVar(&(config.logSnapshot),
+				"snapshot", "",
+				"only show lines about the named snapshot")
+
+			if err := config.resolve(flags, settings, os.Args[2:], false); err != nil {
+				return nil, err
+			}
+			if config.logSince != "" {
+				if _, err := parseSince(config.logSince, time.Now()); err != nil {
+					return nil, err
+				}
+			}
+			return config, nil
+		}
+	case "config":
+		{
+			if len(os.Args) < 3 || os.Args[2] != "show" {
+				return nil, errors.New("usage: config show [<run options>]")
+			}
+			if err := config.resolve(settings, settings, os.Args[3:], false); err != nil {
+				return nil, err
 			}
 			return config, nil
 		}
@@ -0,0 +1,72 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigResolve(t *testing.T) {
+	repository := mockConfig().config.repository
+	defer os.RemoveAll(repository)
+	sysConfig := filepath.Join(repository, "system.conf")
+	ioutil.WriteFile(sysConfig, []byte(`{
+		"repository": "`+repository+`",
+		"maxKeep": 3,
+		"schedule": "shortterm",
+		"notify": "system"
+	}`), 0644)
+	ioutil.WriteFile(filepath.Join(repository, repoConfigName), []byte(`{
+		"maxKeep": 5,
+		"notify": "repository",
+		"origin": "repository:/export",
+		"rsyncOpts": ["--exclude=tmp", "-H"]
+	}`), 0644)
+	os.Setenv(envPrefix+"CONFIG", sysConfig)
+	os.Setenv(envPrefix+"NOTIFY", "env")
+	defer os.Unsetenv(envPrefix + "CONFIG")
+	defer os.Unsetenv(envPrefix + "NOTIFY")
+
+	c := new(Config)
+	settings := c.settings()
+	err := c.resolve(settings, settings, []string{"-origin=/flag"}, false)
+	if err != nil {
+		t.Fatalf("resolve() gave error %v", err)
+	}
+	var tests = []struct {
+		name, value, source string
+	}{
+		{"repository", repository, sysConfig},
+		{"origin", "/flag", "flag -origin"},
+		{"notify", "env", "env SNAPRD_NOTIFY"},
+		{"maxKeep", "5", filepath.Join(repository, repoConfigName)},
+		{"rsyncOpts", "--exclude=tmp -H", filepath.Join(repository, repoConfigName)},
+		{"schedule", "shortterm", sysConfig},
+		{"rsyncPath", "/usr/bin/rsync", "default"},
+	}
+	for _, tt := range tests {
+		if got := settings.Lookup(tt.name).Value.String(); got != tt.value {
+			t.Errorf("%s is %q, wanted %q", tt.name, got, tt.value)
+		}
+		if got := c.sources.source(tt.name); got != tt.source {
+			t.Errorf("%s comes from %q, wanted %q", tt.name, got, tt.source)
+		}
+	}
+}
+
+func TestReadLegacyCache(t *testing.T) {
+	schedules.addFromFile("testdata/snaprd.schedules")
+	c := &Config{repository: "testdata"}
+	if err := c.ReadCache(); err != nil {
+		t.Fatalf("ReadCache() gave error %v", err)
+	}
+	if c.Schedule != "testing" || !c.NoWait || c.MaxKeep != 2 || c.RsyncOpts != nil {
+		t.Errorf("settings not restored from legacy cache: %+v", c)
+	}
+	if c.repository != "testdata" {
+		t.Errorf("repository changed to %s", c.repository)
+	}
+}
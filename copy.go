@@ -0,0 +1,448 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Creation of snapshots of local origins without rsync
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// copierNames are the possible arguments to -copier.
+var copierNames = []string{"rsync", "native"}
+
+// checkCopier returns an error if the copier selected in c can not be used.
+func (c *Config) checkCopier() error {
+	switch c.Copier {
+	case "", "rsync":
+		return nil
+	case "native":
+	default:
+		return fmt.Errorf("unknown copier: %s, use one of %s", c.Copier, strings.Join(copierNames, ","))
+	}
+	if !isLocalOrigin(c.Origin) {
+		return fmt.Errorf("-copier=native only works with local origins: %s", c.Origin)
+	}
+	if c.Storage != "" && c.Storage != "hardlink" {
+		return fmt.Errorf("-copier=native only works with -storage=hardlink")
+	}
+	if len(c.RsyncOpts) > 0 {
+		return fmt.Errorf("-copier=native does not support -rsyncOpts: %s", strings.Join(c.RsyncOpts, " "))
+	}
+	if c.CopyWorkers < 1 {
+		return fmt.Errorf("-copyWorkers must be at least 1: %d", c.CopyWorkers)
+	}
+	return nil
+}
+
+// nativeCopier copies a local origin into a new snapshot, like rsync -a
+// --delete --link-dest does: files that did not change since the base
+// snapshot are hard links to it, the others are copied by several workers
+// at the same time. Ownership (when running as root), permissions,
+// modification times, extended attributes including ACLs, symlinks and
+// special files are preserved.
+type nativeCopier struct {
+	// origin is copied like rsync does it: with a trailing slash its
+	// contents are copied to dest, without it the directory itself
+	origin string
+	dest   string
+	// base is the snapshot unchanged files are linked to, may be empty
+	base    string
+	workers int
+	// owner is true if ownership can be preserved
+	owner bool
+
+	mu  sync.Mutex
+	err error
+	// errors is the number of files that could not be copied
+	errors int
+	// dirs are the directories whose metadata is set after all files are
+	// copied, children before their parents
+	dirs []copyJob
+	jobs chan copyJob
+
+	// statistics, the ones changed by the workers are updated atomically
+	files, regular, dirCount, links int64
+	created, deleted, transferred   int64
+	totalSize, transferredSize      int64
+}
+
+// copyJob is a file in the origin and where it goes.
+type copyJob struct {
+	src, dst, base string
+	fi             os.FileInfo
+}
+
+func newNativeCopier(origin, dest, base string, workers int) *nativeCopier {
+	return &nativeCopier{
+		origin:  origin,
+		dest:    dest,
+		base:    base,
+		workers: workers,
+		owner:   os.Geteuid() == 0,
+	}
+}
+
+// partialTransferError is returned if some files could not be copied, like
+// rsync error 23. The snapshot is still usable.
+type partialTransferError struct {
+	errors int
+	first  error
+}
+
+func (e *partialTransferError) Error() string {
+	return fmt.Sprintf("%d files could not be copied, the first error was: %s", e.errors, e.first)
+}
+
+// run copies the origin. If ctx is done before, ctx.Err() is returned and
+// whatever was copied so far is reused by the next run with the same dest.
+func (nc *nativeCopier) run(ctx context.Context) error {
+	src := filepath.Clean(nc.origin)
+	dst, base := nc.dest, nc.base
+	if !strings.HasSuffix(nc.origin, "/") {
+		dst = filepath.Join(dst, filepath.Base(src))
+		if base != "" {
+			base = filepath.Join(base, filepath.Base(src))
+		}
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("origin is not a directory: %s", nc.origin)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	workers := nc.workers
+	if workers < 1 {
+		workers = 1
+	}
+	nc.jobs = make(chan copyJob, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range nc.jobs {
+				if ctx.Err() == nil {
+					nc.copyFile(ctx, job)
+				}
+			}
+		}()
+	}
+	nc.walkDir(ctx, copyJob{src, dst, base, fi})
+	close(nc.jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, d := range nc.dirs {
+		nc.setMeta(d.src, d.dst, d.fi)
+	}
+	if nc.err != nil {
+		return &partialTransferError{nc.errors, nc.err}
+	}
+	return nil
+}
+
+// walkDir makes job.dst a copy of the directory job.src. Regular files are
+// handed to the workers, everything else is done right away.
+func (nc *nativeCopier) walkDir(ctx context.Context, job copyJob) {
+	nc.files++
+	nc.dirCount++
+	if fi, err := os.Lstat(job.dst); err == nil && !fi.IsDir() {
+		nc.removeStale(job.dst)
+	}
+	if err := os.Mkdir(job.dst, 0700); err == nil {
+		atomic.AddInt64(&nc.created, 1)
+	} else if !os.IsExist(err) {
+		nc.fail(err)
+		return
+	} else if err := ownerAccess(job.dst); err != nil {
+		nc.fail(err)
+		return
+	}
+	entries, err := readDir(job.src)
+	if err != nil {
+		nc.vanishedOrFail(err)
+		return
+	}
+	// like rsync --delete, for snapshots that are made again
+	names := make(map[string]bool, len(entries))
+	for _, fi := range entries {
+		names[fi.Name()] = true
+	}
+	if old, err := readDir(job.dst); err == nil {
+		for _, fi := range old {
+			if !names[fi.Name()] {
+				nc.removeStale(filepath.Join(job.dst, fi.Name()))
+			}
+		}
+	}
+	for _, fi := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		child := copyJob{
+			src: filepath.Join(job.src, fi.Name()),
+			dst: filepath.Join(job.dst, fi.Name()),
+			fi:  fi,
+		}
+		if job.base != "" {
+			child.base = filepath.Join(job.base, fi.Name())
+		}
+		switch {
+		case fi.IsDir():
+			nc.walkDir(ctx, child)
+		case fi.Mode().IsRegular():
+			nc.files++
+			nc.regular++
+			nc.totalSize += fi.Size()
+			nc.jobs <- child
+		case fi.Mode()&os.ModeSymlink != 0:
+			nc.files++
+			nc.links++
+			nc.copySymlink(child)
+		default:
+			nc.files++
+			nc.copySpecial(child)
+		}
+	}
+	nc.dirs = append(nc.dirs, job)
+}
+
+// copyFile links or copies the regular file job.src.
+func (nc *nativeCopier) copyFile(ctx context.Context, job copyJob) {
+	if fi, err := os.Lstat(job.dst); err == nil {
+		if sameFile(job.fi, fi) {
+			return
+		}
+		nc.removeStale(job.dst)
+	}
+	if job.base != "" {
+		if fi, err := os.Lstat(job.base); err == nil && sameFile(job.fi, fi) {
+			if err := os.Link(job.base, job.dst); err == nil {
+				atomic.AddInt64(&nc.created, 1)
+				return
+			}
+		}
+	}
+	in, err := os.Open(job.src)
+	if err != nil {
+		nc.vanishedOrFail(err)
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(job.dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		nc.fail(err)
+		return
+	}
+	n, err := io.Copy(out, &ctxReader{ctx, in})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(job.dst)
+		if ctx.Err() == nil {
+			nc.fail(err)
+		}
+		return
+	}
+	atomic.AddInt64(&nc.created, 1)
+	atomic.AddInt64(&nc.transferred, 1)
+	atomic.AddInt64(&nc.transferredSize, n)
+	nc.setMeta(job.src, job.dst, job.fi)
+}
+
+// copySymlink recreates the symlink job.src, including its modification time.
+func (nc *nativeCopier) copySymlink(job copyJob) {
+	target, err := os.Readlink(job.src)
+	if err != nil {
+		nc.vanishedOrFail(err)
+		return
+	}
+	if old, err := os.Readlink(job.dst); err != nil || old != target {
+		nc.removeStale(job.dst)
+		if err := os.Symlink(target, job.dst); err != nil {
+			nc.fail(err)
+			return
+		}
+		atomic.AddInt64(&nc.created, 1)
+	}
+	if nc.owner {
+		if st, ok := job.fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(job.dst, int(st.Uid), int(st.Gid)); err != nil {
+				nc.fail(err)
+			}
+		}
+	}
+	if err := lutimes(job.dst, job.fi.ModTime()); err != nil {
+		nc.fail(err)
+	}
+}
+
+// copySpecial recreates the device, fifo or socket job.src.
+func (nc *nativeCopier) copySpecial(job copyJob) {
+	st, ok := job.fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	if fi, err := os.Lstat(job.dst); err == nil && sameFile(job.fi, fi) {
+		return
+	}
+	nc.removeStale(job.dst)
+	if err := mknod(job.dst, st); err != nil {
+		nc.fail(&os.PathError{Op: "mknod", Path: job.dst, Err: err})
+		return
+	}
+	atomic.AddInt64(&nc.created, 1)
+	nc.setMeta(job.src, job.dst, job.fi)
+}
+
+// setMeta gives dst the ownership, permissions, extended attributes and
+// modification time of src.
+func (nc *nativeCopier) setMeta(src, dst string, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && nc.owner {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			nc.fail(err)
+		}
+	}
+	// after chown, which clears the setuid bit
+	if err := os.Chmod(dst, fi.Mode()); err != nil {
+		nc.fail(err)
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		nc.fail(err)
+	}
+	if err := os.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+		nc.fail(err)
+	}
+}
+
+// removeStale removes something at path that does not belong there.
+func (nc *nativeCopier) removeStale(path string) {
+	n, err := (&treeRemover{walkers: 1}).removeAll(context.Background(), path)
+	atomic.AddInt64(&nc.deleted, n)
+	if err != nil {
+		nc.fail(err)
+	}
+}
+
+// vanishedOrFail records err, unless the file has vanished from the origin
+// in the meantime, which is harmless.
+func (nc *nativeCopier) vanishedOrFail(err error) {
+	if os.IsNotExist(err) {
+		return
+	}
+	nc.fail(err)
+}
+
+// fail records an error for a single file.
+func (nc *nativeCopier) fail(err error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.errors++
+	if nc.err == nil {
+		nc.err = err
+	}
+}
+
+// statsLines returns the statistics of the last run in the format of rsync
+// --stats.
+func (nc *nativeCopier) statsLines() []string {
+	return []string{
+		fmt.Sprintf("Number of files: %s (reg: %s, dir: %s, link: %s)", commas(nc.files), commas(nc.regular), commas(nc.dirCount), commas(nc.links)),
+		fmt.Sprintf("Number of created files: %s", commas(nc.created)),
+		fmt.Sprintf("Number of deleted files: %s", commas(nc.deleted)),
+		fmt.Sprintf("Number of regular files transferred: %s", commas(nc.transferred)),
+		fmt.Sprintf("Total file size: %s bytes", commas(nc.totalSize)),
+		fmt.Sprintf("Total transferred file size: %s bytes", commas(nc.transferredSize)),
+	}
+}
+
+// sameFile returns true if a and b have the same type, permissions, size,
+// modification time and owner, like rsync -a compares files.
+func sameFile(a, b os.FileInfo) bool {
+	if a.Mode() != b.Mode() || a.Size() != b.Size() || !a.ModTime().Equal(b.ModTime()) {
+		return false
+	}
+	sa, ok1 := a.Sys().(*syscall.Stat_t)
+	sb, ok2 := b.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		return true
+	}
+	return sa.Uid == sb.Uid && sa.Gid == sb.Gid && sa.Rdev == sb.Rdev
+}
+
+// readDir returns the entries of the directory path, in no particular order.
+func readDir(path string) ([]os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+// commas formats n with thousands separators, like rsync does.
+func commas(n int64) string {
+	s := fmt.Sprint(n)
+	for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// ctxReader stops reading when ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// runNativeCopier starts copying the origin into sn with a nativeCopier. It
+// returns a channel the result is sent to, and a function stopping the copy.
+// The statistics are parsed into stats, which must not be used before the
+// result was received.
+func (r *Repository) runNativeCopier(sn, base snapshot, stats *rsyncStats) (chan error, func() error) {
+	nc := newNativeCopier(r.config.Origin, r.store.target(sn.Name()), "", r.config.CopyWorkers)
+	if !base.isZero() {
+		nc.base = r.snapshotPath(base)
+	}
+	r.snapLog(sn).infof("copying %s to %s, unchanged files linked to %s", nc.origin, nc.dest, baseName(base))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		defer cancel()
+		start := time.Now()
+		err := nc.run(ctx)
+		for _, line := range nc.statsLines() {
+			r.log.infof("(copy) %s", line)
+			stats.parseLine(line)
+		}
+		r.log.debugf("copy finished in %s", time.Since(start).Round(time.Millisecond))
+		done <- err
+	}()
+	return done, func() error {
+		cancel()
+		return nil
+	}
+}
@@ -0,0 +1,210 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mockOrigin creates a small origin with the usual kinds of files below dir.
+func mockOrigin(t *testing.T, dir string) string {
+	origin := filepath.Join(dir, "origin")
+	mtime := time.Unix(1400337531, 0)
+	for _, d := range []string{"", "sub", "sub/deep", "readonly"} {
+		if err := os.MkdirAll(filepath.Join(origin, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a", "sub/b", "sub/deep/c", "readonly/d"} {
+		path := filepath.Join(origin, f)
+		if err := ioutil.WriteFile(path, []byte("contents of "+f), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	os.Chmod(filepath.Join(origin, "sub/b"), 0600)
+	os.Symlink("sub/b", filepath.Join(origin, "link"))
+	lutimes(filepath.Join(origin, "link"), mtime)
+	syscall.Mkfifo(filepath.Join(origin, "fifo"), 0640)
+	os.Chmod(filepath.Join(origin, "readonly"), 0555)
+	return origin
+}
+
+// removeTestDir removes dir, including read-only directories within.
+func removeTestDir(dir string) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0755)
+		}
+		return nil
+	})
+	os.RemoveAll(dir)
+}
+
+// compareTrees reports all differences between the trees a and b that
+// rsync -a would care about.
+func compareTrees(t *testing.T, a, b string) {
+	filepath.Walk(a, func(path string, fa os.FileInfo, err error) error {
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		rel, _ := filepath.Rel(a, path)
+		fb, err := os.Lstat(filepath.Join(b, rel))
+		if err != nil {
+			t.Errorf("%s is missing: %v", rel, err)
+			return nil
+		}
+		if fa.Mode() != fb.Mode() {
+			t.Errorf("%s has mode %s, wanted %s", rel, fb.Mode(), fa.Mode())
+		}
+		switch {
+		case fa.Mode().IsRegular():
+			ca, _ := ioutil.ReadFile(path)
+			cb, _ := ioutil.ReadFile(filepath.Join(b, rel))
+			if string(ca) != string(cb) || !fa.ModTime().Equal(fb.ModTime()) {
+				t.Errorf("%s differs", rel)
+			}
+		case fa.Mode()&os.ModeSymlink != 0:
+			ta, _ := os.Readlink(path)
+			tb, _ := os.Readlink(filepath.Join(b, rel))
+			if ta != tb {
+				t.Errorf("%s points to %s, wanted %s", rel, tb, ta)
+			}
+			if runtime.GOOS == "linux" && !fa.ModTime().Equal(fb.ModTime()) {
+				t.Errorf("symlink %s has mtime %s, wanted %s", rel, fb.ModTime(), fa.ModTime())
+			}
+		case fa.IsDir() && rel != ".":
+			if !fa.ModTime().Equal(fb.ModTime()) {
+				t.Errorf("directory %s has mtime %s, wanted %s", rel, fb.ModTime(), fa.ModTime())
+			}
+		}
+		return nil
+	})
+}
+
+// copyStats runs nc and returns the statistics it reported.
+func copyStats(t *testing.T, nc *nativeCopier) *rsyncStats {
+	if err := nc.run(context.Background()); err != nil {
+		t.Fatalf("run() gave error %v", err)
+	}
+	stats := newRsyncStats()
+	for _, line := range nc.statsLines() {
+		stats.parseLine(line)
+	}
+	return stats
+}
+
+func TestNativeCopier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeTestDir(dir)
+	origin := mockOrigin(t, dir)
+	first := filepath.Join(dir, "first")
+	stats := copyStats(t, newNativeCopier(origin+"/", first, "", 2))
+	compareTrees(t, origin, first)
+	if *stats != (rsyncStats{10, 4, 0}) {
+		t.Errorf("first copy gave statistics %+v", *stats)
+	}
+
+	// only the changed file is copied, the others are linked
+	ioutil.WriteFile(filepath.Join(origin, "sub/deep/c"), []byte("changed"), 0644)
+	second := filepath.Join(dir, "second")
+	stats = copyStats(t, newNativeCopier(origin+"/", second, first, 2))
+	compareTrees(t, origin, second)
+	if *stats != (rsyncStats{10, 1, 0}) {
+		t.Errorf("second copy gave statistics %+v", *stats)
+	}
+	for f, linked := range map[string]bool{"a": true, "readonly/d": true, "sub/deep/c": false} {
+		fa, _ := os.Stat(filepath.Join(first, f))
+		fb, _ := os.Stat(filepath.Join(second, f))
+		if os.SameFile(fa, fb) != linked {
+			t.Errorf("%s linked to the base: %v, wanted %v", f, !linked, linked)
+		}
+	}
+
+	// a copy made again only removes what is gone from the origin
+	os.Remove(filepath.Join(origin, "a"))
+	stats = copyStats(t, newNativeCopier(origin+"/", second, first, 2))
+	compareTrees(t, origin, second)
+	if *stats != (rsyncStats{9, 0, 1}) {
+		t.Errorf("repeated copy gave statistics %+v", *stats)
+	}
+
+	// without a trailing slash the directory itself is copied
+	third := filepath.Join(dir, "third")
+	copyStats(t, newNativeCopier(origin, third, "", 1))
+	compareTrees(t, origin, filepath.Join(third, "origin"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newNativeCopier(origin, filepath.Join(dir, "fourth"), "", 1).run(ctx); err != context.Canceled {
+		t.Errorf("canceled run() gave error %v", err)
+	}
+}
+
+func TestNativeCopierSnapshot(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	os.MkdirAll(r.path(dataSubdir), 0755)
+	origin := filepath.Join(r.path(), "origin")
+	os.Mkdir(origin, 0755)
+	ioutil.WriteFile(filepath.Join(origin, "file"), []byte("data"), 0644)
+	r.config.Origin = origin + "/"
+	r.config.Copier = "native"
+	r.config.CopyWorkers = 2
+	r.config.RsyncPath = "/nonexistent/rsync"
+	if err := r.config.checkCopier(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := r.createSnapshot(context.Background(), snapshot{})
+	if err != nil {
+		t.Fatalf("createSnapshot() gave error %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(r.snapshotPath(first), "file")); err != nil || string(b) != "data" {
+		t.Errorf("snapshot does not contain the origin: %q, %v", b, err)
+	}
+	r.cl.(*skewClock).forward(time.Minute)
+	second, err := r.createSnapshot(context.Background(), first)
+	if err != nil {
+		t.Fatalf("createSnapshot() gave error %v", err)
+	}
+	fa, _ := os.Stat(filepath.Join(r.snapshotPath(first), "file"))
+	fb, _ := os.Stat(filepath.Join(r.snapshotPath(second), "file"))
+	if !os.SameFile(fa, fb) {
+		t.Errorf("unchanged file was not linked to the base snapshot")
+	}
+	meta, _ := r.readMeta()
+	if m := meta[metaKey(second)]; m.Files != 2 {
+		t.Errorf("%d files recorded, wanted 2", m.Files)
+	}
+}
+
+func TestCheckCopier(t *testing.T) {
+	for _, tc := range []struct {
+		c  Config
+		ok bool
+	}{
+		{Config{Copier: "rsync", Origin: "host:/data"}, true},
+		{Config{Copier: "native", Origin: "/data", CopyWorkers: 1}, true},
+		{Config{Copier: "native", Origin: "host:/data", CopyWorkers: 1}, false},
+		{Config{Copier: "native", Origin: "/data", CopyWorkers: 1, Storage: "zfs"}, false},
+		{Config{Copier: "native", Origin: "/data"}, false},
+		{Config{Copier: "native", Origin: "/data", CopyWorkers: 1, RsyncOpts: opts{"--exclude=*.tmp"}}, false},
+		{Config{Copier: "rsync", Origin: "/data", RsyncOpts: opts{"--exclude=*.tmp"}}, true},
+		{Config{Copier: "cp", Origin: "/data"}, false},
+	} {
+		if err := tc.c.checkCopier(); (err == nil) != tc.ok {
+			t.Errorf("checkCopier() for %s %s gave %v", tc.c.Copier, tc.c.Origin, err)
+		}
+	}
+}
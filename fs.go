@@ -5,11 +5,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"syscall"
 )
@@ -17,29 +18,25 @@ import (
 // GiB is exactly one gibibyte (2^30)
 const GiB = 1024 * 1024 * 1024
 
-// checkFreeSpace verifies the space constraints specified by the user. Return
-// true if all the constraints are satisfied, or in case something unusual
-// happens.
-func checkFreeSpace(baseDir string, minPerc float64, minGiB int) bool {
+// checkFreeSpace verifies the space constraints specified by the user for
+// the storage st, logging to l. Return true if all the constraints are
+// satisfied, or in case something unusual happens.
+func checkFreeSpace(l *structLogger, st storage, minPerc float64, minGiB int) bool {
 	// This is just to avoid the system call if there is nothing to check
 	if minPerc <= 0 && minGiB <= 0 {
 		return true
 	}
 
-	var stats syscall.Statfs_t
-	debugf("Trying to check free space in %s", baseDir)
-	err := syscall.Statfs(baseDir, &stats)
+	l.debugf("Trying to check free space")
+	freeBytes, sizeBytes, err := st.free()
 	if err != nil {
-		log.Println("could not check free space:", err)
+		l.warnf("could not check free space: %s", err)
 		// We cannot return false if there is an error, otherwise we risk
 		// deleting more than we should
 		return true
 	}
 
-	sizeBytes := uint64(stats.Bsize) * stats.Blocks
-	freeBytes := uint64(stats.Bsize) * stats.Bfree
-
-	debugf("We have %f GiB, and %f GiB of them are free.", float64(sizeBytes)/GiB, float64(freeBytes)/GiB)
+	l.debugf("We have %f GiB, and %f GiB of them are free.", float64(sizeBytes)/GiB, float64(freeBytes)/GiB)
 
 	// The actual check... we fail it we are below either the absolute or the
 	// relative value
@@ -51,39 +48,56 @@ func checkFreeSpace(baseDir string, minPerc float64, minGiB int) bool {
 	return true
 }
 
+// diskSpace returns the free and the total bytes of the filesystem baseDir
+// is on.
+func diskSpace(baseDir string) (freeBytes, sizeBytes uint64, err error) {
+	var stats syscall.Statfs_t
+	if err := syscall.Statfs(baseDir, &stats); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stats.Bsize) * stats.Bfree, uint64(stats.Bsize) * stats.Blocks, nil
+}
+
 // updateSymlinks creates user-friendly symlinks to all complete snapshots. It
 // also removes symlinks to snapshots that have been purged.
-func updateSymlinks() {
-	entries, err := ioutil.ReadDir(config.repository)
+func (r *Repository) updateSymlinks() {
+	if _, ok := r.store.(unlinkedStorage); ok {
+		return
+	}
+	entries, err := ioutil.ReadDir(r.path())
 	if err != nil {
-		log.Println("could not read repository directory", config.repository)
+		r.log.errorf("could not read repository directory %s", r.path())
 		return
 	}
 	for _, f := range entries {
-		pathName := path.Join(config.repository, f.Name())
+		pathName := r.path(f.Name())
 		if isDanglingSymlink(pathName) {
-			debugf("symlink %s is dangling, remove", pathName)
+			r.log.debugf("symlink %s is dangling, remove", pathName)
 			err := os.Remove(pathName)
 			if err != nil {
-				log.Println("could not remove link", pathName)
+				r.log.warnf("could not remove link %s", pathName)
 			}
 		}
 	}
-	cl := new(realClock)
-	snapshots, err := findSnapshots(cl)
+	snapshots, err := r.findSnapshots()
 	if err != nil {
-		log.Println("could not list snapshots")
+		r.log.errorf("could not list snapshots")
 		return
 	}
 	for _, s := range snapshots.state(stateComplete, none) {
-		target := path.Join(dataSubdir, s.Name())
-		stime := s.startTime.Format("Monday_2006-01-02_15.04.05")
-		linkname := path.Join(config.repository, stime)
+		target := r.snapshotLink(s)
+		linkname := r.path(symlinkName(s))
 		overwriteSymlink(target, linkname)
 	}
 	return
 }
 
+// symlinkName returns the name of the user-friendly symlink for a complete
+// snapshot.
+func symlinkName(s snapshot) string {
+	return s.startTime.Format("Monday_2006-01-02_15.04.05")
+}
+
 // isDanglingSymlink returns true only if linkname is a relative symlink
 // pointing to a non-existing path in dataSubdir.
 func isDanglingSymlink(linkname string) bool {
@@ -107,6 +121,14 @@ func isDanglingSymlink(linkname string) bool {
 	return false
 }
 
+// updateLatest points the latest symlink to sn.
+func (r *Repository) updateLatest(sn snapshot) {
+	if _, ok := r.store.(unlinkedStorage); ok {
+		return
+	}
+	overwriteSymlink(r.snapshotLink(sn), r.path("latest"))
+}
+
 // overwriteSymlink creates a symbolic link from linkname to target. It will
 // overwrite an already existing link under linkname, but not if it finds a
 // regular file or directory (or anything else which is not a symlink) under
@@ -146,3 +168,68 @@ func overwriteSymlink(target, linkname string) (err error) {
 	}
 	return
 }
+
+// errTreesDiffer stops walking a tree in sameTree.
+var errTreesDiffer = errors.New("trees differ")
+
+// sameTree returns true if the trees below a and b contain the same names,
+// and every entry looks the same in both: of the same type, with the same
+// permissions and owner, files of the same size and modification time, and
+// symlinks pointing to the same target. File contents are not compared,
+// neither does rsync by default. The directories a and b themselves are not
+// compared.
+func sameTree(a, b string) (bool, error) {
+	entries := 0
+	err := filepath.Walk(b, func(pb string, fb os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if pb == b {
+			return nil
+		}
+		pa := filepath.Join(a, strings.TrimPrefix(pb, b))
+		fa, err := os.Lstat(pa)
+		if err != nil || !sameEntry(pa, pb, fa, fb) {
+			return errTreesDiffer
+		}
+		entries++
+		return nil
+	})
+	if err == errTreesDiffer {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = filepath.Walk(a, func(pa string, fa os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if pa != a {
+			entries--
+		}
+		return nil
+	})
+	return err == nil && entries == 0, err
+}
+
+// sameEntry compares the entries a at path pa and b at path pb for sameTree.
+func sameEntry(pa, pb string, a, b os.FileInfo) bool {
+	if a.Mode() != b.Mode() {
+		return false
+	}
+	sa, oka := a.Sys().(*syscall.Stat_t)
+	sb, okb := b.Sys().(*syscall.Stat_t)
+	if !oka || !okb || sa.Uid != sb.Uid || sa.Gid != sb.Gid {
+		return false
+	}
+	switch {
+	case a.Mode().IsRegular():
+		return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+	case a.Mode()&os.ModeSymlink != 0:
+		ta, erra := os.Readlink(pa)
+		tb, errb := os.Readlink(pb)
+		return erra == nil && errb == nil && ta == tb
+	}
+	return true
+}
@@ -28,45 +28,47 @@ func TestCheckFreeSpace(t *testing.T) {
 	var actualFreePerc = 100 * float64(data.Bfree) / float64(data.Blocks)
 	var actualFreeGiB = int(uint64(data.Bsize) * data.Bfree / GiB)
 
+	st := &hardlinkStorage{root: testDir}
+
 	// Now, let's make a quick run of the test
 	var result bool
-	result = checkFreeSpace(testDir, 0, 0)
+	result = checkFreeSpace(rootLog, st, 0, 0)
 	if !result {
 		t.Errorf("Short run failure")
 	}
 
 	// Successful absolute free space
-	result = checkFreeSpace(testDir, 0, actualFreeGiB/2)
+	result = checkFreeSpace(rootLog, st, 0, actualFreeGiB/2)
 	if !result {
 		t.Errorf("Error in successful absolute free space test")
 	}
 
 	// Successful relative free space
-	result = checkFreeSpace(testDir, actualFreePerc/2, 0)
+	result = checkFreeSpace(rootLog, st, actualFreePerc/2, 0)
 	if !result {
 		t.Errorf("Error in successful relative free space test")
 	}
 
 	// Successful combined free space
-	result = checkFreeSpace(testDir, actualFreePerc/2, actualFreeGiB/2)
+	result = checkFreeSpace(rootLog, st, actualFreePerc/2, actualFreeGiB/2)
 	if !result {
 		t.Errorf("Error in successful combined free space test")
 	}
 
 	// Failed absolute free space
-	result = checkFreeSpace(testDir, 0, actualFreeGiB*2)
+	result = checkFreeSpace(rootLog, st, 0, actualFreeGiB*2)
 	if result {
 		t.Errorf("Error in failed absolute free space test")
 	}
 
 	// Failed relative free space
-	result = checkFreeSpace(testDir, actualFreePerc*2, 0)
+	result = checkFreeSpace(rootLog, st, actualFreePerc*2, 0)
 	if result {
 		t.Errorf("Error in failed absolute free space test")
 	}
 
 	// Failed combined free space
-	result = checkFreeSpace(testDir, actualFreePerc*2, actualFreeGiB*2)
+	result = checkFreeSpace(rootLog, st, actualFreePerc*2, actualFreeGiB*2)
 	if result {
 		t.Errorf("Error in Failed combined free space test")
 	}
@@ -90,11 +92,12 @@ var dslTestPairs = []dslTestPair{
 }
 
 func TestIsDanglingSymlink(t *testing.T) {
-	mockConfig()
-	mockRepository()
-	defer os.RemoveAll(config.repository)
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
 	for i := range dslTestPairs {
-		lname := path.Join(config.repository, dslTestPairs[i].linkname)
+		lname := r.path(dslTestPairs[i].linkname)
 		tname := dslTestPairs[i].target
 		overwriteSymlink(tname, lname)
 		got := isDanglingSymlink(lname)
@@ -106,22 +109,23 @@ func TestIsDanglingSymlink(t *testing.T) {
 }
 
 func TestOverwriteSymlink(t *testing.T) {
-	mockConfig()
-	mockRepository()
-	defer os.RemoveAll(config.repository)
-	testdir := path.Join(config.repository, "somedir")
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	testdir := r.path("somedir")
 	os.Mkdir(testdir, 0777)
 	err := overwriteSymlink("irrelevant", testdir)
 	if err == nil {
 		t.Errorf("%s was overwritten, but it shouldn't", testdir)
 	}
-	testfile := path.Join(config.repository, "somefile")
+	testfile := r.path("somefile")
 	_, _ = os.Create(testfile)
 	err = overwriteSymlink("irrelevant", testfile)
 	if err == nil {
 		t.Errorf("%s was overwritten, but it shouldn't", testfile)
 	}
-	testlink := path.Join(config.repository, "somelink")
+	testlink := r.path("somelink")
 	_ = os.Symlink("irrelevant", testlink)
 	err = overwriteSymlink("irrelevant", testlink)
 	if err != nil {
@@ -130,11 +134,12 @@ func TestOverwriteSymlink(t *testing.T) {
 }
 
 func TestUpdateSymlinks(t *testing.T) {
-	mockConfig()
-	mockRepository()
-	defer os.RemoveAll(config.repository)
-	updateSymlinks()
-	symlink := path.Join(config.repository, "Saturday_2014-05-17_16.38.51")
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	r.updateSymlinks()
+	symlink := r.path("Saturday_2014-05-17_16.38.51")
 	target, err := os.Readlink(symlink)
 	if target != path.Join(dataSubdir, mockSnapshots[0]) {
 		t.Errorf("symlink %s -> %s is wrong or missing: %v", symlink, target, err)
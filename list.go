@@ -0,0 +1,274 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Output of the list command in various formats
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/daviddengcn/go-colortext"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listFormats are the possible arguments to list -format.
+var listFormats = []string{"text", "json", "csv", "tsv"}
+
+func validListFormat(f string) bool {
+	for _, lf := range listFormats {
+		if f == lf {
+			return true
+		}
+	}
+	return false
+}
+
+// listEntry is a snapshot together with its position in the schedule.
+type listEntry struct {
+	sn       snapshot
+	interval int
+	// dist is the distance to the next snapshot in the same interval, zero
+	// for the youngest one.
+	dist time.Duration
+}
+
+// duration returns how long the creation of the snapshot took.
+func (e listEntry) duration() time.Duration {
+	if e.sn.endTime.After(e.sn.startTime) {
+		return e.sn.endTime.Sub(e.sn.startTime)
+	}
+	return 0
+}
+
+// listInterval is an interval of the schedule and the snapshots in it.
+type listInterval struct {
+	index    int
+	duration time.Duration
+	// from is how long ago the interval started, zero for the highest
+	// (innumerable) interval.
+	from    time.Duration
+	goal    int // zero means unlimited
+	entries []listEntry
+}
+
+// collectListing sorts the snapshots of the repository into the intervals
+// of the schedule, oldest interval first.
+func (r *Repository) collectListing() []listInterval {
+	intervals := r.intervals()
+	snapshots, err := r.findSnapshots()
+	if err != nil {
+		r.log.errorf("%s", err)
+	}
+	if r.config.showAll {
+		snapshots = snapshots.state(any, none)
+	} else {
+		snapshots = snapshots.state(stateComplete, none)
+	}
+	listing := make([]listInterval, 0, len(intervals)-1)
+	for n := len(intervals) - 2; n >= 0; n-- {
+		r.log.debugf("listing interval %d", n)
+		snapshots := snapshots.interval(intervals, n, r.cl)
+		r.log.debugf("snapshots in interval %d: %s", n, snapshots)
+		iv := listInterval{index: n, duration: intervals[n]}
+		if n < len(intervals)-2 {
+			iv.from = intervals.offset(n + 1)
+			iv.goal = intervals.goal(n)
+		} else {
+			iv.goal = r.config.MaxKeep
+		}
+		for i, sn := range snapshots {
+			e := listEntry{sn: sn, interval: n}
+			if i < len(snapshots)-1 {
+				e.dist = snapshots[i+1].startTime.Sub(sn.startTime)
+			}
+			iv.entries = append(iv.entries, e)
+		}
+		listing = append(listing, iv)
+	}
+	return listing
+}
+
+// subcmdList give the user an overview of what's in the repository.
+func subcmdList(r *Repository) {
+	listing := r.collectListing()
+	var err error
+	switch r.config.listFormat {
+	case "json":
+		err = r.listJSON(os.Stdout, listing)
+	case "csv":
+		err = r.listDelimited(os.Stdout, listing, ',')
+	case "tsv":
+		err = r.listDelimited(os.Stdout, listing, '\t')
+	default:
+		if r.config.tree {
+			r.listTree(os.Stdout, listing, r.cl.Now())
+		} else {
+			r.listText(listing)
+		}
+	}
+	if err != nil {
+		r.log.errorf("%s", err)
+	}
+}
+
+// listText prints the listing in human readable, colored form.
+func (r *Repository) listText(listing []listInterval) {
+	for _, iv := range listing {
+		ct.Foreground(ct.Yellow, false)
+		if iv.from != 0 {
+			fmt.Printf("### From %s ago, %d/%d\n", formatDuration(iv.from), len(iv.entries), iv.goal)
+		} else if r.config.MaxKeep != 0 {
+			fmt.Printf("### From past, %d/%d\n", len(iv.entries), r.config.MaxKeep)
+		} else if r.config.MinPercSpace != 0 {
+			fmt.Printf("### From past, %d/(keep %.1f%% free)\n", len(iv.entries), r.config.MinPercSpace)
+		} else if r.config.MinGiBSpace != 0 {
+			fmt.Printf("### From past, %d/(keep %dGiB free)\n", len(iv.entries), r.config.MinGiBSpace)
+		} else {
+			fmt.Printf("### From past, %d/∞\n", len(iv.entries))
+		}
+		ct.ResetColor()
+		for _, e := range iv.entries {
+			sn := e.sn
+			stime := sn.startTime.Format("2006-01-02 Monday 15:04:05")
+			if r.config.verbose {
+				var unchanged string
+				if !sn.verified.IsZero() {
+					unchanged = ", unchanged until " + sn.verified.Format("2006-01-02 15:04:05")
+				}
+				fmt.Printf("%d %s (%s, %s/%s, %s%s) \"%s\"\n", e.interval, stime, e.duration(), formatDuration(iv.duration), e.dist, sn.state, unchanged, sn.Name())
+			} else {
+				fmt.Printf("%s (%s, %s)\n", stime, e.duration(), formatDuration(iv.duration))
+			}
+		}
+	}
+}
+
+// jsonSnapshot is the json representation of a listEntry. Durations are in
+// seconds.
+type jsonSnapshot struct {
+	Name             string     `json:"name"`
+	State            string     `json:"state"`
+	Start            time.Time  `json:"start"`
+	End              *time.Time `json:"end"`
+	Verified         *time.Time `json:"verified,omitempty"`
+	Duration         int64      `json:"duration"`
+	Interval         int        `json:"interval"`
+	IntervalDuration int64      `json:"intervalDuration"`
+	Distance         int64      `json:"distance"`
+	Path             string     `json:"path"`
+	Symlink          string     `json:"symlink"`
+}
+
+// jsonListInterval is the json representation of a listInterval. From and Goal
+// are null for the highest interval if there is no limit.
+type jsonListInterval struct {
+	Interval  int            `json:"interval"`
+	Duration  int64          `json:"duration"`
+	From      *int64         `json:"from"`
+	Goal      *int           `json:"goal"`
+	Count     int            `json:"count"`
+	Snapshots []jsonSnapshot `json:"snapshots"`
+}
+
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+func (r *Repository) newJSONSnapshot(e listEntry, iv listInterval) jsonSnapshot {
+	sn := e.sn
+	j := jsonSnapshot{
+		Name:             sn.Name(),
+		State:            sn.state.String(),
+		Start:            sn.startTime,
+		Duration:         seconds(e.duration()),
+		Interval:         e.interval,
+		IntervalDuration: seconds(iv.duration),
+		Distance:         seconds(e.dist),
+		Path:             r.snapshotPath(sn),
+	}
+	if sn.state != stateIncomplete {
+		end := sn.endTime
+		j.End = &end
+	}
+	if !sn.verified.IsZero() {
+		verified := sn.verified
+		j.Verified = &verified
+	}
+	if sn.state == stateComplete {
+		j.Symlink = symlinkName(sn)
+	}
+	return j
+}
+
+// listJSON writes the listing as a json document.
+func (r *Repository) listJSON(w io.Writer, listing []listInterval) error {
+	doc := struct {
+		Repository string             `json:"repository"`
+		Origin     string             `json:"origin"`
+		Schedule   string             `json:"schedule"`
+		Intervals  []jsonListInterval `json:"intervals"`
+	}{
+		Repository: r.config.repository,
+		Origin:     r.config.Origin,
+		Schedule:   r.config.Schedule,
+		Intervals:  make([]jsonListInterval, 0, len(listing)),
+	}
+	for _, iv := range listing {
+		jiv := jsonListInterval{
+			Interval:  iv.index,
+			Duration:  seconds(iv.duration),
+			Count:     len(iv.entries),
+			Snapshots: make([]jsonSnapshot, 0, len(iv.entries)),
+		}
+		if iv.from != 0 {
+			from := seconds(iv.from)
+			jiv.From = &from
+		}
+		if iv.goal != 0 {
+			goal := iv.goal
+			jiv.Goal = &goal
+		}
+		for _, e := range iv.entries {
+			jiv.Snapshots = append(jiv.Snapshots, r.newJSONSnapshot(e, iv))
+		}
+		doc.Intervals = append(doc.Intervals, jiv)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// listDelimited writes one line per snapshot, with the given field separator.
+// The goal and count of the interval are repeated on every line. Times are in
+// RFC 3339 format, durations in seconds.
+func (r *Repository) listDelimited(w io.Writer, listing []listInterval, sep rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = sep
+	cw.Write([]string{"name", "state", "start", "end", "duration",
+		"interval", "interval_duration", "interval_goal", "interval_count",
+		"distance", "path", "symlink"})
+	for _, iv := range listing {
+		var goal string
+		if iv.goal != 0 {
+			goal = strconv.Itoa(iv.goal)
+		}
+		for _, e := range iv.entries {
+			j := r.newJSONSnapshot(e, iv)
+			var end string
+			if j.End != nil {
+				end = j.End.Format(time.RFC3339)
+			}
+			cw.Write([]string{j.Name, j.State, j.Start.Format(time.RFC3339), end,
+				strconv.FormatInt(j.Duration, 10),
+				strconv.Itoa(j.Interval), strconv.FormatInt(j.IntervalDuration, 10),
+				goal, strconv.Itoa(len(iv.entries)),
+				strconv.FormatInt(j.Distance, 10), j.Path, j.Symlink})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,83 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestListJSON(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	var buf bytes.Buffer
+	if err := r.listJSON(&buf, r.collectListing()); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Schedule  string
+		Intervals []jsonListInterval
+	}
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("could not parse json output: %v", err)
+	}
+	if doc.Schedule != "testing2" || len(doc.Intervals) != 4 {
+		t.Fatalf("unexpected json output: %s", buf.String())
+	}
+	var counts []int
+	for _, iv := range doc.Intervals {
+		counts = append(counts, iv.Count)
+	}
+	if want := []int{1, 2, 2, 4}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("interval counts are %v, wanted %v", counts, want)
+	}
+	if g := doc.Intervals[0].Goal; g == nil || *g != 2 {
+		t.Errorf("goal of highest interval should be maxKeep")
+	}
+	sn := doc.Intervals[3].Snapshots[0]
+	want := jsonSnapshot{
+		Name:             "1400337706-1400337707-complete",
+		State:            "Complete",
+		Start:            sn.Start,
+		End:              sn.End,
+		Duration:         1,
+		Interval:         0,
+		IntervalDuration: 5,
+		Distance:         5,
+		Path:             r.path(dataSubdir, "1400337706-1400337707-complete"),
+		Symlink:          "Saturday_2014-05-17_16.41.46",
+	}
+	if !reflect.DeepEqual(sn, want) {
+		t.Errorf("got %+v, wanted %+v", sn, want)
+	}
+}
+
+func TestListDelimited(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	var buf bytes.Buffer
+	if err := r.listDelimited(&buf, r.collectListing(), '\t'); err != nil {
+		t.Fatal(err)
+	}
+	cr := csv.NewReader(&buf)
+	cr.Comma = '\t'
+	records, err := cr.ReadAll()
+	if err != nil {
+		t.Fatalf("could not parse tsv output: %v", err)
+	}
+	if len(records) != len(mockSnapshots)+1 {
+		t.Fatalf("got %d lines, wanted %d", len(records), len(mockSnapshots)+1)
+	}
+	first := records[1]
+	if first[0] != mockSnapshots[0] || first[5] != "3" || first[7] != "2" || first[8] != "1" {
+		t.Errorf("unexpected first line: %v", first)
+	}
+}
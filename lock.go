@@ -7,7 +7,6 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"strconv"
 )
@@ -41,6 +40,6 @@ func (pl *pidLocker) Unlock() {
 	debugf("delete pidfile %s", pl.f)
 	err := os.Remove(pl.f)
 	if err != nil {
-		log.Printf("could not remove pid file %s: %s", pl.f, err)
+		warnf("could not remove pid file %s: %s", pl.f, err)
 	}
 }
@@ -0,0 +1,287 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Persistent, rotating log in the repository and the log subcommand
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logFileName     = "." + myName + ".log"
+	logPollInterval = time.Second
+)
+
+// repoLog stores log records as json lines in the repository. When the file
+// grows larger than maxSize, it is rotated and at most keep old files are
+// kept.
+type repoLog struct {
+	path    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func logFile(repository string) string {
+	return filepath.Join(repository, logFileName)
+}
+
+// openRepoLog opens (or creates) the log file at path for appending.
+func openRepoLog(path string, maxSize int64, keep int) (*repoLog, error) {
+	l := &repoLog{
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *repoLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, dropping the
+// oldest file, and starts a new log file.
+func (l *repoLog) rotate() error {
+	l.f.Close()
+	os.Remove(l.path + "." + strconv.Itoa(l.keep))
+	for n := l.keep - 1; n > 0; n-- {
+		os.Rename(l.path+"."+strconv.Itoa(n), l.path+"."+strconv.Itoa(n+1))
+	}
+	if l.keep > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+// write appends r to the log file. The caller has to make sure there are no
+// concurrent calls.
+func (l *repoLog) write(r logRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *repoLog) Close() error {
+	return l.f.Close()
+}
+
+// parseLogLine reads a record from a line of the log file. Lines that are not
+// json are returned as the message of an otherwise empty record.
+func parseLogLine(line string) logRecord {
+	var r logRecord
+	if err := json.Unmarshal([]byte(line), &r); err != nil {
+		return logRecord{Level: levelInfo, Msg: line}
+	}
+	return r
+}
+
+// readLogRecords reads all records from the log at path, including the
+// rotated files, oldest first.
+func readLogRecords(path string) ([]logRecord, error) {
+	files, _ := filepath.Glob(path + ".*")
+	var rotated []int
+	for _, f := range files {
+		if n, err := strconv.Atoi(strings.TrimPrefix(f, path+".")); err == nil {
+			rotated = append(rotated, n)
+		}
+	}
+	sort.Ints(rotated)
+	names := make([]string, 0, len(rotated)+1)
+	for i := len(rotated) - 1; i >= 0; i-- {
+		names = append(names, path+"."+strconv.Itoa(rotated[i]))
+	}
+	names = append(names, path)
+	var records []logRecord
+	for _, name := range names {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return records, err
+		}
+		in := bufio.NewScanner(f)
+		in.Buffer(nil, 1024*1024)
+		for in.Scan() {
+			records = append(records, parseLogLine(in.Text()))
+		}
+		f.Close()
+		if err := in.Err(); err != nil {
+			return records, err
+		}
+	}
+	return records, nil
+}
+
+// logFilter selects records for the log subcommand.
+type logFilter struct {
+	since    time.Time
+	snapshot string
+}
+
+// match returns true if r passes the filter. A snapshot is matched by its
+// start time, which is the part of the name that does not change.
+func (lf logFilter) match(r logRecord) bool {
+	if !lf.since.IsZero() && r.Time.Before(lf.since) {
+		return false
+	}
+	if lf.snapshot != "" {
+		key := snapshotKey(lf.snapshot)
+		if snapshotKey(r.snapshot()) != key && !strings.Contains(r.Msg, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSince parses the argument to log -since. It is either a duration
+// (e. g. "2h" or "1d12h") before now or a point in time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := parseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time for -since: %s", s)
+}
+
+// subcmdLog prints the last lines of the repository log matching the
+// configured filter, and optionally waits for new lines.
+func subcmdLog(w io.Writer, r *Repository) error {
+	lf := logFilter{snapshot: r.config.logSnapshot}
+	if r.config.logSince != "" {
+		t, err := parseSince(r.config.logSince, r.cl.Now())
+		if err != nil {
+			return err
+		}
+		lf.since = t
+	}
+	path := logFile(r.config.repository)
+	records, err := readLogRecords(path)
+	if err != nil {
+		return err
+	}
+	var matching []logRecord
+	for _, rec := range records {
+		if lf.match(rec) {
+			matching = append(matching, rec)
+		}
+	}
+	if r.config.logLines > 0 && len(matching) > r.config.logLines {
+		matching = matching[len(matching)-r.config.logLines:]
+	}
+	for _, rec := range matching {
+		fmt.Fprintln(w, rec)
+	}
+	if r.config.logFollow {
+		return followLog(w, path, lf)
+	}
+	return nil
+}
+
+// followLog prints records appended to the log at path, following it through
+// rotations. It only returns on errors.
+func followLog(w io.Writer, path string, lf logFilter) error {
+	var f *os.File
+	var offset int64
+	var partial []byte
+	if fi, err := os.Stat(path); err == nil {
+		offset = fi.Size()
+	}
+	for {
+		fi, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if f != nil && fi != nil {
+			cur, err := f.Stat()
+			if err != nil || !os.SameFile(cur, fi) || fi.Size() < offset {
+				// rotated or truncated, read what is left and start over
+				// with the new file
+				partial = readFollow(w, f, partial, lf)
+				f.Close()
+				f = nil
+				offset = 0
+				partial = nil
+			}
+		}
+		if f == nil && fi != nil {
+			if f, err = os.Open(path); err != nil {
+				return err
+			}
+			if _, err = f.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if f != nil {
+			partial = readFollow(w, f, partial, lf)
+		}
+		time.Sleep(logPollInterval)
+	}
+}
+
+// readFollow prints all complete lines readable from f that match lf and
+// returns what is left of an incomplete last line.
+func readFollow(w io.Writer, f *os.File, partial []byte, lf logFilter) []byte {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		partial = append(partial, buf[:n]...)
+		if n == 0 || err != nil {
+			break
+		}
+	}
+	for {
+		i := bytes.IndexByte(partial, '\n')
+		if i < 0 {
+			break
+		}
+		if r := parseLogLine(string(partial[:i])); lf.match(r) {
+			fmt.Fprintln(w, r)
+		}
+		partial = partial[i+1:]
+	}
+	return partial
+}
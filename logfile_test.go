@@ -0,0 +1,120 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepoLogRotate(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	path := logFile(r.config.repository)
+	l, err := openRepoLog(path, 400, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		l.write(logRecord{Time: time.Unix(startAt, 0), Level: levelInfo, Msg: fmt.Sprintf("line %d", i)})
+	}
+	l.Close()
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Errorf("rotated log file is missing: %v", err)
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("too many rotated log files kept")
+	}
+	records, err := readLogRecords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records) == 20 {
+		t.Fatalf("got %d records, expected some to be rotated away", len(records))
+	}
+	first := 20 - len(records)
+	for i, r := range records {
+		if want := fmt.Sprintf("line %d", first+i); r.Msg != want {
+			t.Errorf("record %d is %q, wanted %q", i, r.Msg, want)
+		}
+	}
+}
+
+func TestSubcmdLog(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	path := logFile(r.config.repository)
+	cl := newSkewClock(startAt)
+	r.cl = cl
+	l, err := openRepoLog(path, 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl := newStructLogger(ioutil.Discard, cl)
+	sl.file = l
+	sl.output(1, levelInfo, nil, "started")
+	sl.startRun("1400337706-0-incomplete")
+	sl.output(1, levelInfo, nil, "run: [rsync]")
+	sl.endRun()
+	sl.output(1, levelInfo, nil, "finished: 1400337706-1400337707-complete")
+	sl.output(1, levelInfo, nil, "purging 1400337691-1400337692-purging")
+	l.Close()
+	// a line left by some other program
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	fmt.Fprintln(f, "not json")
+	f.Close()
+
+	tests := []struct {
+		lines    int
+		snapshot string
+		want     int
+	}{
+		{0, "", 5},
+		{2, "", 2},
+		{0, "1400337706-1400337707-complete", 2},
+		{1, "1400337706-1400337707-complete", 1},
+	}
+	for _, tt := range tests {
+		r.config.logLines = tt.lines
+		r.config.logSnapshot = tt.snapshot
+		var buf bytes.Buffer
+		if err := subcmdLog(&buf, r); err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(got) != tt.want {
+			t.Errorf("-n %d -snapshot %q: got %d lines, wanted %d:\n%s", tt.lines, tt.snapshot, len(got), tt.want, buf.String())
+		}
+	}
+	r.config.logLines = 0
+	r.config.logSnapshot = "1400337706"
+	var buf bytes.Buffer
+	subcmdLog(&buf, r)
+	if !strings.Contains(buf.String(), fmt.Sprintf("[%d.1 1400337706-0-incomplete] run: [rsync]", os.Getpid())) {
+		t.Errorf("rsync run is not marked:\n%s", buf.String())
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2014, 5, 17, 16, 0, 0, 0, time.Local)
+	tests := map[string]time.Time{
+		"2h":               now.Add(-2 * time.Hour),
+		"1d":               now.Add(-day),
+		"2014-05-01":       time.Date(2014, 5, 1, 0, 0, 0, 0, time.Local),
+		"2014-05-01 12:30": time.Date(2014, 5, 1, 12, 30, 0, 0, time.Local),
+	}
+	for s, want := range tests {
+		got, err := parseSince(s, now)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("parseSince(%q) = %s, %v, wanted %s", s, got, err, want)
+		}
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Errorf("parseSince should fail for \"yesterday\"")
+	}
+}
@@ -0,0 +1,449 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Leveled, structured logging
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarning
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+// logFormats are the possible arguments to -logFormat.
+var logFormats = []string{"text", "json"}
+
+func validLogFormat(f string) bool {
+	for _, lf := range logFormats {
+		if f == lf {
+			return true
+		}
+	}
+	return false
+}
+
+func (lv logLevel) String() string {
+	if lv < levelDebug || lv > levelError {
+		return "unknown"
+	}
+	return logLevelNames[lv]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.ToLower(s) == name {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+// logFields are additional, machine readable information about a log message.
+// Commonly used keys are repository, origin, snapshot, state and rsyncPid.
+type logFields map[string]interface{}
+
+// logRecord is a single log message with its fields.
+type logRecord struct {
+	Time  time.Time
+	Level logLevel
+	Msg   string
+	// Pid is the process id of snaprd.
+	Pid int
+	// Run counts the rsync runs of the process, zero outside of a run.
+	Run    int
+	Fields logFields
+}
+
+// reservedKeys are the json keys used for the fixed parts of a logRecord.
+var reservedKeys = []string{"time", "level", "msg", "pid", "run"}
+
+// MarshalJSON writes the record as a flat json object.
+func (r logRecord) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(r.Fields)+len(reservedKeys))
+	for k, v := range r.Fields {
+		m[k] = v
+	}
+	m["time"] = r.Time.Format(time.RFC3339Nano)
+	m["level"] = r.Level.String()
+	m["msg"] = r.Msg
+	m["pid"] = r.Pid
+	if r.Run != 0 {
+		m["run"] = r.Run
+	}
+	return json.Marshal(m)
+}
+
+func (r *logRecord) UnmarshalJSON(b []byte) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*r = logRecord{Level: levelInfo}
+	if s, ok := m["time"].(string); ok {
+		r.Time, _ = time.Parse(time.RFC3339Nano, s)
+	}
+	if s, ok := m["level"].(string); ok {
+		r.Level, _ = parseLogLevel(s)
+	}
+	r.Msg, _ = m["msg"].(string)
+	if n, ok := m["pid"].(float64); ok {
+		r.Pid = int(n)
+	}
+	if n, ok := m["run"].(float64); ok {
+		r.Run = int(n)
+	}
+	for _, k := range reservedKeys {
+		delete(m, k)
+	}
+	if len(m) > 0 {
+		r.Fields = logFields(m)
+	}
+	return nil
+}
+
+// snapshot returns the name of the snapshot the record is about, if any.
+func (r logRecord) snapshot() string {
+	s, _ := r.Fields["snapshot"].(string)
+	return s
+}
+
+// snapshotKey returns the start time part of a snapshot name, which does not
+// change with state transitions.
+func snapshotKey(name string) string {
+	return strings.SplitN(name, "-", 2)[0]
+}
+
+// runID identifies the rsync run a record belongs to, empty if none.
+func (r logRecord) runID() string {
+	if r.Run == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", r.Pid, r.Run)
+}
+
+// String formats the record for the log command.
+func (r logRecord) String() string {
+	var mark, level string
+	if id := r.runID(); id != "" {
+		mark = fmt.Sprintf("[%s %s] ", id, r.snapshot())
+	}
+	if r.Level != levelInfo {
+		level = "<" + strings.ToUpper(r.Level.String()) + "> "
+	}
+	return fmt.Sprintf("%s %s%s%s", r.Time.Format("2006-01-02 15:04:05"), mark, level, r.Msg)
+}
+
+// logSink holds the outputs and the format of log records. It is shared by
+// all loggers derived from the same root.
+type logSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	json   bool
+	level  logLevel
+	noDate bool
+	// base fields are added to every json record
+	base logFields
+	file *repoLog
+	// target receives all records besides out, if set
+	target logTarget
+	cl     clock
+	pid    int
+}
+
+// structLogger writes log records to out, either as text or as one json
+// object per line, and optionally to the log file of the repository. Each
+// logger keeps track of its own rsync run.
+type structLogger struct {
+	*logSink
+	runMu sync.Mutex
+	// the rsync run in progress
+	run      int
+	snapshot string
+	rsyncPid int
+}
+
+// rootLog is where all log output goes to.
+var rootLog = newStructLogger(os.Stderr, new(realClock))
+
+func newStructLogger(out io.Writer, cl clock) *structLogger {
+	s := &logSink{
+		out:   out,
+		level: levelInfo,
+		cl:    cl,
+		pid:   os.Getpid(),
+	}
+	if debugEnv() {
+		s.level = levelDebug
+	}
+	return &structLogger{logSink: s}
+}
+
+// sub returns a logger that writes to the same outputs as l, but marks
+// records with its own rsync runs.
+func (l *structLogger) sub() *structLogger {
+	return &structLogger{logSink: l.logSink}
+}
+
+// debugEnv returns true if debug output is forced by the environment.
+func debugEnv() bool {
+	return os.Getenv("SNAPRD_DEBUG") == "1"
+}
+
+// configure sets format and level of the logger from their names.
+func (l *structLogger) configure(format, level string, noDate bool) error {
+	lv, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if !validLogFormat(format) {
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	if debugEnv() {
+		lv = levelDebug
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.json = format == "json"
+	l.level = lv
+	l.noDate = noDate
+	return nil
+}
+
+// enabled returns true if messages of the given level are written.
+func (l *structLogger) enabled(level logLevel) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// startRun marks all following records as belonging to a new rsync run for
+// the named snapshot.
+func (l *structLogger) startRun(snapshot string) {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	l.run++
+	l.snapshot = snapshot
+	l.rsyncPid = 0
+}
+
+// setRsyncPid records the process id of the rsync of the current run.
+func (l *structLogger) setRsyncPid(pid int) {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	l.rsyncPid = pid
+}
+
+// endRun ends the current rsync run.
+func (l *structLogger) endRun() {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	l.snapshot = ""
+	l.rsyncPid = 0
+}
+
+// output writes a record. calldepth is used to find the source of debug
+// messages, as in log.Output.
+func (l *structLogger) output(calldepth int, level logLevel, fields logFields, msg string) {
+	if !l.enabled(level) {
+		return
+	}
+	r := logRecord{
+		Time:   l.cl.Now(),
+		Level:  level,
+		Msg:    strings.TrimRight(msg, "\n"),
+		Pid:    l.pid,
+		Fields: make(logFields, len(fields)+4),
+	}
+	for k, v := range fields {
+		r.Fields[k] = v
+	}
+	if level == levelDebug {
+		if _, file, line, ok := runtime.Caller(calldepth); ok {
+			r.Fields["source"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+		}
+	}
+	l.runMu.Lock()
+	run, snapshot, rsyncPid := l.run, l.snapshot, l.rsyncPid
+	l.runMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the text format only shows the fields given by the caller
+	var line, targetMsg string
+	if !l.json {
+		line = formatText(r, !l.noDate, true) + "\n"
+	}
+	if l.target != nil {
+		targetMsg = formatText(r, false, false)
+	}
+	// messages about other snapshots during a run, e. g. from the purger,
+	// do not belong to the run
+	if snapshot != "" {
+		sn, ok := r.Fields["snapshot"].(string)
+		if !ok || snapshotKey(sn) == snapshotKey(snapshot) {
+			r.Run = run
+			if !ok {
+				r.Fields["snapshot"] = snapshot
+			}
+			if rsyncPid != 0 {
+				r.Fields["rsyncPid"] = rsyncPid
+			}
+		}
+	}
+	if l.file != nil {
+		if err := l.file.write(r); err != nil {
+			fmt.Fprintln(l.out, "could not write log file:", err)
+		}
+	}
+	for k, v := range l.base {
+		if _, ok := r.Fields[k]; !ok {
+			r.Fields[k] = v
+		}
+	}
+	if l.target != nil {
+		if err := l.target.send(r, targetMsg); err != nil {
+			fmt.Fprintln(l.out, "could not send log message:", err)
+		}
+	}
+	if l.json {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		l.out.Write(append(b, '\n'))
+		return
+	}
+	l.out.Write([]byte(line))
+}
+
+// formatText formats r for the text log format: the message, followed by
+// the fields as key=value pairs. date and level select whether the time and
+// the level of the record are included.
+func formatText(r logRecord, date, level bool) string {
+	var b bytes.Buffer
+	if date {
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+	if src, ok := r.Fields["source"]; ok {
+		fmt.Fprintf(&b, "%s: ", src)
+	}
+	if level && r.Level != levelInfo {
+		fmt.Fprintf(&b, "<%s> ", strings.ToUpper(r.Level.String()))
+	}
+	b.WriteString(r.Msg)
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		if k != "source" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, r.Fields[k])
+	}
+	return b.String()
+}
+
+// stdLogWriter passes output of the standard log package on to rootLog.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		rootLog.output(4, levelInfo, nil, line)
+	}
+	return len(p), nil
+}
+
+// logEntry is used to log messages with fields.
+type logEntry struct {
+	l      *structLogger
+	fields logFields
+}
+
+func withFields(f logFields) logEntry {
+	return rootLog.withFields(f)
+}
+
+func (l *structLogger) withFields(f logFields) logEntry {
+	return logEntry{l, f}
+}
+
+func (e logEntry) debugf(format string, args ...interface{}) {
+	e.l.output(2, levelDebug, e.fields, fmt.Sprintf(format, args...))
+}
+
+func (e logEntry) infof(format string, args ...interface{}) {
+	e.l.output(2, levelInfo, e.fields, fmt.Sprintf(format, args...))
+}
+
+func (e logEntry) warnf(format string, args ...interface{}) {
+	e.l.output(2, levelWarning, e.fields, fmt.Sprintf(format, args...))
+}
+
+func (e logEntry) errorf(format string, args ...interface{}) {
+	e.l.output(2, levelError, e.fields, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) debugf(format string, args ...interface{}) {
+	l.output(2, levelDebug, nil, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) infof(format string, args ...interface{}) {
+	l.output(2, levelInfo, nil, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) warnf(format string, args ...interface{}) {
+	l.output(2, levelWarning, nil, fmt.Sprintf(format, args...))
+}
+
+func (l *structLogger) errorf(format string, args ...interface{}) {
+	l.output(2, levelError, nil, fmt.Sprintf(format, args...))
+}
+
+func debugf(format string, args ...interface{}) {
+	rootLog.output(2, levelDebug, nil, fmt.Sprintf(format, args...))
+}
+
+func infof(format string, args ...interface{}) {
+	rootLog.output(2, levelInfo, nil, fmt.Sprintf(format, args...))
+}
+
+func warnf(format string, args ...interface{}) {
+	rootLog.output(2, levelWarning, nil, fmt.Sprintf(format, args...))
+}
+
+func errorf(format string, args ...interface{}) {
+	rootLog.output(2, levelError, nil, fmt.Sprintf(format, args...))
+}
+
+// fatalf logs an error and exits.
+func fatalf(format string, args ...interface{}) {
+	rootLog.output(2, levelError, nil, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// setupLogging directs all log output to out, formatted as configured.
+func setupLogging(out io.Writer) {
+	rootLog = newStructLogger(out, new(realClock))
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
@@ -0,0 +1,126 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStructLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := newStructLogger(&buf, newSkewClock(startAt))
+	if err := l.configure("text", "info", true); err != nil {
+		t.Fatal(err)
+	}
+	l.output(1, levelDebug, nil, "hidden")
+	l.output(1, levelInfo, nil, "plain")
+	l.output(1, levelError, logFields{"snapshot": "1400337706-0-incomplete", "state": "Incomplete -> Complete"}, "failed")
+	want := "plain\n<ERROR> failed snapshot=1400337706-0-incomplete state=Incomplete -> Complete\n"
+	if buf.String() != want {
+		t.Errorf("got %q, wanted %q", buf.String(), want)
+	}
+}
+
+func TestStructLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := newStructLogger(&buf, newSkewClock(startAt))
+	if err := l.configure("json", "debug", false); err != nil {
+		t.Fatal(err)
+	}
+	l.base = logFields{"repository": "/snapshots", "origin": "/data"}
+	l.output(1, levelInfo, nil, "before")
+	l.startRun("1400337706-0-incomplete")
+	l.setRsyncPid(4711)
+	l.output(1, levelInfo, nil, "(rsync) sending incremental file list")
+	l.output(1, levelInfo, logFields{"snapshot": "1400337706-1400337707-complete"}, "finished")
+	l.output(1, levelInfo, logFields{"snapshot": "1400337691-1400337692-obsolete"}, "purging")
+	l.endRun()
+	l.output(1, levelWarning, nil, "after")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, wanted 5:\n%s", len(lines), buf.String())
+	}
+	var records []map[string]interface{}
+	for _, line := range lines {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("could not parse %q: %v", line, err)
+		}
+		if m["repository"] != "/snapshots" || m["origin"] != "/data" {
+			t.Errorf("base fields missing in %q", line)
+		}
+		records = append(records, m)
+	}
+	if _, ok := records[0]["run"]; ok {
+		t.Errorf("record before the run is marked as part of it")
+	}
+	if r := records[1]; r["run"] != 1.0 || r["snapshot"] != "1400337706-0-incomplete" || r["rsyncPid"] != 4711.0 {
+		t.Errorf("rsync output is not marked: %v", r)
+	}
+	if r := records[2]; r["run"] != 1.0 || r["snapshot"] != "1400337706-1400337707-complete" {
+		t.Errorf("renamed snapshot does not belong to the run: %v", r)
+	}
+	if _, ok := records[3]["run"]; ok {
+		t.Errorf("record about another snapshot is marked as part of the run")
+	}
+	if r := records[4]; r["level"] != "warning" || r["run"] != nil {
+		t.Errorf("unexpected record %v", r)
+	}
+}
+
+func TestStructLoggerSub(t *testing.T) {
+	var buf bytes.Buffer
+	root := newStructLogger(&buf, newSkewClock(startAt))
+	if err := root.configure("json", "info", false); err != nil {
+		t.Fatal(err)
+	}
+	a, b := root.sub(), root.sub()
+	a.startRun("1400337706-0-incomplete")
+	a.output(1, levelInfo, nil, "a")
+	b.output(1, levelInfo, nil, "b")
+	root.output(1, levelInfo, nil, "root")
+	b.startRun("1400337707-0-incomplete")
+	b.output(1, levelInfo, nil, "b")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, wanted 4:\n%s", len(lines), buf.String())
+	}
+	for i, want := range []string{"1400337706-0-incomplete", "", "", "1400337707-0-incomplete"} {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &m); err != nil {
+			t.Fatalf("could not parse %q: %v", lines[i], err)
+		}
+		if want == "" {
+			if _, ok := m["run"]; ok {
+				t.Errorf("record %q is marked as part of a run of another logger", lines[i])
+			}
+		} else if m["run"] != 1.0 || m["snapshot"] != want {
+			t.Errorf("record %q is not marked as run 1 of %s", lines[i], want)
+		}
+	}
+}
+
+func TestLogRecordJSON(t *testing.T) {
+	r := logRecord{Time: time.Unix(startAt, 0), Level: levelWarning, Msg: "m", Pid: 1, Run: 2, Fields: logFields{"snapshot": "s"}}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseLogLine(string(b))
+	if !got.Time.Equal(r.Time) || got.Level != r.Level || got.Msg != r.Msg || got.runID() != "1.2" || got.snapshot() != "s" {
+		t.Errorf("got %+v, wanted %+v", got, r)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	if lv, err := parseLogLevel("Warning"); err != nil || lv != levelWarning {
+		t.Errorf("parseLogLevel(\"Warning\") = %s, %v", lv, err)
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("parseLogLevel should fail for \"verbose\"")
+	}
+}
@@ -0,0 +1,200 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Sending log messages to journald or syslog
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// logTargetNames are the possible arguments to -logTarget.
+var logTargetNames = []string{"stderr", "journald", "syslog"}
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// logTarget is a destination for log records other than standard error.
+// msg is the message formatted for text based targets.
+type logTarget interface {
+	send(r logRecord, msg string) error
+	Close() error
+}
+
+// newLogTarget returns the named log target. For "stderr" it returns nil,
+// since that is where log output goes by default.
+func newLogTarget(name, facility string) (logTarget, error) {
+	switch name {
+	case "stderr":
+		return nil, nil
+	case "journald":
+		return newJournalTarget(journalSocket)
+	case "syslog":
+		f, err := parseFacility(facility)
+		if err != nil {
+			return nil, err
+		}
+		return newSyslogTarget(f)
+	}
+	return nil, fmt.Errorf("unknown log target: %s", name)
+}
+
+// syslogPriority maps log levels to syslog severities.
+func syslogPriority(lv logLevel) syslog.Priority {
+	switch lv {
+	case levelDebug:
+		return syslog.LOG_DEBUG
+	case levelWarning:
+		return syslog.LOG_WARNING
+	case levelError:
+		return syslog.LOG_ERR
+	}
+	return syslog.LOG_INFO
+}
+
+// journalTarget sends records to journald using its native protocol, with
+// the fields of the record as journal fields.
+type journalTarget struct {
+	conn *net.UnixConn
+}
+
+func newJournalTarget(socket string) (*journalTarget, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to journald: %s", err)
+	}
+	return &journalTarget{conn}, nil
+}
+
+// journalKey converts a field name like "rsyncPid" to a journal field name
+// like "RSYNC_PID". Journal field names consist of upper case letters,
+// digits and underscores, and must not start with an underscore.
+func journalKey(k string) string {
+	var b bytes.Buffer
+	for i, c := range k {
+		switch {
+		case unicode.IsUpper(c) && i > 0:
+			b.WriteRune('_')
+			b.WriteRune(c)
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			b.WriteRune(unicode.ToUpper(c))
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return strings.TrimLeft(b.String(), "_")
+}
+
+// writeJournalField appends a field in the format of the native journal
+// protocol. Values containing newlines are written with their size in front.
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if strings.Contains(value, "\n") {
+		b.WriteString(key)
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('=')
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalMessage encodes r as a journal entry.
+func journalMessage(r logRecord) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", r.Msg)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(int(syslogPriority(r.Level))))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", myName)
+	writeJournalField(&b, "SYSLOG_PID", strconv.Itoa(r.Pid))
+	if r.Run != 0 {
+		writeJournalField(&b, "RUN", r.runID())
+	}
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeJournalField(&b, journalKey(k), fmt.Sprint(r.Fields[k]))
+	}
+	return b.Bytes()
+}
+
+func (j *journalTarget) send(r logRecord, msg string) error {
+	_, err := j.conn.Write(journalMessage(r))
+	return err
+}
+
+func (j *journalTarget) Close() error {
+	return j.conn.Close()
+}
+
+// syslogFacilities are the possible arguments to -syslogFacility.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func parseFacility(s string) (syslog.Priority, error) {
+	if f, ok := syslogFacilities[strings.ToLower(s)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility: %s", s)
+}
+
+// syslogTarget sends records to the local syslog daemon.
+type syslogTarget struct {
+	w *syslog.Writer
+}
+
+func newSyslogTarget(facility syslog.Priority) (*syslogTarget, error) {
+	w, err := syslog.New(facility|syslog.LOG_INFO, myName)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to syslog: %s", err)
+	}
+	return &syslogTarget{w}, nil
+}
+
+func (s *syslogTarget) send(r logRecord, msg string) error {
+	switch syslogPriority(r.Level) {
+	case syslog.LOG_DEBUG:
+		return s.w.Debug(msg)
+	case syslog.LOG_WARNING:
+		return s.w.Warning(msg)
+	case syslog.LOG_ERR:
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
+
+func (s *syslogTarget) Close() error {
+	return s.w.Close()
+}
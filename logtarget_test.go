@@ -0,0 +1,98 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournalKey(t *testing.T) {
+	tests := map[string]string{
+		"snapshot":   "SNAPSHOT",
+		"rsyncPid":   "RSYNC_PID",
+		"repository": "REPOSITORY",
+		"_x-y":       "X_Y",
+	}
+	for in, want := range tests {
+		if got := journalKey(in); got != want {
+			t.Errorf("journalKey(%q) = %q, wanted %q", in, got, want)
+		}
+	}
+}
+
+func TestJournalMessage(t *testing.T) {
+	r := logRecord{
+		Level:  levelError,
+		Msg:    "two\nlines",
+		Pid:    42,
+		Fields: logFields{"snapshot": "1400337706-0-incomplete", "state": "Incomplete -> Complete"},
+	}
+	got := journalMessage(r)
+	want := "MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n" +
+		"PRIORITY=3\n" +
+		"SYSLOG_IDENTIFIER=snaprd\n" +
+		"SYSLOG_PID=42\n" +
+		"SNAPSHOT=1400337706-0-incomplete\n" +
+		"STATE=Incomplete -> Complete\n"
+	if string(got) != want {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+}
+
+func TestJournalTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target, err := newJournalTarget(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	var buf bytes.Buffer
+	l := newStructLogger(&buf, newSkewClock(startAt))
+	l.target = target
+	l.output(1, levelWarning, logFields{"snapshot": "1400337706-0-incomplete"}, "hello")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 4096)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(b[:n])
+	for _, field := range []string{"MESSAGE=hello\n", "PRIORITY=4\n", "SNAPSHOT=1400337706-0-incomplete\n"} {
+		if !strings.Contains(msg, field) {
+			t.Errorf("field %q missing in %q", field, msg)
+		}
+	}
+	if !strings.Contains(buf.String(), "hello") {
+		t.Errorf("message was not written to the log buffer")
+	}
+}
+
+func TestParseFacility(t *testing.T) {
+	if f, err := parseFacility("LOCAL3"); err != nil || f != syslog.LOG_LOCAL3 {
+		t.Errorf("parseFacility(\"LOCAL3\") = %v, %v", f, err)
+	}
+	if _, err := parseFacility("local8"); err == nil {
+		t.Errorf("parseFacility should fail for \"local8\"")
+	}
+	if _, err := newLogTarget("console", "daemon"); err == nil {
+		t.Errorf("newLogTarget should fail for \"console\"")
+	}
+}
@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Setting the modification time of symlinks themselves.
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// atFdcwd makes utimensat(2) resolve relative paths like other calls.
+	atFdcwd = -0x64
+	// atSymlinkNofollow makes utimensat(2) change the symlink itself.
+	atSymlinkNofollow = 0x100
+	// utimeOmit tells utimensat(2) to leave the access time alone.
+	utimeOmit = (1 << 30) - 2
+)
+
+// lutimes sets the modification time of path without following it if it is
+// a symlink.
+func lutimes(path string, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return &os.PathError{Op: "lutimes", Path: path, Err: err}
+	}
+	ts := [2]syscall.Timespec{
+		{Nsec: utimeOmit},
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	fd := atFdcwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd),
+		uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])),
+		atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "lutimes", Path: path, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import "time"
+
+// lutimes does nothing, the modification time of symlinks is only set on
+// linux.
+func lutimes(path string, mtime time.Time) error {
+	return nil
+}
@@ -3,18 +3,24 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os/exec"
+	"time"
 )
 
-func FailureMail(exitCode int, logBuffer *RingIO) {
+func FailureMail(c *Config, exitCode int, logBuffer *RingIO) {
+	var lines []RingLine
+	if c.NotifyLog > 0 {
+		lines = logBuffer.Recent(c.NotifyLog)
+	} else {
+		lines = logBuffer.Since(time.Time{})
+	}
 	mail := fmt.Sprintf("snaprd exited with return value %d.\nLatest log output:\n\n%s",
-		exitCode, logBuffer.GetAsText())
-	subject := fmt.Sprintf("snaprd failure (origin: %s)", config.Origin)
-	SendMail(config.Notify, subject, mail)
+		exitCode, linesAsText(lines))
+	subject := fmt.Sprintf("snaprd failure (origin: %s)", c.Origin)
+	SendMail(c.Notify, subject, mail)
 }
 
-func RsyncIssueMail(rsyncError error, rsyncErrorCode int) {
+func RsyncIssueMail(c *Config, rsyncError error, rsyncErrorCode int) {
 	var errText string
 	if s, ok := rsyncIgnoredErrors[rsyncErrorCode]; ok == true {
 		errText = s
@@ -23,10 +29,22 @@ func RsyncIssueMail(rsyncError error, rsyncErrorCode int) {
 	}
 	mail := fmt.Sprintf(`rsync finished with error: %s (%s).
 This is a non-fatal error, snaprd will try again.`, rsyncError, errText)
-	subject := fmt.Sprintf("snaprd rsync error (origin: %s)", config.Origin)
+	subject := fmt.Sprintf("snaprd rsync error (origin: %s)", c.Origin)
 	// In this case we care that the mail command is not blocking the whole
 	// program
-	go SendMail(config.Notify, subject, mail)
+	go SendMail(c.Notify, subject, mail)
+}
+
+func QuarantineMail(c *Config, path string, attempts int, purgeError error) {
+	mail := fmt.Sprintf(`Purging a snapshot failed %d times, the last error was: %s.
+It was moved to quarantine and will not be touched by snaprd anymore:
+
+%s
+
+Please remove it by hand, or rename it back to <start>-<end>-obsolete to let
+snaprd try again.`, attempts, purgeError, path)
+	subject := fmt.Sprintf("snaprd purge failed (origin: %s)", c.Origin)
+	go SendMail(c.Notify, subject, mail)
 }
 
 func NotifyMail(to, msg string) {
@@ -37,12 +55,12 @@ func SendMail(to, subject, msg string) {
 	sendmail := exec.Command("mail", "-s", subject, to)
 	stdin, err := sendmail.StdinPipe()
 	if err != nil {
-		log.Println(err)
+		errorf("could not send mail: %s", err)
 		return
 	}
 	stdout, err := sendmail.StdoutPipe()
 	if err != nil {
-		log.Println(err)
+		errorf("could not send mail: %s", err)
 		return
 	}
 	sendmail.Start()
@@ -51,5 +69,5 @@ func SendMail(to, subject, msg string) {
 	stdin.Close()
 	ioutil.ReadAll(stdout)
 	sendmail.Wait()
-	log.Printf("sending notification to %s done\n", to)
+	infof("sending notification to %s done", to)
 }
@@ -6,317 +6,433 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/daviddengcn/go-colortext"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
 
 const initialWait = time.Second * 30
 
-var config *Config
-var logger *log.Logger
+// waitForSchedule blocks until the snapshot following sn is due, as given by
+// cal, or until ctx is done. Returns true if the wait was cut short by a
+// signal on force.
+func (r *Repository) waitForSchedule(ctx context.Context, sn snapshot, cal *calendar, force <-chan os.Signal) bool {
+	var last time.Time
+	if !sn.isZero() {
+		last = sn.effectiveTime()
+		r.log.debugf("gap: %s", r.cl.Now().Sub(last))
+	}
+	r.mu.RLock()
+	next := cal.next(last, r.cl.Now())
+	r.mu.RUnlock()
+	r.state.waitUntil(next)
+	wait := next.Sub(r.cl.Now())
+	if wait <= 0 {
+		return false
+	}
+	r.log.infof("wait %s before next snapshot", wait)
+	select {
+	case <-force:
+		r.log.infof("Snapshot forced by signal, skipping wait time.")
+		return true
+	case <-r.cl.After(wait):
+		r.log.debugf("Awoken at %s\n", r.cl.Now())
+	case <-ctx.Done():
+	}
+	return false
+}
 
-func debugf(format string, args ...interface{}) {
-	if os.Getenv("SNAPRD_DEBUG") == "1" {
-		logger.Output(2, "<DEBUG> "+fmt.Sprintf(format, args...))
+// runTicker reads the first lastGood snapshot from disk and outputs it on out
+// after calling wait. Afterwards it does the same for every snapshot received
+// on in, until ctx is done.
+func (r *Repository) runTicker(ctx context.Context, in <-chan snapshot, out chan<- snapshot, wait func(sn snapshot, force <-chan os.Signal)) {
+	r.mu.RLock()
+	sn := r.lastGoodFromDisk()
+	r.mu.RUnlock()
+	if !sn.isZero() {
+		r.log.debugf("lastgood from disk: %s\n", sn.String())
+	}
+	for {
+		force := make(chan os.Signal, 1)
+		signal.Notify(force, syscall.SIGUSR2)
+		wait(sn, force)
+		signal.Stop(force)
+		select {
+		case out <- sn:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case sn = <-in:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
 // lastGoodTicker is the clock for the create loop. It takes the last
 // created snapshot on its input channel and outputs it on the output channel,
-// but only after an appropriate waiting time. To start things off, the first
-// lastGood snapshot has to be read from disk.
-func lastGoodTicker(in, out chan *snapshot, cl clock) {
-	var gap, wait time.Duration
-	var sn *snapshot
-	sn = lastGoodFromDisk(cl)
-	if sn != nil {
-		debugf("lastgood from disk: %s\n", sn.String())
+// but only after an appropriate waiting time, as given by cal.
+func (r *Repository) lastGoodTicker(ctx context.Context, in <-chan snapshot, out chan<- snapshot, cal *calendar) {
+	r.runTicker(ctx, in, out, func(sn snapshot, force <-chan os.Signal) {
+		r.waitForSchedule(ctx, sn, cal, force)
+	})
+}
+
+// runLoops makes, prunes and purges snapshots. The snapshot creation loop runs
+// in the calling goroutine, the ticker, the purge workers and the free space
+// check in goroutines of their own. All changes to the repository are made by its
+// owner goroutine. Snapshots are passed between them by value only.
+//
+// runLoops returns after ctx is done, after stop was closed and the current
+// snapshot and purges are finished, or after creating a snapshot failed. Only
+// in the last case an error is returned. It waits for all goroutines it
+// started.
+func (r *Repository) runLoops(ctx context.Context, stop <-chan struct{}, reloadc <-chan *reload) error {
+	cal, err := newCalendar(r.intervals()[0], r.config.Anchor, r.config.Blackout)
+	if err != nil {
+		return err
 	}
-	// kick off the loop
+	var w *originWatcher
+	if r.config.Watch {
+		w, err = newOriginWatcher(r.config.Origin)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	ownerStopped := r.startOwner(ctx)
+	defer func() {
+		cancel()
+		wg.Wait()
+		<-ownerStopped
+	}()
+
+	lastGoodIn := make(chan snapshot)
+	lastGoodOut := make(chan snapshot)
+	// Empty type for the channel: we don't care about what is inside, only
+	// about the fact that there is something inside. One pending check is
+	// enough, so the create loop never waits for it.
+	freeSpaceCheck := make(chan struct{}, 1)
+
+	wg.Add(1)
 	go func() {
-		in <- sn
-		return
+		defer wg.Done()
+		if w != nil {
+			r.changeTicker(ctx, lastGoodIn, lastGoodOut, cal, w.changed, r.config.WatchDebounce, r.config.WatchMaxStale)
+		} else {
+			r.lastGoodTicker(ctx, lastGoodIn, lastGoodOut, cal)
+		}
 	}()
+
+	// Usually the purgers get their input only from prune(). But there could
+	// be snapshots left behind from a previously failed snaprd run, so we
+	// look for them at the beginning and after every snapshot.
+	if !r.config.NoPurge {
+		r.rescanPurge(r.purgeQ)
+	}
+
+	// A graceful stop cancels drain, then the purge workers finish the
+	// snapshots they are purging, but do not take other ones.
+	drain, stopPurging := context.WithCancel(ctx)
+	defer stopPurging()
+	var purgers sync.WaitGroup
+	for i := 0; i < r.config.PurgeWorkers; i++ {
+		wg.Add(1)
+		purgers.Add(1)
+		go func() {
+			defer wg.Done()
+			defer purgers.Done()
+			r.purgeWorker(ctx, drain, r.purgeQ)
+		}()
+	}
+	r.log.debugf("started %d purge goroutines", r.config.PurgeWorkers)
+
+	// Free space claiming loop. It is only needed if we do not purge all
+	// expired snapshots automatically anyway.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			// Wait until we are ordered to do something
+			select {
+			case <-freeSpaceCheck:
+			case <-ctx.Done():
+				return
+			}
+			r.view().claimFreeSpace(ctx)
+		}
+	}()
+
+	// Snapshot creation loop
+	r.log.debugf("starting snapshot creation loop")
 	for {
-		sn := <-in
-		if sn != nil {
-			gap = cl.Now().Sub(sn.startTime)
-			debugf("gap: %s", gap)
-			wait = schedules[config.Schedule][0] - gap
-			if wait > 0 {
-				sigc := make(chan os.Signal, 1)
-				signal.Notify(sigc, syscall.SIGUSR2)
-				log.Println("wait", wait, "before next snapshot")
+		r.log.debugf("start of create loop")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-stop:
+			r.log.debugf("gracefully exiting snapshot creation loop")
+			stopPurging()
+			purgers.Wait()
+			return nil
+		case rl := <-reloadc:
+			rl.apply(r, cal)
+		case lastGood := <-lastGoodOut:
+			sn, err := r.createSnapshot(ctx, lastGood)
+			r.state.set(stagePruning, "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				r.log.debugf("snapshot creation finally failed (%s), the partial transfer will hopefully be reused", err)
+				return err
+			}
+			select {
+			case lastGoodIn <- sn:
+			case <-ctx.Done():
+				return nil
+			}
+			r.log.debugf("pruning")
+			r.prune(r.purgeQ)
+			if !r.config.NoPurge {
+				r.rescanPurge(r.purgeQ)
+			}
+			if r.config.NoPurge {
+				r.log.debugf("checking space constraints")
 				select {
-				case <-sigc:
-					log.Println("Snapshot forced by signal, skipping wait time.")
-				case <-time.After(wait):
-					debugf("Awoken at %s\n", cl.Now())
+				case freeSpaceCheck <- struct{}{}:
+				default:
 				}
 			}
+			r.state.set(stageWaiting, "")
 		}
-		out <- sn
 	}
 }
 
-// subcmdRun is the main, long-running routine and starts off a couple of
-// helper goroutines.
-func subcmdRun() (ferr error) {
-	pl := newPidLocker(filepath.Join(config.repository, ".pid"))
+// claimFreeSpace purges obsolete snapshots, oldest first, until the space
+// constraints are met or ctx is done.
+func (r *Repository) claimFreeSpace(ctx context.Context) {
+	// Get all obsolete snapshots
+	// This returns a sorted list
+	snapshots, err := r.findSnapshots()
+	if err != nil {
+		r.log.errorf("%s", err)
+		return
+	}
+	if len(snapshots) < 2 {
+		r.log.infof("less than 2 snapshots found, not pruning")
+		return
+	}
+	obsolete := snapshots.state(stateObsolete, none)
+	// We only delete as long as we need *AND* we have something to delete
+	for !checkFreeSpace(r.log, r.store, r.config.MinPercSpace, r.config.MinGiBSpace) && len(obsolete) > 0 && ctx.Err() == nil {
+		// If there is not enough space, purge the oldest snapshot
+		last := len(obsolete) - 1
+		r.purge(ctx, obsolete[last])
+		// We remove it from the list, it's quicker than recalculating the list.
+		obsolete = obsolete[:last]
+	}
+}
+
+// subcmdRun is the main, long-running routine. It runs the snapshot loops
+// until it is told to stop by a signal.
+func subcmdRun(r *Repository) (ferr error) {
+	pl := newPidLocker(r.path(".pid"))
 	err := pl.Lock()
 	if err != nil {
 		ferr = err
 		return
 	}
 	defer pl.Unlock()
-	if !config.NoWait {
+	n, err := newNotifier()
+	if err != nil {
+		r.log.warnf("%s", err)
+	}
+	defer n.Close()
+	if !r.config.NoWait {
 		sigc := make(chan os.Signal, 1)
 		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-		log.Printf("waiting %s before making snapshots\n", initialWait)
+		r.log.infof("waiting %s before making snapshots", initialWait)
+		n.notify(fmt.Sprintf("STATUS=waiting %s before making snapshots", initialWait))
 		select {
 		case <-sigc:
 			return errors.New("-> Early exit")
 		case <-time.After(initialWait):
 		}
+		signal.Stop(sigc)
 	}
-	createExit := make(chan bool)
-	createExitDone := make(chan error)
-	// The obsoleteQueue should not be larger than the absolute number of
-	// expected snapshots. However, there is no way (yet) to calculate that
-	// number.
-	obsoleteQueue := make(chan *snapshot, 10000)
-	lastGoodIn := make(chan *snapshot)
-	lastGoodOut := make(chan *snapshot)
-	// Empty type for the channel: we don't care about what is inside, only
-	// about the fact that there is something inside
-	freeSpaceCheck := make(chan struct{})
+	n.notify("READY=1")
+	defer n.notify("STOPPING=1")
+	superviseDone := make(chan struct{})
+	defer close(superviseDone)
+	go superviseLoop(n, r.state, new(realClock), watchdogInterval(), superviseDone)
 
-	cl := new(realClock)
-	go lastGoodTicker(lastGoodIn, lastGoodOut, cl)
-
-	// Snapshot creation loop
-	go func() {
-		var lastGood *snapshot
-		var createError error
-	CREATE_LOOP:
-		for {
-			debugf("start of create loop")
-			select {
-			case <-createExit:
-				debugf("gracefully exiting snapshot creation goroutine")
-				lastGoodOut = nil
-				break CREATE_LOOP
-			case lastGood = <-lastGoodOut:
-				sn, err := createSnapshot(lastGood)
-				if err != nil || sn == nil {
-					debugf("snapshot creation finally failed (%s), the partial transfer will hopefully be reused", err)
-					createError = err
-					go func() {
-						// need to stop the lastGoodTicker here because it could
-						// happen that it will be faster and the create loop would
-						// run again instead of exiting
-						lastGoodOut = nil
-						debugf("subcmdRun: sending createExit")
-						createExit <- true
-						debugf("subcmdRun: createExit sent")
-						return
-					}()
-					time.Sleep(time.Second)
-				}
-				lastGoodIn <- sn
-				debugf("pruning")
-				prune(obsoleteQueue, cl)
-				// If we purge automatically all the expired snapshots,
-				// there's nothing to remove to free space.
-				if config.NoPurge {
-					debugf("checking space constraints")
-					freeSpaceCheck <- struct{}{}
-				}
-			}
-		}
-		createExitDone <- createError
-	}()
-	debugf("started snapshot creation goroutine")
-
-	// Usually the purger gets its input only from prune(). But there could be
-	// snapshots left behind from a previously failed snaprd run, so we fill
-	// the obsoleteQueue once at the beginning.
-	for _, sn := range findDangling(cl) {
-		obsoleteQueue <- sn
-	}
-
-	// Purger loop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	// A validated new configuration, applied by the create loop between two
+	// snapshots. Only the latest one is kept.
+	reloadc := make(chan *reload, 1)
+	loopsDone := make(chan error, 1)
 	go func() {
-		for {
-			if sn := <-obsoleteQueue; !config.NoPurge {
-				sn.purge()
-			}
-		}
+		loopsDone <- r.runLoops(ctx, stop, reloadc)
 	}()
-	debugf("started purge goroutine")
 
-	// If we are going to automatically purge all expired snapshots, we
-	// needn't even starting the gofunc
-	if config.NoPurge {
-		// Free space claiming function
-		go func() {
-			for {
-				// Wait until we are ordered to do something
-				<-freeSpaceCheck
-				// Get all obsolete snapshots
-				// This returns a sorted list
-				snapshots, err := findSnapshots(cl)
+	// Global signal handling
+	sigc := make(chan os.Signal, 1)
+	// SIGUSR2 is only acted upon by the ticker while it waits, but it must
+	// not terminate snaprd at other times.
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	defer signal.Stop(sigc)
+	for {
+		select {
+		case sig := <-sigc:
+			r.log.debugf("Got signal %s", sig)
+			switch sig {
+			case syscall.SIGINT, syscall.SIGTERM:
+				r.log.infof("-> Immediate exit")
+				cancel()
+				<-loopsDone
+				return
+			case syscall.SIGUSR1:
+				r.log.infof("-> Graceful exit")
+				close(stop)
+				ferr = <-loopsDone
+				return
+			case syscall.SIGUSR2:
+				// handled by the ticker if it is waiting
+			case syscall.SIGHUP:
+				r.mu.RLock()
+				rl, err := reloadConfig(r.config, os.Args[2:])
+				r.mu.RUnlock()
 				if err != nil {
-					log.Println(err)
-					return
+					r.log.errorf("configuration not reloaded: %s", err)
+					continue
 				}
-				if len(snapshots) < 2 {
-					log.Println("less than 2 snapshots found, not pruning")
-					return
-				}
-				obsolete := snapshots.state(stateObsolete, none)
-				// We only delete as long as we need *AND* we have something to delete
-				for !checkFreeSpace(config.repository, config.MinPercSpace, config.MinGiBSpace) && len(obsolete) > 0 {
-					// If there is not enough space, purge the oldest snapshot
-					last := len(obsolete) - 1
-					obsolete[last].purge()
-					// We remove it from the list, it's quicker than recalculating the list.
-					obsolete = obsolete[:last]
+				r.log.infof("-> Reload, applied before the next snapshot")
+				select {
+				case <-reloadc:
+				default:
 				}
+				reloadc <- rl
 			}
-		}()
-	}
-
-	// Global signal handling
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
-	select {
-	case sig := <-sigc:
-		debugf("Got signal %s", sig)
-		switch sig {
-		case syscall.SIGINT, syscall.SIGTERM:
-			log.Println("-> Immediate exit")
-		case syscall.SIGUSR1:
-			log.Println("-> Graceful exit")
-			createExit <- true
-			ferr = <-createExitDone
+		// ferr will hold the error that happened in the create loop
+		case ferr = <-loopsDone:
+			r.log.infof("-> Rsync exit")
+			return
 		}
-	// ferr will hold the error that happened in the CREATE_LOOP
-	case ferr = <-createExitDone:
-		log.Println("-> Rsync exit")
 	}
-	return
 }
 
-// subcmdList give the user an overview of what's in the repository.
-func subcmdList(cl clock) {
-	intervals := schedules[config.Schedule]
-	if cl == nil {
-		cl = new(realClock)
+// mainExitCode runs the subcommand and returns the exit code, together with
+// the configuration if it could be loaded.
+func mainExitCode(logIO *RingIO) (int, *Config) {
+	setupLogging(logIO)
+	config, err := loadConfig()
+	if err != nil || config == nil {
+		if err == flag.ErrHelp {
+			return 0, nil
+		}
+		errorf("%s", err)
+		return 1, nil
 	}
-	snapshots, err := findSnapshots(cl)
-	if err != nil {
-		log.Println(err)
+	if err = rootLog.configure(config.LogFormat, config.LogLevel, config.NoLogDate); err != nil {
+		errorf("%s", err)
+		return 1, config
 	}
-	for n := len(intervals) - 2; n >= 0; n-- {
-		debugf("listing interval %d", n)
-		if config.showAll {
-			snapshots = snapshots.state(any, none)
-		} else {
-			snapshots = snapshots.state(stateComplete, none)
+	rootLog.base = logFields{"repository": config.repository, "origin": config.Origin}
+	r := newRepository(config, schedules, new(realClock), rootLog.sub())
+	switch subcmd {
+	case "run", "serve":
+		logIO.setBudget(config.LogBuffer << 10)
+		target, err := newLogTarget(config.LogTarget, config.SysFacility)
+		if err != nil {
+			errorf("%s", err)
+			return 1, config
 		}
-		snapshots := snapshots.interval(intervals, n, cl)
-		debugf("snapshots in interval %d: %s", n, snapshots)
-		if n < len(intervals)-2 {
-			ct.Foreground(ct.Yellow, false)
-			fmt.Printf("### From %s ago, %d/%d\n", intervals.offset(n+1), len(snapshots), intervals.goal(n))
-			ct.ResetColor()
-		} else {
-			ct.Foreground(ct.Yellow, false)
-			if config.MaxKeep != 0 {
-				fmt.Printf("### From past, %d/%d\n", len(snapshots), config.MaxKeep)
-			} else if config.MinPercSpace != 0 {
-				fmt.Printf("### From past, %d/(keep %.1f%% free)\n", len(snapshots), config.MinPercSpace)
-			} else if config.MinGiBSpace != 0 {
-				fmt.Printf("### From past, %d/(keep %dGiB free)\n", len(snapshots), config.MinGiBSpace)
-			} else {
-				fmt.Printf("### From past, %d/∞\n", len(snapshots))
-			}
-			ct.ResetColor()
+		if target != nil {
+			defer target.Close()
+			rootLog.target = target
+			// keep the output for the failure mail, but do not print it
+			logIO.setOutput(ioutil.Discard)
 		}
-		for i, sn := range snapshots {
-			stime := sn.startTime.Format("2006-01-02 Monday 15:04:05")
-			var dur, dist time.Duration
-			if i < len(snapshots)-1 {
-				dist = snapshots[i+1].startTime.Sub(sn.startTime)
-			}
-			if sn.endTime.After(sn.startTime) {
-				dur = sn.endTime.Sub(sn.startTime)
-			}
-			if config.verbose {
-				fmt.Printf("%d %s (%s, %s/%s, %s) \"%s\"\n", n, stime, dur, intervals[n], dist, sn.state, sn.Name())
+		if config.LogSize > 0 {
+			rl, err := openRepoLog(logFile(config.repository), int64(config.LogSize)<<20, config.LogKeep)
+			if err != nil {
+				warnf("could not open log file: %s", err)
 			} else {
-				fmt.Printf("%s (%s, %s)\n", stime, dur, intervals[n])
+				defer rl.Close()
+				rootLog.file = rl
 			}
 		}
-	}
-}
-
-func mainExitCode(logIO io.Writer) int {
-	logger = log.New(logIO, "", log.Ldate|log.Ltime|log.Lshortfile)
-	log.SetOutput(logIO)
-	var err error
-	if config, err = loadConfig(); err != nil || config == nil {
-		if err == flag.ErrHelp {
-			return 0
+		infof("%s %s started with pid %d", myName, version, os.Getpid())
+		infof("### Repository: %s, Origin: %s, Schedule: %s", config.repository, config.Origin, config.Schedule)
+		if subcmd == "serve" {
+			err = subcmdServe(r, os.Getenv("SSH_ORIGINAL_COMMAND"), os.Stdin, os.Stdout)
+		} else {
+			err = subcmdRun(r)
 		}
-		log.Println(err)
-		return 1
-	}
-	if config.NoLogDate {
-		log.SetFlags(logger.Flags() - log.Ldate - log.Ltime)
-		logger.SetFlags(logger.Flags() - log.Ldate - log.Ltime)
-	}
-	switch subcmd {
-	case "run":
-		log.Printf("%s %s started with pid %d\n", myName, version, os.Getpid())
-		log.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
-		err = subcmdRun()
 		if err != nil {
-			log.Println(err)
-			return 2
+			errorf("%s", err)
+			return 2, config
 		}
 	case "list":
-		if config.noColor {
+		if config.noColor || config.listFormat != "text" {
 			ct.Writer = ioutil.Discard
 		}
-		ct.Foreground(ct.Green, false)
-		fmt.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
-		ct.ResetColor()
-		subcmdList(nil)
+		if config.listFormat == "text" {
+			ct.Foreground(ct.Green, false)
+			fmt.Printf("### Repository: %s, Origin: %s, Schedule: %s\n", config.repository, config.Origin, config.Schedule)
+			ct.ResetColor()
+		}
+		subcmdList(r)
+	case "replicate":
+		if err = subcmdReplicate(r, config.replicaDest, config.replicaSched); err != nil {
+			errorf("%s", err)
+			return 2, config
+		}
+	case "export":
+		if err = subcmdExport(r, os.Stdout); err != nil {
+			errorf("%s", err)
+			return 2, config
+		}
+	case "import":
+		if err = subcmdImport(r, os.Stdin); err != nil {
+			errorf("%s", err)
+			return 2, config
+		}
 	case "scheds":
 		schedules.list()
+	case "config":
+		config.sources.show(os.Stdout)
+	case "log":
+		if err = subcmdLog(os.Stdout, r); err != nil {
+			errorf("%s", err)
+			return 1, config
+		}
 	}
-	return 0
+	return 0, config
 }
 
 func main() {
-	rio := newRingIO(os.Stderr, 25, 100)
-	exitCode := mainExitCode(rio)
+	rio := newRingIO(os.Stderr, defaultLogBuffer<<10)
+	exitCode, config := mainExitCode(rio)
 	// do not send a notification when error code is 0 or 1 (error in flag handling)
 	// because in the case 1 we can not access the config yet.
 	if exitCode > 1 && config.Notify != "" {
-		FailureMail(exitCode, rio)
+		FailureMail(config, exitCode, rio)
 	}
 	os.Exit(exitCode)
 }
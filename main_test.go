@@ -1,20 +1,125 @@
 package main
 
-import "os"
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeRsync writes a shell script to dir that behaves like a quick rsync,
+// with body run before the destination is created. Every call is recorded in
+// dir/calls.
+func fakeRsync(t *testing.T, dir, body string) string {
+	script := `#!/bin/sh
+for a; do dst=$a; done
+echo "$dst" >> "` + filepath.Join(dir, "calls") + `"
+` + body + `
+mkdir -p "$dst"
+echo "Number of files: 1"
+`
+	path := filepath.Join(dir, "rsync")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// calls returns how often the fake rsync in dir was run.
+func calls(dir string) int {
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	return bytes.Count(b, []byte("\n"))
+}
+
+// TestRunLoopsGraceful lets the create loop, the ticker, the owner and the
+// purger work on a repository concurrently for a while. Run with -race.
+func TestRunLoopsGraceful(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	r.config.Origin = "/tmp/"
+	r.config.RsyncPath = fakeRsync(t, r.path(), "")
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.runLoops(context.Background(), stop, nil)
+	}()
+	timeout := time.After(10 * time.Second)
+	for calls(r.path()) < 30 {
+		select {
+		case err := <-done:
+			t.Fatalf("runLoops() returned early: %v", err)
+		case <-timeout:
+			t.Fatalf("only %d snapshots made", calls(r.path()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("runLoops() gave error %v", err)
+	}
+	sl, err := r.findSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a graceful stop finishes the running snapshot and purge
+	if n := len(sl.state(stateIncomplete+statePurging, none)); n != 0 {
+		t.Errorf("%d incomplete or purging snapshots left: %v", n, sl)
+	}
+	latest, _ := os.Readlink(r.path("latest"))
+	if want := filepath.Join(dataSubdir, sl.lastGood().Name()); latest != want {
+		t.Errorf("latest points to %s, wanted %s", latest, want)
+	}
+	if n := len(sl.state(stateComplete, none)); n > 12 {
+		t.Errorf("%d complete snapshots, the schedule was not applied", n)
+	}
+}
+
+// TestRunLoopsCancel stops runLoops while rsync is running.
+func TestRunLoopsCancel(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	os.MkdirAll(r.path(dataSubdir), 0777)
+	r.config.Origin = "/tmp/"
+	r.config.RsyncPath = fakeRsync(t, r.path(), `mkdir -p "$dst"; exec sleep 10`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.runLoops(ctx, nil, nil)
+	}()
+	for calls(r.path()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runLoops() gave error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("runLoops() did not stop")
+	}
+	sl, _ := r.findSnapshots()
+	if len(sl) != 1 || sl[0].state != stateIncomplete {
+		t.Errorf("wanted one incomplete snapshot for reuse, got %v", sl)
+	}
+}
 
 func ExampleSubcmdList() {
-	mockConfig()
-	mockRepository()
-	defer os.RemoveAll(config.repository)
-	cl := newSkewClock(startAt)
-	subcmdList(cl)
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	subcmdList(r)
 	// Output:
 	// ### From past, 1/2
 	// 2014-05-17 Saturday 16:38:51 (1s, 1m20s)
 	// ### From 2m20s ago, 2/2
 	// 2014-05-17 Saturday 16:40:11 (1s, 40s)
 	// 2014-05-17 Saturday 16:40:51 (1s, 40s)
-	// ### From 1m0s ago, 2/2
+	// ### From 1m ago, 2/2
 	// 2014-05-17 Saturday 16:41:11 (1s, 20s)
 	// 2014-05-17 Saturday 16:41:31 (1s, 20s)
 	// ### From 20s ago, 4/4
@@ -27,9 +132,47 @@ func ExampleSubcmdList() {
 func ExampleScheds() {
 	schedules.list()
 	// Output:
-	// longterm: [6h0m0s 24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// shortterm: [10m0s 2h0m0s 24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// test1: [24h0m0s 168h0m0s 672h0m0s 876000h0m0s]
-	// testing: [5s 20s 2m20s 4m40s 876000h0m0s]
-	// testing2: [5s 20s 40s 1m20s 876000h0m0s]
+	// longterm: [6h 1d 1w 1M long]
+	// shortterm: [10m 2h 1d 1w 1M long]
+	// test1: [1d 1w 1M long]
+	// test2: [1d12h 2w 1M2w long]
+	// testing: [5s 20s 2m20s 4m40s long]
+	// testing2: [5s 20s 40s 1m20s long]
+}
+
+func TestSubcmdListTree(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	var out bytes.Buffer
+	r.listTree(&out, r.collectListing(), r.cl.Now())
+	want := `interval 3 (1m20s), from past, 1/2
+  2014 (1)
+    05 May (1)
+      17 Saturday (1)
+        16:38:51 (1s)
+interval 2 (40s), from 2m20s ago, 2/2
+  2014 (2)
+    05 May (2)
+      17 Saturday (2)
+        16:40:11 (1s) -> promoted to interval 3 in 29s
+        16:40:51 (1s)
+interval 1 (20s), from 1m ago, 2/2
+  2014 (2)
+    05 May (2)
+      17 Saturday (2)
+        16:41:11 (1s) -> obsolete in 9s
+        16:41:31 (1s)
+interval 0 (5s), from 20s ago, 4/4
+  2014 (4)
+    05 May (4)
+      17 Saturday (4)
+        16:41:46 (1s) -> obsolete in 4s
+        16:41:51 (1s)
+        16:41:56 (1s)
+        16:42:01 (1s)
+`
+	if out.String() != want {
+		t.Errorf("listTree() wrote\n%s\nwanted\n%s", out.String(), want)
+	}
 }
@@ -0,0 +1,91 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Extra information about snapshots that does not fit into the directory name
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+// snapshotMeta is stored per snapshot in the repository metadata file.
+type snapshotMeta struct {
+	// Files is the number of files rsync reported for the snapshot.
+	Files int64 `json:"files"`
+	// Verified is the last time (unix) a new snapshot was found to be
+	// identical to this one and therefore discarded.
+	Verified int64 `json:"verified,omitempty"`
+	// PurgeFailures is the number of failed attempts to purge the snapshot.
+	PurgeFailures int `json:"purgeFailures,omitempty"`
+}
+
+func (r *Repository) metaFile() string {
+	return r.path("." + myName + ".meta")
+}
+
+// metaKey returns the key used for sn in the metadata file. The start time
+// is the only part of the snapshot name that never changes.
+func metaKey(sn snapshot) string {
+	return strconv.FormatInt(sn.startTime.Unix(), 10)
+}
+
+// readMeta reads the metadata file. A missing file is not an error.
+func (r *Repository) readMeta() (map[string]snapshotMeta, error) {
+	meta := make(map[string]snapshotMeta)
+	b, err := ioutil.ReadFile(r.metaFile())
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// writeMeta atomically replaces the metadata file.
+func (r *Repository) writeMeta(meta map[string]snapshotMeta) error {
+	b, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.metaFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.metaFile())
+}
+
+// updateMeta reads the metadata file, lets f modify it and writes it back.
+func (r *Repository) updateMeta(f func(map[string]snapshotMeta)) error {
+	return r.mutate(func() error { return r.changeMeta(f) })
+}
+
+// changeMeta is updateMeta for the owner of the repository.
+func (r *Repository) changeMeta(f func(map[string]snapshotMeta)) error {
+	meta, err := r.readMeta()
+	if err != nil {
+		return err
+	}
+	f(meta)
+	return r.writeMeta(meta)
+}
+
+// loadMeta fills in metadata for all snapshots in sl. The metadata file is
+// always replaced atomically, so it can be read by anyone.
+func (r *Repository) loadMeta(sl snapshotList) error {
+	meta, err := r.readMeta()
+	if err != nil {
+		return err
+	}
+	for i := range sl {
+		if m, ok := meta[metaKey(sl[i])]; ok && m.Verified != 0 {
+			sl[i].verified = time.Unix(m.Verified, 0)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"syscall"
+)
+
+// mknod creates a special file like the one st was read from.
+func mknod(path string, st *syscall.Stat_t) error {
+	return syscall.Mknod(path, uint32(st.Mode), st.Rdev)
+}
@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Lower the CPU and I/O priority of a single thread
+
+package main
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerThreadPriority locks the calling goroutine to its thread and gives the
+// thread the lowest CPU priority and the idle I/O scheduling class. The
+// thread is never unlocked, so it is discarded when the goroutine ends and
+// the priorities do not apply to any other goroutine.
+func lowerThreadPriority() error {
+	runtime.LockOSThread()
+	tid := syscall.Gettid()
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19); err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"errors"
+)
+
+func lowerThreadPriority() error {
+	return errors.New("-purgeNice is only supported on linux")
+}
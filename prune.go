@@ -6,56 +6,54 @@
 
 package main
 
-import (
-	"log"
-)
-
 // Sieves snapshots according to schedule and marks them as obsolete. Also,
-// enqueue them in the buffered channel q for later reuse or deletion.
-func prune(q chan *snapshot, cl clock) {
-	intervals := schedules[config.Schedule]
+// add them to q for later deletion.
+func (r *Repository) prune(q *purgeQueue) {
+	intervals := r.intervals()
 	// interval 0 does not need pruning, start with 1
 	for i := len(intervals) - 2; i > 0; i-- {
-		snapshots, err := findSnapshots(cl)
+		snapshots, err := r.findSnapshots()
 		if err != nil {
-			log.Println(err)
+			r.log.errorf("%s", err)
 			return
 		}
 		if len(snapshots) < 2 {
-			log.Println("less than 2 snapshots found, not pruning")
+			r.log.infof("less than 2 snapshots found, not pruning")
 			return
 		}
-		iv := snapshots.interval(intervals, i, cl).state(stateComplete, stateObsolete)
+		iv := snapshots.interval(intervals, i, r.cl).state(stateComplete, stateObsolete)
 		pruneAgain := false
 		if len(iv) > 2 {
 			// prune highest interval by maximum number
 			if (i == len(intervals)-2) &&
-				(len(iv) > config.MaxKeep) &&
-				(config.MaxKeep != 0) {
-				debugf("%d snapshots in oldest interval", len(iv))
-				log.Printf("mark oldest as obsolete: %s", iv[0])
-				err := iv[0].transObsolete()
+				(len(iv) > r.config.MaxKeep) &&
+				(r.config.MaxKeep != 0) {
+				r.log.debugf("%d snapshots in oldest interval", len(iv))
+				r.snapLog(iv[0]).infof("mark oldest as obsolete: %s", iv[0])
+				sn, err := r.transObsolete(iv[0])
 				if err != nil {
-					log.Printf("could not transition snapshot: %s", err)
+					r.log.errorf("could not transition snapshot: %s", err)
+				} else {
+					q.add(sn)
+					pruneAgain = true
 				}
-				q <- iv[0]
-				pruneAgain = true
 			}
 			// regularly prune by sieving
 			youngest := len(iv) - 1
 			secondYoungest := youngest - 1
-			dist := iv[youngest].startTime.Sub(iv[secondYoungest].startTime)
+			dist := iv[youngest].effectiveTime().Sub(iv[secondYoungest].effectiveTime())
 			if dist.Seconds() < intervals[i].Seconds() {
-				log.Printf("mark as obsolete: %s", iv[youngest].Name())
-				err := iv[youngest].transObsolete()
+				r.snapLog(iv[youngest]).infof("mark as obsolete: %s", iv[youngest].Name())
+				sn, err := r.transObsolete(iv[youngest])
 				if err != nil {
-					log.Printf("could not transition snapshot: %s", err)
+					r.log.errorf("could not transition snapshot: %s", err)
+				} else {
+					q.add(sn)
+					pruneAgain = true
 				}
-				q <- iv[youngest]
-				pruneAgain = true
 			}
 			if pruneAgain {
-				prune(q, cl)
+				r.prune(q)
 			}
 		}
 	}
@@ -6,7 +6,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"testing"
 	"time"
 )
@@ -27,34 +26,44 @@ var mockSnapshots = []string{
 	"1400337721-1400337722-complete",
 }
 
-func mockConfig() {
+// mockConfig returns an empty repository in a temporary directory, with a
+// clock starting at startAt.
+func mockConfig() *Repository {
 	tmpRepository, err := ioutil.TempDir("", "snaprd_testing")
 	if err != nil {
 		panic("could not create temporary directory")
 	}
-	config = &Config{
-		repository: tmpRepository,
-		Schedule:   "testing2",
-		MaxKeep:    2,
-		NoPurge:    false,
-		SchedFile:  "testdata/snaprd.schedules",
+	c := &Config{
+		repository:    tmpRepository,
+		Schedule:      "testing2",
+		MaxKeep:       2,
+		NoPurge:       false,
+		PurgeWorkers:  2,
+		PurgeWalkers:  2,
+		PurgeAttempts: 2,
+		SchedFile:     "testdata/snaprd.schedules",
 	}
+	scheds := builtinSchedules()
+	scheds.addFromFile(c.SchedFile)
+	return newRepository(c, scheds, newSkewClock(startAt), rootLog.sub())
 }
 
-func mockRepository() {
+func mockRepository(r *Repository) {
 	for _, s := range mockSnapshots {
-		os.MkdirAll(filepath.Join(config.repository, dataSubdir, s), 0777)
+		os.MkdirAll(r.path(dataSubdir, s), 0777)
 	}
 }
 
-func assertSnapshotChanLen(t *testing.T, c chan *snapshot, want int) {
-	if got := len(c); got != want {
-		t.Errorf("channel %v contains %v snapshots, wanted %v", c, got, want)
+func assertPurgeQueueLen(t *testing.T, q *purgeQueue, want int) {
+	if got := q.len(); got != want {
+		t.Errorf("purge queue contains %v snapshots, wanted %v", got, want)
 	}
 }
 
-func assertSnapshotChanItem(t *testing.T, c chan *snapshot, want string) {
-	if got := <-c; got.String() != want {
+func assertPurgeQueueItem(t *testing.T, q *purgeQueue, want string) {
+	got, _ := q.next()
+	q.finish(got)
+	if got.String() != want {
 		t.Errorf("prune() obsoleted %v, wanted %v", got.String(), want)
 	}
 }
@@ -65,31 +74,32 @@ type pruneTestPair struct {
 }
 
 func TestPrune(t *testing.T) {
+	t.Parallel()
 	log.SetOutput(ioutil.Discard)
-	mockConfig()
-	mockRepository()
-	schedules.addFromFile(config.SchedFile)
-	defer os.RemoveAll(config.repository)
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
 	cl := newSkewClock(startAt)
-	c := make(chan *snapshot, 100)
+	r.cl = cl
+	q := newPurgeQueue()
 
 	tests := []pruneTestPair{
 		{0,
 			[]string{},
 		},
-		{schedules[config.Schedule][0],
+		{r.intervals()[0],
 			[]string{
 				"1400337706-1400337707 Obsolete",
 			},
 		},
-		{schedules[config.Schedule][0] * 10,
+		{r.intervals()[0] * 10,
 			[]string{
 				"1400337716-1400337717 Obsolete",
 				"1400337711-1400337712 Obsolete",
 				"1400337691-1400337692 Obsolete",
 			},
 		},
-		{schedules[config.Schedule][0] * 20,
+		{r.intervals()[0] * 20,
 			[]string{
 				"1400337531-1400337532 Obsolete",
 				"1400337721-1400337722 Obsolete",
@@ -101,10 +111,10 @@ func TestPrune(t *testing.T) {
 
 	for _, pair := range tests {
 		cl.forward(pair.iteration)
-		prune(c, cl)
-		assertSnapshotChanLen(t, c, len(pair.obsoleted))
+		r.prune(q)
+		assertPurgeQueueLen(t, q, len(pair.obsoleted))
 		for _, snS := range pair.obsoleted {
-			assertSnapshotChanItem(t, c, snS)
+			assertPurgeQueueItem(t, q, snS)
 		}
 	}
 }
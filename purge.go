@@ -0,0 +1,245 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Deletion of obsolete snapshots
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxPurgeQueue is the maximum number of snapshots waiting to be purged.
+// Snapshots that do not fit stay obsolete on disk and are found again by the
+// next rescan.
+const maxPurgeQueue = 1000
+
+// purgeQueue holds the snapshots waiting to be purged. Every snapshot is
+// queued at most once, keyed by metaKey, the part of its name that does not
+// change with its state. Adding to the queue never blocks. It is safe for use
+// by multiple goroutines.
+type purgeQueue struct {
+	mu      sync.Mutex
+	order   []string
+	pending map[string]snapshot
+	// busy are the snapshots taken by a purge worker, but not finished yet
+	busy map[string]bool
+	// ready has a value whenever there might be something to take
+	ready chan struct{}
+}
+
+func newPurgeQueue() *purgeQueue {
+	return &purgeQueue{
+		pending: make(map[string]snapshot),
+		busy:    make(map[string]bool),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// add queues sn for purging. Returns false if it is queued or being purged
+// already, or if the queue is full.
+func (q *purgeQueue) add(sn snapshot) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := metaKey(sn)
+	if _, ok := q.pending[key]; ok || q.busy[key] || len(q.order) >= maxPurgeQueue {
+		return false
+	}
+	q.pending[key] = sn
+	q.order = append(q.order, key)
+	q.wake()
+	return true
+}
+
+// wake makes sure a waiting worker looks at the queue. q.mu must be held.
+func (q *purgeQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest queued snapshot without waiting. It must be handed
+// back with finish when the worker is done with it.
+func (q *purgeQueue) next() (snapshot, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.order) == 0 {
+		return snapshot{}, false
+	}
+	key := q.order[0]
+	q.order = q.order[1:]
+	sn := q.pending[key]
+	delete(q.pending, key)
+	q.busy[key] = true
+	if len(q.order) > 0 {
+		q.wake()
+	}
+	return sn, true
+}
+
+// take waits for the next queued snapshot. Returns false if ctx is done first.
+func (q *purgeQueue) take(ctx context.Context) (snapshot, bool) {
+	for ctx.Err() == nil {
+		if sn, ok := q.next(); ok {
+			return sn, true
+		}
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+		}
+	}
+	return snapshot{}, false
+}
+
+// finish marks sn as no longer being purged.
+func (q *purgeQueue) finish(sn snapshot) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.busy, metaKey(sn))
+}
+
+// len returns how many snapshots are waiting to be purged, including the
+// ones being purged right now.
+func (q *purgeQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.order) + len(q.busy)
+}
+
+// rescanPurge queues all obsolete or half purged snapshots found on disk.
+func (r *Repository) rescanPurge(q *purgeQueue) {
+	added := 0
+	for _, sn := range r.findDangling() {
+		if q.add(sn) {
+			added++
+		}
+	}
+	if added > 0 {
+		r.log.infof("%d snapshots queued for purging, %d waiting in total", added, q.len())
+	}
+}
+
+// purgeWorker purges the snapshots in q until drain, which must be derived
+// from ctx, is done. The snapshot being purged then is finished, unless ctx
+// is done as well. The snapshot is looked up on disk again before, so
+// anything that happened to it since it was queued is taken into account.
+func (r *Repository) purgeWorker(ctx, drain context.Context, q *purgeQueue) {
+	for {
+		sn, ok := q.take(drain)
+		if !ok {
+			return
+		}
+		r.purgeQueued(ctx, sn)
+		q.finish(sn)
+	}
+}
+
+// purgeAll purges the snapshots in q one after the other, until q is empty
+// or ctx is done.
+func (r *Repository) purgeAll(ctx context.Context, q *purgeQueue) {
+	for ctx.Err() == nil {
+		sn, ok := q.next()
+		if !ok {
+			return
+		}
+		r.purgeQueued(ctx, sn)
+		q.finish(sn)
+	}
+}
+
+// purgeQueued purges sn, which was taken from the purge queue, unless it is
+// no longer obsolete or purging on disk. A reload during the purge takes
+// effect for the next snapshot.
+func (r *Repository) purgeQueued(ctx context.Context, sn snapshot) {
+	v := r.view()
+	if v.config.NoPurge {
+		return
+	}
+	if cur, ok := v.onDisk(sn); ok && (cur.state == stateObsolete || cur.state == statePurging) {
+		v.purge(ctx, cur)
+	} else {
+		v.snapLog(sn).debugf("%s is no longer to be purged", sn.Name())
+	}
+}
+
+// onDisk returns the snapshot with the start time of sn as it is currently
+// found on disk, and false if there is none.
+func (r *Repository) onDisk(sn snapshot) (snapshot, bool) {
+	snapshots, err := r.findSnapshots()
+	if err != nil {
+		r.log.errorf("%s", err)
+		return snapshot{}, false
+	}
+	for _, s := range snapshots {
+		if s.startTime.Equal(sn.startTime) {
+			return s, true
+		}
+	}
+	return snapshot{}, false
+}
+
+// purge deletes s from disk. If ctx is done before, s is left in purging
+// state, so deleting it is resumed with the next rescan.
+func (r *Repository) purge(ctx context.Context, s snapshot) {
+	s, err := r.transPurging(s)
+	if err != nil {
+		r.snapLog(s).errorf("error peparing %s for purging: %s", s.Name(), err)
+		return
+	}
+	r.snapLog(s).infof("purging %s", s.Name())
+	start := time.Now()
+	files, err := r.store.remove(ctx, s.Name(), func(files int64) {
+		r.snapLog(s).infof("purging %s: %d files removed in %s", s.Name(), files, time.Since(start).Round(time.Second))
+	})
+	if ctx.Err() != nil {
+		r.snapLog(s).infof("purging %s interrupted after %d files, it will be resumed", s.Name(), files)
+		return
+	}
+	if err != nil {
+		r.purgeFailed(s, err)
+		return
+	}
+	err = r.updateMeta(func(meta map[string]snapshotMeta) {
+		delete(meta, metaKey(s))
+	})
+	if err != nil {
+		r.snapLog(s).warnf("could not update metadata for %s: %s", s.Name(), err)
+	}
+	msg := fmt.Sprintf("finished purging %s in %s", s.Name(), time.Since(start).Round(time.Second))
+	if files > 0 {
+		msg += fmt.Sprintf(", %d files removed", files)
+	}
+	r.snapLog(s).infof("%s", msg)
+}
+
+// purgeFailed records a failed attempt to purge s, which is left in purging
+// state to be tried again after the next rescan. After too many attempts s is
+// quarantined instead and a notification is sent.
+func (r *Repository) purgeFailed(s snapshot, purgeErr error) {
+	failures := 0
+	err := r.updateMeta(func(meta map[string]snapshotMeta) {
+		m := meta[metaKey(s)]
+		m.PurgeFailures++
+		failures = m.PurgeFailures
+		meta[metaKey(s)] = m
+	})
+	if err != nil {
+		r.snapLog(s).warnf("could not update metadata for %s: %s", s.Name(), err)
+	}
+	if failures < r.config.PurgeAttempts {
+		r.snapLog(s).warnf("purging %s failed (attempt %d of %d), trying again later: %s", s.Name(), failures, r.config.PurgeAttempts, purgeErr)
+		return
+	}
+	q, err := r.transQuarantined(s)
+	if err != nil {
+		r.snapLog(s).errorf("purging %s failed and it could not be quarantined: %s", s.Name(), err)
+		return
+	}
+	r.snapLog(q).errorf("purging %s failed %d times, moved to quarantine: %s", s.Name(), failures, purgeErr)
+	if r.config.Notify != "" {
+		QuarantineMail(r.config, r.snapshotPath(q), failures, purgeErr)
+	}
+}
@@ -0,0 +1,106 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPurgeQueue(t *testing.T) {
+	q := newPurgeQueue()
+	obsolete := newSnapshot(time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete)
+	purging := newSnapshot(time.Unix(1400337711, 0), time.Unix(1400337712, 0), statePurging)
+	if !q.add(obsolete) {
+		t.Errorf("add() refused a new snapshot")
+	}
+	if q.add(obsolete) || q.add(purging) {
+		t.Errorf("add() accepted the same snapshot twice")
+	}
+	sn, ok := q.take(context.Background())
+	if !ok || sn.String() != obsolete.String() {
+		t.Errorf("take() gave %v, wanted %v", sn, obsolete)
+	}
+	if q.add(purging) {
+		t.Errorf("add() accepted a snapshot being purged")
+	}
+	if q.len() != 1 {
+		t.Errorf("len() is %d, wanted 1", q.len())
+	}
+	q.finish(sn)
+	if q.len() != 0 {
+		t.Errorf("len() is %d after finish(), wanted 0", q.len())
+	}
+	for i := 0; i < maxPurgeQueue; i++ {
+		q.add(newSnapshot(time.Unix(int64(i), 0), time.Unix(int64(i+1), 0), stateObsolete))
+	}
+	if q.add(obsolete) {
+		t.Errorf("add() accepted a snapshot into a full queue")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := newPurgeQueue().take(ctx); ok {
+		t.Errorf("take() returned a snapshot from an empty queue")
+	}
+}
+
+func TestPurgeWorker(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepositoryDangling(r)
+	defer os.RemoveAll(r.path())
+	q := r.purgeQ
+	r.rescanPurge(q)
+	if q.len() != 2 {
+		t.Fatalf("rescan queued %d snapshots, wanted 2", q.len())
+	}
+	// a queued snapshot that was removed in the meantime is skipped
+	q.add(newSnapshot(time.Unix(1400337000, 0), time.Unix(1400337001, 0), stateObsolete))
+	if !strings.Contains(r.state.status(), "3 snapshots to purge") {
+		t.Errorf("status does not show the queue: %s", r.state.status())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.purgeWorker(ctx, ctx, q)
+		close(done)
+	}()
+	for q.len() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if dangling := r.findDangling(); len(dangling) != 0 {
+		t.Errorf("snapshots left after purging: %v", dangling)
+	}
+}
+
+func TestPurgeFailed(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepositoryDangling(r)
+	defer os.RemoveAll(r.path())
+	sn := newSnapshot(time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging)
+	r.purgeFailed(sn, errors.New("operation not permitted"))
+	if _, err := os.Stat(r.snapshotPath(sn)); err != nil {
+		t.Errorf("snapshot was moved after the first failure: %v", err)
+	}
+	r.purgeFailed(sn, errors.New("operation not permitted"))
+	q := newSnapshot(sn.startTime, sn.endTime, stateQuarantined)
+	if _, err := os.Stat(r.snapshotPath(q)); err != nil {
+		t.Errorf("snapshot was not quarantined: %v", err)
+	}
+	for _, d := range r.findDangling() {
+		if d.startTime.Equal(sn.startTime) {
+			t.Errorf("quarantined snapshot is dangling: %s", d.Name())
+		}
+	}
+	meta, _ := r.readMeta()
+	if m := meta[metaKey(sn)]; m.PurgeFailures != 2 {
+		t.Errorf("%d purge failures recorded, wanted 2", m.PurgeFailures)
+	}
+}
@@ -0,0 +1,128 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Reload settings and schedules of a running snaprd on SIGHUP
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// restartSettings can not be changed by a reload.
+var restartSettings = []string{"repository", "watch", "logTarget", "syslogFacility", "logSize", "logKeep", "logBuffer", "purgeWorkers", "storage"}
+
+// reload is a validated new configuration for the run command.
+type reload struct {
+	config    *Config
+	schedules scheduleList
+	cal       *calendar
+}
+
+// reloadConfig resolves the settings of the run command again from args, the
+// environment and the configuration files, and reads the schedule file. The
+// result is validated, but not applied. Settings that can only be changed by
+// a restart keep the values from old.
+func reloadConfig(old *Config, args []string) (*reload, error) {
+	c := new(Config)
+	settings := c.settings()
+	if err := c.resolve(settings, settings, args, false); err != nil {
+		return nil, err
+	}
+	if old.sources != nil {
+		for _, name := range restartSettings {
+			was := old.sources.flags.Lookup(name).Value.String()
+			if now := settings.Lookup(name).Value.String(); now != was {
+				warnf("changing %s from %q to %q requires a restart", name, was, now)
+				settings.Set(name, was)
+			}
+		}
+	}
+	scheds := builtinSchedules()
+	if c.SchedFile != "" {
+		if err := scheds.addFromFile(c.SchedFile); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := scheds[c.Schedule]; !ok {
+		return nil, fmt.Errorf("no such schedule: %s", c.Schedule)
+	}
+	cal, err := newCalendar(scheds[c.Schedule][0], c.Anchor, c.Blackout)
+	if err != nil {
+		return nil, err
+	}
+	if c.Watch && !isLocalOrigin(c.Origin) {
+		return nil, fmt.Errorf("-watch only works with local origins: %s", c.Origin)
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		return nil, err
+	}
+	if !validLogFormat(c.LogFormat) {
+		return nil, fmt.Errorf("unknown log format: %s", c.LogFormat)
+	}
+	if err := c.checkPurge(); err != nil {
+		return nil, err
+	}
+	if err := c.checkCopier(); err != nil {
+		return nil, err
+	}
+	return &reload{c, scheds, cal}, nil
+}
+
+// configDiff describes the differences between two configurations and their
+// schedules, one line per changed setting.
+func configDiff(old, new *Config, oldScheds, newScheds scheduleList) []string {
+	var diff []string
+	values := func(c *Config) map[string]string {
+		m := make(map[string]string)
+		if c.sources != nil {
+			c.sources.flags.VisitAll(func(f *flag.Flag) {
+				m[f.Name] = f.Value.String()
+			})
+		}
+		return m
+	}
+	oldValues, newValues := values(old), values(new)
+	var names []string
+	for name := range newValues {
+		if _, ok := flagAliases[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if oldValues[name] != newValues[name] {
+			diff = append(diff, fmt.Sprintf("%s: %q -> %q", name, oldValues[name], newValues[name]))
+		}
+	}
+	if o, n := oldScheds[new.Schedule], newScheds[new.Schedule]; o.String() != n.String() && o != nil {
+		diff = append(diff, fmt.Sprintf("schedule %s: %s -> %s", new.Schedule, o.String(), n.String()))
+	}
+	return diff
+}
+
+// apply replaces the configuration of repo by rl and logs what changed. cal
+// is the calendar used by the ticker. The repository mutex protects it along
+// with the configuration.
+func (rl *reload) apply(repo *Repository, cal *calendar) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	diff := configDiff(repo.config, rl.config, repo.schedules, rl.schedules)
+	if len(diff) == 0 {
+		repo.log.infof("reloaded configuration, nothing changed")
+	}
+	for _, d := range diff {
+		repo.log.infof("reloaded configuration, %s", d)
+	}
+	repo.config = rl.config
+	repo.store = newStorage(rl.config)
+	repo.schedules = rl.schedules
+	*cal = *rl.cal
+	if err := repo.log.configure(rl.config.LogFormat, rl.config.LogLevel, rl.config.NoLogDate); err != nil {
+		repo.log.warnf("%s", err)
+	}
+	if err := rl.config.WriteCache(); err != nil {
+		repo.log.warnf("could not write settings cache file: %s", err)
+	}
+}
@@ -0,0 +1,113 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	repository := mockConfig().config.repository
+	defer os.RemoveAll(repository)
+	os.Setenv(envPrefix+"CONFIG", filepath.Join(repository, "nonexistent.conf"))
+	defer os.Unsetenv(envPrefix + "CONFIG")
+	args := []string{"-repository", repository, "-origin", "/tmp", "-schedule", "shortterm"}
+	old, err := reloadConfig(new(Config), args)
+	if err != nil {
+		t.Fatalf("reloadConfig() gave error %v", err)
+	}
+
+	repoConfig := filepath.Join(repository, repoConfigName)
+	ioutil.WriteFile(repoConfig, []byte(`{"maxKeep": 5, "logSize": 7}`), 0644)
+	r, err := reloadConfig(old.config, args)
+	if err != nil {
+		t.Fatalf("reloadConfig() gave error %v", err)
+	}
+	if r.config.MaxKeep != 5 {
+		t.Errorf("maxKeep is %d, wanted 5", r.config.MaxKeep)
+	}
+	if r.config.LogSize != old.config.LogSize {
+		t.Errorf("logSize changed to %d, but requires a restart", r.config.LogSize)
+	}
+	diff := configDiff(old.config, r.config, old.schedules, r.schedules)
+	if len(diff) != 1 || diff[0] != `maxKeep: "0" -> "5"` {
+		t.Errorf("unexpected difference: %q", diff)
+	}
+
+	ioutil.WriteFile(repoConfig, []byte(`{"schedule": "nonexistent"}`), 0644)
+	if _, err := reloadConfig(old.config, args[:4]); err == nil || !strings.Contains(err.Error(), "no such schedule") {
+		t.Errorf("reloadConfig() should fail for an unknown schedule, got %v", err)
+	}
+}
+
+func TestReloadApply(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	args := []string{"-repository", r.config.repository, "-origin", "/tmp", "-schedule", "shortterm"}
+	rl, err := reloadConfig(r.config, args)
+	if err != nil {
+		t.Fatalf("reloadConfig() gave error %v", err)
+	}
+	cal := new(calendar)
+	rl.apply(r, cal)
+	if r.config != rl.config || r.intervals().String() != schedules["shortterm"].String() {
+		t.Errorf("configuration not replaced: %+v", r.config)
+	}
+	if cal.period != rl.cal.period {
+		t.Errorf("calendar not replaced")
+	}
+	if _, err := os.Stat(r.path(cacheName)); err != nil {
+		t.Errorf("settings cache not written: %v", err)
+	}
+}
+
+// A reload must not wait for a purge, which can take hours.
+func TestReloadDuringPurge(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	ms := mockMemStorage(r, mockSnapshots)
+	ms.removing = make(chan string, 1)
+	ms.release = make(chan struct{})
+	sn, _ := r.onDisk(mustParseSnapshot(t, mockSnapshots[0]))
+	sn, err := r.transObsolete(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-repository", r.config.repository, "-origin", "/tmp", "-schedule", "shortterm"}
+	rl, err := reloadConfig(r.config, args)
+	if err != nil {
+		t.Fatalf("reloadConfig() gave error %v", err)
+	}
+	purged := make(chan struct{})
+	go func() {
+		r.purgeQueued(context.Background(), sn)
+		close(purged)
+	}()
+	select {
+	case <-ms.removing:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("purge did not start")
+	}
+	applied := make(chan struct{})
+	go func() {
+		rl.apply(r, new(calendar))
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Errorf("reload waited for the purge")
+	}
+	close(ms.release)
+	<-purged
+	<-applied
+	if n, _ := ms.count(statePurging); n != 0 {
+		t.Errorf("purge was not finished with the storage it started with")
+	}
+}
@@ -0,0 +1,248 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Removal of huge directory trees, like snapshots with millions of files
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readDirChunk is how many directory entries are read at once, so huge
+// directories do not have to fit into memory.
+const readDirChunk = 1024
+
+// treeRemover removes directory trees with several goroutines ("walkers")
+// working on different directories at the same time.
+type treeRemover struct {
+	walkers int
+	// rate is the maximum number of files removed per second by all walkers
+	// together. Zero means unlimited.
+	rate int
+	// nice gives the walkers the lowest CPU and I/O priority.
+	nice bool
+	// progress, if set, is called every progressInterval with the number of
+	// files removed so far.
+	progress         func(files int64)
+	progressInterval time.Duration
+}
+
+// removeAll removes root and everything below it, like os.RemoveAll. It
+// returns the number of files removed and the first error it encountered.
+// Other files are still removed after an error. If ctx is done, the walkers
+// stop and ctx.Err() is returned. Whatever is left of the tree can be removed
+// by calling removeAll again.
+func (tr *treeRemover) removeAll(ctx context.Context, root string) (int64, error) {
+	fi, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !fi.IsDir() {
+		return 1, os.Remove(root)
+	}
+	w := &treeWalk{
+		ctx:     ctx,
+		pending: []string{root},
+	}
+	w.cond = sync.NewCond(&w.mu)
+	if tr.rate > 0 {
+		w.limit = &rateLimiter{interval: time.Second / time.Duration(tr.rate)}
+	}
+	walkers := tr.walkers
+	if walkers < 1 {
+		walkers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < walkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tr.nice {
+				if err := lowerThreadPriority(); err != nil {
+					debugf("could not lower priority of purge walker: %s", err)
+				}
+			}
+			w.run()
+		}()
+	}
+	walked := make(chan struct{})
+	reported := make(chan struct{})
+	if tr.progress == nil || tr.progressInterval <= 0 {
+		close(reported)
+	} else {
+		go func() {
+			defer close(reported)
+			t := time.NewTicker(tr.progressInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					tr.progress(atomic.LoadInt64(&w.removed))
+				case <-walked:
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(walked)
+	<-reported
+	if err := ctx.Err(); err != nil {
+		return w.removed, err
+	}
+	// Only empty directories are left now.
+	if err := os.RemoveAll(root); err != nil {
+		w.fail(err)
+	}
+	return w.removed, w.err
+}
+
+// treeWalk is the state shared by the walkers of one removeAll call.
+type treeWalk struct {
+	ctx   context.Context
+	limit *rateLimiter
+	mu    sync.Mutex
+	cond  *sync.Cond
+	// pending are the directories not looked at yet
+	pending []string
+	// active is the number of walkers busy with a directory
+	active  int
+	removed int64
+	err     error
+}
+
+// run takes directories from the pending list and removes the files in them,
+// until there is nothing left to do.
+func (w *treeWalk) run() {
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && w.active > 0 && w.ctx.Err() == nil {
+			w.cond.Wait()
+		}
+		if len(w.pending) == 0 || w.ctx.Err() != nil {
+			w.cond.Broadcast()
+			w.mu.Unlock()
+			return
+		}
+		dir := w.pending[len(w.pending)-1]
+		w.pending = w.pending[:len(w.pending)-1]
+		w.active++
+		w.mu.Unlock()
+
+		w.removeFiles(dir)
+
+		w.mu.Lock()
+		w.active--
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// removeFiles removes all files in dir and adds its subdirectories to the
+// pending list. Directories that are not accessible or writable, which rsync
+// creates quite often, are made so first.
+func (w *treeWalk) removeFiles(dir string) {
+	f, err := os.Open(dir)
+	if os.IsPermission(err) {
+		if ownerAccess(dir) == nil {
+			f, err = os.Open(dir)
+		}
+	}
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Mode().Perm()&0700 != 0700 {
+		if err := ownerAccess(dir); err != nil {
+			w.fail(err)
+		}
+	}
+	for {
+		entries, err := f.Readdir(readDirChunk)
+		for _, fi := range entries {
+			path := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				w.mu.Lock()
+				w.pending = append(w.pending, path)
+				w.cond.Signal()
+				w.mu.Unlock()
+				continue
+			}
+			if w.limit != nil {
+				w.limit.wait(w.ctx)
+			}
+			if w.ctx.Err() != nil {
+				return
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				w.fail(err)
+				continue
+			}
+			atomic.AddInt64(&w.removed, 1)
+		}
+		if err == io.EOF || len(entries) == 0 {
+			return
+		}
+		if err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// ownerAccess gives the owner of path full access to it.
+func ownerAccess(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, fi.Mode().Perm()|0700)
+}
+
+// fail records err if it is the first one.
+func (w *treeWalk) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// rateLimiter spaces events at least interval apart. It is safe for use by
+// multiple goroutines.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next event may happen or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
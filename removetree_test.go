@@ -0,0 +1,119 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockTree creates a directory tree with dirs subdirectories of depth levels
+// below root, each of them containing files files. Returns the number of
+// files created.
+func mockTree(t *testing.T, root string, levels, dirs, files int) int64 {
+	var n int64
+	for i := 0; i < files; i++ {
+		if err := ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("f%d", i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if levels == 0 {
+		return n
+	}
+	for i := 0; i < dirs; i++ {
+		sub := filepath.Join(root, fmt.Sprintf("d%d", i))
+		os.Mkdir(sub, 0755)
+		n += mockTree(t, sub, levels-1, dirs, files)
+	}
+	return n
+}
+
+func TestRemoveAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "tree")
+	os.Mkdir(root, 0755)
+	want := mockTree(t, root, 3, 4, 5)
+	var reported int64
+	tr := &treeRemover{
+		walkers:          4,
+		nice:             true,
+		progress:         func(files int64) { reported = files },
+		progressInterval: time.Millisecond,
+	}
+	n, err := tr.removeAll(context.Background(), root)
+	if err != nil {
+		t.Fatalf("removeAll() gave error %v", err)
+	}
+	if n != want {
+		t.Errorf("removeAll() removed %d files, wanted %d", n, want)
+	}
+	if reported > want {
+		t.Errorf("progress reported %d files, more than there were", reported)
+	}
+	if _, err := os.Lstat(root); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", root)
+	}
+	if n, err := tr.removeAll(context.Background(), root); n != 0 || err != nil {
+		t.Errorf("removeAll() of a missing tree gave %d, %v", n, err)
+	}
+}
+
+func TestRemoveAllRateResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "tree")
+	os.Mkdir(root, 0755)
+	want := mockTree(t, root, 1, 2, 10)
+	// 30 files take 300ms at this rate, so the deadline interrupts it
+	tr := &treeRemover{walkers: 2, rate: 100}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	n, err := tr.removeAll(ctx, root)
+	if err != context.DeadlineExceeded {
+		t.Errorf("removeAll() gave error %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if n == 0 || n >= want {
+		t.Errorf("removeAll() removed %d of %d files before the deadline", n, want)
+	}
+	tr.rate = 0
+	rest, err := tr.removeAll(context.Background(), root)
+	if err != nil || n+rest != want {
+		t.Errorf("resumed removeAll() removed %d files (%v), wanted %d", rest, err, want-n)
+	}
+}
+
+func TestRemoveAllReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "tree")
+	os.Mkdir(root, 0755)
+	want := mockTree(t, root, 2, 2, 2)
+	// like rsync does for read-only directories in the origin
+	os.Chmod(filepath.Join(root, "d0"), 0555)
+	os.Chmod(filepath.Join(root, "d1", "d1"), 0)
+	os.Chmod(root, 0500)
+	tr := &treeRemover{walkers: 2}
+	n, err := tr.removeAll(context.Background(), root)
+	if err != nil || n != want {
+		t.Errorf("removeAll() removed %d of %d files: %v", n, want, err)
+	}
+	if _, err := os.Lstat(root); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", root)
+	}
+}
@@ -0,0 +1,265 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Replication of complete snapshots to a second repository
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// replicasSubdir holds the state of the replicas of a repository, one
+// directory per target.
+const replicasSubdir = ".replicas"
+
+// replicaNames is the file listing the snapshots of a replica.
+const replicaNames = "snapshots"
+
+// replicaStorage stands in for the snapshots of a replica, which is usually
+// on another host. Only the names of the snapshots are kept, in the state
+// directory of the replica. State transitions are made to these names only,
+// the replica itself contains complete snapshots until they are removed from
+// it. It is not safe for concurrent use.
+type replicaStorage struct {
+	// file lists the names, one per line
+	file      string
+	names     []string
+	dest      string
+	rsyncPath string
+}
+
+// newReplicaStorage returns the storage for the replica dest, with the names
+// of its snapshots read from dir.
+func newReplicaStorage(dir, dest, rsyncPath string) (*replicaStorage, error) {
+	rs := &replicaStorage{
+		file:      filepath.Join(dir, replicaNames),
+		dest:      strings.TrimSuffix(dest, "/"),
+		rsyncPath: rsyncPath,
+	}
+	b, err := ioutil.ReadFile(rs.file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rs.names = strings.Fields(string(b))
+	sort.Strings(rs.names)
+	return rs, nil
+}
+
+// unlinked makes the repository leave out symlinks, the snapshots of a
+// replica are not on this host.
+func (rs *replicaStorage) unlinked() {}
+
+// save atomically replaces the file listing the names.
+func (rs *replicaStorage) save() error {
+	tmp := rs.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(rs.names, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rs.file)
+}
+
+// add records name as replicated.
+func (rs *replicaStorage) add(name string) error {
+	rs.names = append(rs.names, name)
+	sort.Strings(rs.names)
+	return rs.save()
+}
+
+// dataPath returns the data directory of the replica, in rsync syntax.
+func (rs *replicaStorage) dataPath() string {
+	return rs.dest + "/" + dataSubdir
+}
+
+// remoteName returns the name name has in the replica, where all snapshots
+// are complete.
+func remoteName(name string) string {
+	stime, etime, _, err := parseSnapshotName(name)
+	if err != nil {
+		return name
+	}
+	return newSnapshot(stime, etime, stateComplete).Name()
+}
+
+func (rs *replicaStorage) list() ([]string, error) {
+	return append([]string(nil), rs.names...), nil
+}
+
+func (rs *replicaStorage) path(name string) string {
+	return rs.dataPath() + "/" + remoteName(name)
+}
+
+func (rs *replicaStorage) target(name string) string {
+	return rs.path(name)
+}
+
+func (rs *replicaStorage) prepare(name, base string) error {
+	return nil
+}
+
+// rsyncArgs returns the --link-dest option relative to the new snapshot, so
+// it works for remote replicas as well.
+func (rs *replicaStorage) rsyncArgs(base string) []string {
+	if base == "" {
+		return nil
+	}
+	return []string{"--link-dest=../" + remoteName(base)}
+}
+
+func (rs *replicaStorage) rename(from, to string) error {
+	for i, name := range rs.names {
+		if name == from {
+			rs.names[i] = to
+			sort.Strings(rs.names)
+			return rs.save()
+		}
+	}
+	return fmt.Errorf("no such snapshot in replica: %s", from)
+}
+
+func (rs *replicaStorage) complete(from, to string) error {
+	return rs.rename(from, to)
+}
+
+// remove deletes the snapshot from the replica with rsync, by syncing the
+// data directory with an empty one, but only for the snapshot.
+func (rs *replicaStorage) remove(ctx context.Context, name string, progress func(files int64)) (int64, error) {
+	empty, err := ioutil.TempDir("", myName+"_empty")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(empty)
+	cmd := exec.CommandContext(ctx, rs.rsyncPath, "-r", "--delete",
+		"--include=/"+remoteName(name)+"/***", "--exclude=*",
+		empty+"/", rs.dataPath()+"/")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("could not remove %s from replica: %s", name, err)
+	}
+	for i, n := range rs.names {
+		if n == name {
+			rs.names = append(rs.names[:i], rs.names[i+1:]...)
+			break
+		}
+	}
+	return 0, rs.save()
+}
+
+func (rs *replicaStorage) free() (uint64, uint64, error) {
+	return 0, 0, errors.New("free space of a replica is unknown")
+}
+
+var unsafeKeyChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// replicaKey returns the name of the state directory for the replica dest.
+func replicaKey(dest string) string {
+	return unsafeKeyChars.ReplaceAllString(strings.TrimSuffix(dest, "/"), "_")
+}
+
+// newReplica returns a repository standing for the replica dest of r. It is
+// pruned with schedule, and its state is kept in a directory of r.
+func (r *Repository) newReplica(dest, schedule string) (*Repository, error) {
+	dir := r.path(replicasSubdir, replicaKey(dest))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rs, err := newReplicaStorage(dir, dest, r.config.RsyncPath)
+	if err != nil {
+		return nil, err
+	}
+	c := *r.config
+	c.repository = dir
+	c.Schedule = schedule
+	c.MaxKeep = 0
+	c.NoPurge = false
+	replica := newRepository(&c, r.schedules, r.cl, r.log)
+	replica.store = rs
+	return replica, nil
+}
+
+// replicateSnapshot copies sn to the replica, hard linking unchanged files to
+// base, the snapshot replicated before, if there is one.
+func (r *Repository) replicateSnapshot(ctx context.Context, replica *Repository, sn, base snapshot) error {
+	rs := replica.store.(*replicaStorage)
+	args := []string{"-aH", "--numeric-ids", "--delete"}
+	src, dst := r.snapshotPath(sn)+"/", rs.target(sn.Name())+"/"
+	if base.isZero() {
+		// rsync only creates the last directory of the destination, which
+		// might be the data directory for the first snapshot.
+		src, dst = r.snapshotPath(sn), rs.dataPath()+"/"
+	} else {
+		args = append(args, rs.rsyncArgs(base.Name())...)
+	}
+	args = append(args, src, dst)
+	r.snapLog(sn).infof("run: %s %s", r.config.RsyncPath, args)
+	cmd := exec.CommandContext(ctx, r.config.RsyncPath, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("could not replicate %s: %s", sn.Name(), err)
+	}
+	if err := rs.add(sn.Name()); err != nil {
+		return err
+	}
+	r.snapLog(sn).infof("replicated %s in %s", sn.Name(), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// subcmdReplicate copies the complete snapshots of r to the repository dest,
+// oldest first, each one hard linked to the one before. Only snapshots younger
+// than the last one replicated before are copied, so snapshots pruned from
+// the replica are not copied again. If schedule is not empty, the replica is
+// pruned with it afterwards.
+func subcmdReplicate(r *Repository, dest, schedule string) error {
+	replica, err := r.newReplica(dest, schedule)
+	if err != nil {
+		return err
+	}
+	pl := newPidLocker(replica.path(".pid"))
+	if err := pl.Lock(); err != nil {
+		return err
+	}
+	defer pl.Unlock()
+	ctx, cancel := r.cancelOnSignal()
+	defer cancel()
+
+	snapshots, err := r.findSnapshots()
+	if err != nil {
+		return err
+	}
+	replicated, err := replica.findSnapshots()
+	if err != nil {
+		return err
+	}
+	base := replicated.lastGood()
+	last := replicated.last()
+	n := 0
+	for _, sn := range snapshots.state(stateComplete, none) {
+		if !last.isZero() && !sn.startTime.After(last.startTime) {
+			continue
+		}
+		if err := r.replicateSnapshot(ctx, replica, sn, base); err != nil {
+			return err
+		}
+		base = sn
+		n++
+	}
+	r.log.infof("%d snapshots replicated to %s", n, dest)
+	if schedule == "" {
+		return nil
+	}
+	replica.prune(replica.purgeQ)
+	replica.rescanPurge(replica.purgeQ)
+	replica.purgeAll(ctx, replica.purgeQ)
+	return ctx.Err()
+}
@@ -0,0 +1,107 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRsyncCopy writes a shell script to dir that copies local directories
+// like rsync, as far as the replication needs it. Every call is recorded in
+// dir/calls.
+func fakeRsyncCopy(t *testing.T, dir string) string {
+	script := `#!/bin/sh
+echo "$@" >> "` + filepath.Join(dir, "calls") + `"
+for a; do
+	case $a in --include=*) del=${a#--include=/}; del=${del%/\*\*\*};; esac
+	src=$dst; dst=$a
+done
+if [ -n "$del" ]; then rm -rf "$dst$del"; exit 0; fi
+case $src in */) ;; *) dst=$dst$(basename "$src")/;; esac
+mkdir -p "$dst" && cp -a "$src/." "$dst"
+`
+	path := filepath.Join(dir, "rsync")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// assertReplica checks that the replica dest contains the snapshots names
+// and nothing else.
+func assertReplica(t *testing.T, dest string, names []string) {
+	files, _ := ioutil.ReadDir(filepath.Join(dest, dataSubdir))
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Name())
+		if b, _ := ioutil.ReadFile(filepath.Join(dest, dataSubdir, f.Name(), "file")); string(b) != f.Name() {
+			t.Errorf("%s was not copied", f.Name())
+		}
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("replica contains %v, wanted %v", got, names)
+	}
+}
+
+func TestSubcmdReplicate(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	for _, name := range mockSnapshots {
+		ioutil.WriteFile(r.path(dataSubdir, name, "file"), []byte(name), 0644)
+	}
+	os.Rename(r.path(dataSubdir, mockSnapshots[0]), r.path(dataSubdir, "1400337531-1400337532-obsolete"))
+	dest := filepath.Join(r.path(), "replica")
+	os.Mkdir(dest, 0755)
+	r.config.RsyncPath = fakeRsyncCopy(t, r.path())
+
+	if err := subcmdReplicate(r, dest, ""); err != nil {
+		t.Fatalf("subcmdReplicate() gave error %v", err)
+	}
+	assertReplica(t, dest, mockSnapshots[1:])
+	b, _ := ioutil.ReadFile(filepath.Join(r.path(), "calls"))
+	calls := strings.Split(string(b), "\n")
+	if strings.Contains(calls[0], "--link-dest") {
+		t.Errorf("first snapshot was based on another one: %s", calls[0])
+	}
+	if want := "--link-dest=../" + mockSnapshots[1]; !strings.Contains(calls[1], want) {
+		t.Errorf("second snapshot was not based on the first one: %s", calls[1])
+	}
+
+	// nothing new, nothing copied
+	if err := subcmdReplicate(r, dest, ""); err != nil {
+		t.Fatalf("subcmdReplicate() gave error %v", err)
+	}
+	if b2, _ := ioutil.ReadFile(filepath.Join(r.path(), "calls")); !bytes.Equal(b, b2) {
+		t.Errorf("rsync was run again for replicated snapshots")
+	}
+
+	r.cl.(*skewClock).forward(5 * time.Second)
+	name := "1400337726-1400337727-complete"
+	os.Mkdir(r.path(dataSubdir, name), 0755)
+	ioutil.WriteFile(r.path(dataSubdir, name, "file"), []byte(name), 0644)
+	if err := subcmdReplicate(r, dest, "testing2"); err != nil {
+		t.Fatalf("subcmdReplicate() gave error %v", err)
+	}
+	// the same as the second step of TestPrune
+	want := append([]string{}, mockSnapshots[1:5]...)
+	want = append(want, append(mockSnapshots[6:], name)...)
+	assertReplica(t, dest, want)
+	state := r.path(replicasSubdir, replicaKey(dest))
+	if b, _ := ioutil.ReadFile(filepath.Join(state, replicaNames)); !reflect.DeepEqual(strings.Fields(string(b)), want) {
+		t.Errorf("replicated snapshots recorded as %q", b)
+	}
+	files, _ := ioutil.ReadDir(state)
+	for _, f := range files {
+		if f.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("symlink %s created for the replica", f.Name())
+		}
+	}
+}
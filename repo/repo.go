@@ -0,0 +1,219 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Package repo gives other programs access to snaprd repositories. It can
+// list the snapshots of a repository and ask a running snaprd to make a
+// snapshot now.
+//
+// Only reading is done directly on disk. Everything that changes the
+// repository is left to the snaprd process managing it. Snapshots can only be
+// listed for storages that keep them as directories in the data directory,
+// which are hardlink (the default) and btrfs.
+package repo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dataSubdir is where snaprd keeps the snapshot directories.
+const dataSubdir = ".data"
+
+// settingsName is the file snaprd writes the settings of the last run to.
+const settingsName = ".snaprd.settings"
+
+// dirStorages are the storages keeping snapshots as directories named like
+// the snapshots in the data directory.
+var dirStorages = map[string]bool{
+	"":         true,
+	"hardlink": true,
+	"btrfs":    true,
+}
+
+// State is the state of a snapshot.
+type State int
+
+const (
+	Incomplete State = iota
+	Complete
+	Obsolete
+	Purging
+	// Quarantined snapshots could not be purged by snaprd.
+	Quarantined
+)
+
+var stateNames = []string{"incomplete", "complete", "obsolete", "purging", "quarantined"}
+
+// String returns the state as used in snapshot directory names.
+func (st State) String() string {
+	if st < Incomplete || st > Quarantined {
+		return "unknown"
+	}
+	return stateNames[st]
+}
+
+// Snapshot describes a snapshot directory.
+type Snapshot struct {
+	Name  string
+	Path  string
+	Start time.Time
+	// End is zero for incomplete snapshots.
+	End   time.Time
+	State State
+}
+
+// ParseName parses a snapshot directory name like
+// "1400337531-1400337532-complete". Path is left empty. snaprd uses it for
+// all snapshot names as well.
+func ParseName(name string) (Snapshot, error) {
+	sa := strings.Split(name, "-")
+	if len(sa) != 3 {
+		return Snapshot{}, errors.New("malformed snapshot name: " + name)
+	}
+	stime, err := strconv.ParseInt(sa[0], 10, 64)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("malformed snapshot name: %s", name)
+	}
+	etime, err := strconv.ParseInt(sa[1], 10, 64)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("malformed snapshot name: %s", name)
+	}
+	sn := Snapshot{Name: name, Start: time.Unix(stime, 0), State: -1}
+	for i, s := range stateNames {
+		if sa[2] == s {
+			sn.State = State(i)
+		}
+	}
+	switch {
+	case sn.State == -1:
+		return Snapshot{}, errors.New("could not parse state: " + name)
+	case sn.State == Incomplete && etime != 0:
+		return Snapshot{}, errors.New("incomplete state but non-zero end time: " + name)
+	case sn.State != Incomplete:
+		sn.End = time.Unix(etime, 0)
+	}
+	return sn, nil
+}
+
+// Repository is a directory managed by snaprd.
+type Repository struct {
+	Dir string
+}
+
+// Open returns the repository in dir. It fails if dir does not look like a
+// snaprd repository.
+func Open(dir string) (*Repository, error) {
+	fi, err := os.Stat(filepath.Join(dir, dataSubdir))
+	if err != nil {
+		return nil, fmt.Errorf("not a snaprd repository: %s", dir)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("not a snaprd repository: %s", dir)
+	}
+	return &Repository{dir}, nil
+}
+
+// storage returns the storage of the repository, as found in the settings
+// of the last run. It is empty if there are no settings.
+func (r *Repository) storage() (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.Dir, settingsName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var settings struct {
+		Storage string `json:"storage"`
+	}
+	if err := json.Unmarshal(b, &settings); err != nil {
+		return "", fmt.Errorf("invalid settings in %s: %s", r.Dir, err)
+	}
+	return settings.Storage, nil
+}
+
+// Snapshots returns all snapshots of the repository, oldest first.
+// Directories that are not snapshots are skipped. It fails for storages that
+// do not keep snapshots as directories, like zfs.
+func (r *Repository) Snapshots() ([]Snapshot, error) {
+	storage, err := r.storage()
+	if err != nil {
+		return nil, err
+	}
+	if !dirStorages[storage] {
+		return nil, fmt.Errorf("listing snapshots is not supported for storage %s", storage)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(r.Dir, dataSubdir))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []Snapshot
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		sn, err := ParseName(f.Name())
+		if err != nil {
+			continue
+		}
+		sn.Path = filepath.Join(r.Dir, dataSubdir, sn.Name)
+		snapshots = append(snapshots, sn)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Start.Before(snapshots[j].Start)
+	})
+	return snapshots, nil
+}
+
+// Latest returns the youngest complete snapshot. ok is false if there is
+// none.
+func (r *Repository) Latest() (sn Snapshot, ok bool, err error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].State == Complete {
+			return snapshots[i], true, nil
+		}
+	}
+	return Snapshot{}, false, nil
+}
+
+// Pid returns the process id of the snaprd running on the repository.
+func (r *Repository) Pid() (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(r.Dir, ".pid"))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("snaprd is not running on %s", r.Dir)
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file in %s: %s", r.Dir, err)
+	}
+	if err := syscall.Kill(pid, 0); err != nil {
+		return 0, fmt.Errorf("snaprd is not running on %s: stale pid file", r.Dir)
+	}
+	return pid, nil
+}
+
+// Trigger asks the snaprd running on the repository to make a snapshot now,
+// like sending it SIGUSR2. If a snapshot is being made already, nothing
+// happens.
+func (r *Repository) Trigger() error {
+	pid, err := r.Pid()
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
@@ -0,0 +1,118 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func mockRepository(t *testing.T, names ...string) *Repository {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		os.MkdirAll(filepath.Join(dir, dataSubdir, name), 0777)
+	}
+	os.MkdirAll(filepath.Join(dir, dataSubdir), 0777)
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseName(t *testing.T) {
+	sn, err := ParseName("1400337531-1400337532-complete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sn.State != Complete || sn.Start.Unix() != 1400337531 || sn.End.Unix() != 1400337532 {
+		t.Errorf("wrong snapshot: %+v", sn)
+	}
+	sn, err = ParseName("1400337531-0-incomplete")
+	if err != nil || sn.State != Incomplete || !sn.End.IsZero() {
+		t.Errorf("wrong incomplete snapshot: %+v, %v", sn, err)
+	}
+	for _, name := range []string{
+		"1400337531-1400337532-completeXXX",
+		"-1400337652-purging",
+		"1400337721-1400337722-incomplete",
+		"1400337721.0-1400337722-incomplete",
+	} {
+		if _, err := ParseName(name); err == nil {
+			t.Errorf("ParseName(%q) did not fail, but it should", name)
+		}
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	r := mockRepository(t,
+		"1400337721-1400337722-complete",
+		"1400337531-1400337532-complete",
+		"1400337651-1400337652-obsolete",
+		"1400337727-0-incomplete",
+		"lost+found",
+	)
+	defer os.RemoveAll(r.Dir)
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 4 || snapshots[0].Name != "1400337531-1400337532-complete" {
+		t.Fatalf("wrong snapshots: %+v", snapshots)
+	}
+	if want := filepath.Join(r.Dir, dataSubdir, snapshots[0].Name); snapshots[0].Path != want {
+		t.Errorf("path is %s, wanted %s", snapshots[0].Path, want)
+	}
+	sn, ok, err := r.Latest()
+	if err != nil || !ok || sn.Name != "1400337721-1400337722-complete" {
+		t.Errorf("latest is %+v, %v, %v", sn, ok, err)
+	}
+	if _, err := Open(filepath.Join(r.Dir, dataSubdir)); err == nil {
+		t.Errorf("Open() should fail for a directory without snapshots")
+	}
+}
+
+func TestSnapshotsStorage(t *testing.T) {
+	r := mockRepository(t, "1400337531-1400337532-complete")
+	defer os.RemoveAll(r.Dir)
+	settings := filepath.Join(r.Dir, settingsName)
+	for storage, ok := range map[string]bool{"hardlink": true, "btrfs": true, "zfs": false} {
+		ioutil.WriteFile(settings, []byte(`{"Storage": "`+storage+`"}`), 0666)
+		snapshots, err := r.Snapshots()
+		if ok && (err != nil || len(snapshots) != 1) {
+			t.Errorf("Snapshots() with %s storage gave %+v, %v", storage, snapshots, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("Snapshots() with %s storage did not fail, but it should", storage)
+		}
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	r := mockRepository(t)
+	defer os.RemoveAll(r.Dir)
+	if err := r.Trigger(); err == nil {
+		t.Errorf("Trigger() should fail without a running snaprd")
+	}
+	ioutil.WriteFile(filepath.Join(r.Dir, ".pid"), []byte(strconv.Itoa(os.Getpid())), 0666)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	defer signal.Stop(c)
+	if err := r.Trigger(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Errorf("no signal received")
+	}
+}
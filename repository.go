@@ -0,0 +1,158 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// The repository and the settings it is managed with
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+)
+
+// errStopped is returned for changes to a repository whose owner has
+// stopped.
+var errStopped = errors.New("repository is shut down")
+
+// Repository is a directory holding snapshots, together with everything
+// needed to manage it: the settings, the schedules they refer to, the clock
+// and the logger. Several repositories can be managed in one process.
+type Repository struct {
+	// mu protects config, schedules and store while they are replaced by a
+	// reload. The create loop, which does the replacing, does not need it
+	// for reading. The other goroutines of subcmdRun hold it for reading
+	// only briefly. Work that takes long, like purging, is done on a view,
+	// so it does not hold up a reload.
+	mu        sync.RWMutex
+	config    *Config
+	schedules scheduleList
+	cl        clock
+	log       *structLogger
+	// state is what the create loop of subcmdRun is doing
+	state *loopState
+	// purgeQ holds the obsolete snapshots waiting to be deleted
+	purgeQ *purgeQueue
+	// store keeps the snapshots on disk. It is replaced along with config.
+	store storage
+	// push is the client pushing the snapshot with subcmdServe, nil if
+	// snapshots are pulled from the origin
+	push *pushClient
+	// ops is read by the owner goroutine, which makes all changes to the
+	// repository on disk: renaming snapshots, symlinks and metadata. It is
+	// nil if there is no owner, then changes are made directly.
+	ops     chan func()
+	stopped <-chan struct{}
+}
+
+// newRepository returns the repository given in c. scheds must contain the
+// schedule selected in c.
+func newRepository(c *Config, scheds scheduleList, cl clock, l *structLogger) *Repository {
+	q := newPurgeQueue()
+	state := newLoopState(cl)
+	state.purgeQ = q
+	return &Repository{
+		config:    c,
+		schedules: scheds,
+		cl:        cl,
+		log:       l,
+		state:     state,
+		purgeQ:    q,
+		store:     newStorage(c),
+	}
+}
+
+// view returns a copy of r with the configuration, schedules and storage of
+// the moment. It shares everything else with r, including the owner
+// goroutine, and is not changed by a reload.
+func (r *Repository) view() *Repository {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &Repository{
+		config:    r.config,
+		schedules: r.schedules,
+		cl:        r.cl,
+		log:       r.log,
+		state:     r.state,
+		purgeQ:    r.purgeQ,
+		store:     r.store,
+		push:      r.push,
+		ops:       r.ops,
+		stopped:   r.stopped,
+	}
+}
+
+// intervals returns the schedule the repository is pruned by.
+func (r *Repository) intervals() intervalList {
+	return r.schedules[r.config.Schedule]
+}
+
+// path returns the path of a file within the repository.
+func (r *Repository) path(elem ...string) string {
+	return filepath.Join(append([]string{r.config.repository}, elem...)...)
+}
+
+// snapshotPath returns the full pathname s can be read from.
+func (r *Repository) snapshotPath(s snapshot) string {
+	return r.store.path(s.Name())
+}
+
+// snapshotLink returns the target of symlinks to s, relative to the
+// repository.
+func (r *Repository) snapshotLink(s snapshot) string {
+	target, err := filepath.Rel(r.path(), r.snapshotPath(s))
+	if err != nil {
+		return filepath.Join(dataSubdir, s.Name())
+	}
+	return target
+}
+
+// baseName returns the name of base, or an empty string for the zero
+// snapshot.
+func baseName(base snapshot) string {
+	if base.isZero() {
+		return ""
+	}
+	return base.Name()
+}
+
+// snapLog returns a logEntry for messages about sn.
+func (r *Repository) snapLog(sn snapshot) logEntry {
+	return r.log.withFields(logFields{"snapshot": sn.Name()})
+}
+
+// startOwner starts the goroutine owning the repository. From now on all
+// changes are made by it, one after the other, until ctx is done. The
+// returned channel is closed when the owner has stopped.
+func (r *Repository) startOwner(ctx context.Context) <-chan struct{} {
+	ops := make(chan func())
+	stopped := make(chan struct{})
+	r.ops, r.stopped = ops, stopped
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case f := <-ops:
+				f()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// mutate lets the owner run f and returns its error. f must not call mutate
+// itself.
+func (r *Repository) mutate(f func() error) error {
+	if r.ops == nil {
+		return f()
+	}
+	done := make(chan error, 1)
+	select {
+	case r.ops <- func() { done <- f() }:
+		return <-done
+	case <-r.stopped:
+		return errStopped
+	}
+}
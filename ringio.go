@@ -6,80 +6,156 @@ import (
 	"bytes"
 	"io"
 	"sync"
+	"time"
 )
 
+// ellipsis marks the part cut out of lines that are too long.
+const ellipsis = " [...] "
+
+// RingLine is a line of output together with the time it was written.
+type RingLine struct {
+	Time time.Time
+	Text []byte // without the trailing newline
+}
+
+func (l RingLine) String() string {
+	return l.Time.Format("2006-01-02 15:04:05 ") + string(l.Text)
+}
+
 type RingIO struct {
 	out     io.Writer // the io we are proxying
-	maxLen  int       // max number of lines
-	maxElem int       // max length of a line
+	budget  int       // max number of bytes of all lines
 	mu      *sync.Mutex
-	buf     map[int][]byte // a map holding the lines
-	p       int            // points to the current item in the map
+	lines   []RingLine
+	size    int      // number of bytes in lines
+	partial RingLine // a line not terminated by a newline yet
+	cl      clock
 }
 
 // newRingIO instantiates a new RingIO list, which satisfies the io.Writer
 // out is an io.Writer that will write the output to the final destination.
-// maxLen will be the maximum number of elements kept in the ring buffer. If
-// this number is reached, for each Write() the first element will be removed
-// before the new element is added.
-// maxElem is the maximum size in bytes of an individual element of the list.
-func newRingIO(out io.Writer, maxLen int, maxElem int) *RingIO {
+// The output is split into lines, and the latest lines are kept as long as
+// their size does not exceed budget bytes. Lines longer than budget are
+// shortened in the middle, so both their beginning and their end are kept.
+func newRingIO(out io.Writer, budget int) *RingIO {
 	return &RingIO{
-		out:     out,
-		maxLen:  maxLen,
-		maxElem: maxElem,
-		mu:      new(sync.Mutex),
-		buf:     make(map[int][]byte),
-		p:       0,
+		out:    out,
+		budget: budget,
+		mu:     new(sync.Mutex),
+		cl:     new(realClock),
 	}
 }
 
+// setOutput changes the io.Writer output is passed on to.
+func (r *RingIO) setOutput(out io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.out = out
+}
+
+// setBudget changes the number of bytes kept, dropping the oldest lines if
+// needed.
+func (r *RingIO) setBudget(budget int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budget = budget
+	r.shrink()
+}
+
 func (r *RingIO) Write(s []byte) (int, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var e []byte
-	// we need to copy the slice because the caller may be reusing it
-	c := make([]byte, len(s))
-	copy(c, s)
+	n := len(s)
 	// write to the io.Writer we are proxying
-	r.out.Write(c)
-	ls := len(c)
-	// if needed, truncate the new entry to maxElem bytes and append a newline
-	if ls > r.maxElem {
-		e = append(c[0:r.maxElem], byte('\n'))
-	} else {
-		e = c
+	r.out.Write(s)
+	now := r.cl.Now()
+	for len(s) > 0 {
+		if r.partial.Text == nil {
+			r.partial.Time = now
+		}
+		i := bytes.IndexByte(s, '\n')
+		if i < 0 {
+			// we need to copy the slice because the caller may be reusing it
+			r.partial.Text = append(r.partial.Text, s...)
+			break
+		}
+		r.add(RingLine{r.partial.Time, append(r.partial.Text, s[:i]...)})
+		r.partial = RingLine{}
+		s = s[i+1:]
 	}
-	r.buf[r.p] = e
-	// reset the pointer if maxLen is reached
-	if r.p < r.maxLen-1 {
-		r.p += 1
-	} else {
-		r.p = 0
+	return n, nil
+}
+
+// add appends a complete line and drops the oldest lines if the budget is
+// exceeded.
+func (r *RingIO) add(l RingLine) {
+	if len(l.Text) > r.budget && r.budget > len(ellipsis) {
+		keep := r.budget - len(ellipsis)
+		head := keep / 3
+		text := make([]byte, 0, r.budget)
+		text = append(text, l.Text[:head]...)
+		text = append(text, ellipsis...)
+		l.Text = append(text, l.Text[len(l.Text)-(keep-head):]...)
 	}
-	return len(c), nil
+	r.lines = append(r.lines, l)
+	r.size += len(l.Text)
+	r.shrink()
 }
 
-// GetAll returns all elements of the ring buffer as a slice of byte slices
-func (r *RingIO) GetAll() [][]byte {
+func (r *RingIO) shrink() {
+	n := 0
+	for r.size > r.budget && n < len(r.lines) {
+		r.size -= len(r.lines[n].Text)
+		n++
+	}
+	if n > 0 {
+		r.lines = append([]RingLine(nil), r.lines[n:]...)
+	}
+}
+
+// Since returns all buffered lines written at or after t, oldest first. An
+// unterminated last line is included.
+func (r *RingIO) Since(t time.Time) []RingLine {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	var ret [][]byte
-	// return buf, but starting from where the pointer currently points to
-	for i := r.p; i < r.maxLen; i += 1 {
-		ret = append(ret, r.buf[i])
+	var ret []RingLine
+	for _, l := range r.lines {
+		if !l.Time.Before(t) {
+			ret = append(ret, RingLine{l.Time, append([]byte(nil), l.Text...)})
+		}
 	}
-	for i := 0; i < r.p; i += 1 {
-		ret = append(ret, r.buf[i])
+	if r.partial.Text != nil && !r.partial.Time.Before(t) {
+		ret = append(ret, RingLine{r.partial.Time, append([]byte(nil), r.partial.Text...)})
+	}
+	return ret
+}
+
+// Recent returns the lines written during the last d.
+func (r *RingIO) Recent(d time.Duration) []RingLine {
+	return r.Since(r.cl.Now().Add(-d))
+}
+
+// GetAll returns all elements of the ring buffer as a slice of byte slices,
+// each terminated by a newline.
+func (r *RingIO) GetAll() [][]byte {
+	var ret [][]byte
+	for _, l := range r.Since(time.Time{}) {
+		ret = append(ret, append(l.Text, '\n'))
 	}
 	return ret
 }
 
 // GetAsText concatenates all buffered lines into one byte slice
 func (r *RingIO) GetAsText() []byte {
+	return linesAsText(r.Since(time.Time{}))
+}
+
+// linesAsText concatenates lines into one byte slice, separated by newlines.
+func linesAsText(lines []RingLine) []byte {
 	var b bytes.Buffer
-	for _, l := range r.GetAll() {
-		b.Write(l)
+	for _, l := range lines {
+		b.Write(l.Text)
+		b.WriteByte('\n')
 	}
 	return b.Bytes()
 }
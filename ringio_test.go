@@ -6,10 +6,11 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type rioTestPair struct {
-	params [2]int
+	budget int
 	in     [][]byte
 	out    []byte
 }
@@ -17,17 +18,17 @@ type rioTestPair struct {
 func TestRingIO(t *testing.T) {
 	tests := []rioTestPair{
 		{
-			[2]int{3, 12},
+			30,
 			[][]byte{
 				[]byte("a string\n"),
 				[]byte("another string\n"),
 				[]byte("something\n"),
 				[]byte("else\n"),
 			},
-			[]byte("another stri\nsomething\nelse\n"),
+			[]byte("another string\nsomething\nelse\n"),
 		},
 		{
-			[2]int{2, 10},
+			13,
 			[][]byte{
 				[]byte("a string\n"),
 				[]byte("another string\n"),
@@ -37,27 +38,33 @@ func TestRingIO(t *testing.T) {
 			[]byte("something\nelse\n"),
 		},
 		{
-			[2]int{2, 4},
+			100,
 			[][]byte{
-				[]byte("a string"),
-				[]byte("test1"),
-				[]byte("test2"),
+				[]byte("one\ntwo\nthr"),
+				[]byte("ee\n"),
 			},
-			[]byte("test\ntest\n"),
+			[]byte("one\ntwo\nthree\n"),
 		},
 		{
-			[2]int{100, 100},
+			100,
 			[][]byte{
 				[]byte("a string"),
 				[]byte("test1"),
 				[]byte("test2"),
 			},
-			[]byte("a stringtest1test2"),
+			[]byte("a stringtest1test2\n"),
+		},
+		{
+			22,
+			[][]byte{
+				[]byte("rsync: some very long message: Permission denied (13)\n"),
+			},
+			[]byte("rsync [...] enied (13)\n"),
 		},
 	}
-	var buf bytes.Buffer
 	for _, tp := range tests {
-		rio := newRingIO(&buf, tp.params[0], tp.params[1])
+		var buf bytes.Buffer
+		rio := newRingIO(&buf, tp.budget)
 		for _, l := range tp.in {
 			rio.Write(l)
 		}
@@ -66,5 +73,34 @@ func TestRingIO(t *testing.T) {
 		if !reflect.DeepEqual(got, wanted) {
 			t.Errorf("wanted:\n>>>\n%s\n<<<\ngot:\n>>>\n%s\n<<<", wanted, got)
 		}
+		if want := bytes.Join(tp.in, nil); !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("output was not passed on unchanged: %q", buf.Bytes())
+		}
+		for _, l := range rio.GetAll() {
+			if len(l) == 0 || l[len(l)-1] != '\n' {
+				t.Errorf("GetAll returned an unterminated line: %q", l)
+			}
+		}
+	}
+}
+
+func TestRingIORecent(t *testing.T) {
+	var buf bytes.Buffer
+	rio := newRingIO(&buf, 1000)
+	cl := newSkewClock(startAt)
+	rio.cl = cl
+	rio.Write([]byte("old\n"))
+	cl.forward(10 * time.Minute)
+	rio.Write([]byte("new\nnewer\n"))
+	lines := rio.Recent(5 * time.Minute)
+	if len(lines) != 2 || string(lines[0].Text) != "new" || string(lines[1].Text) != "newer" {
+		t.Errorf("unexpected recent lines %q", lines)
+	}
+	if d := cl.Now().Sub(lines[0].Time); d < 0 || d > time.Second {
+		t.Errorf("line has time %s, wanted %s", lines[0].Time, cl.Now())
+	}
+	rio.setBudget(5)
+	if got := rio.GetAsText(); string(got) != "newer\n" {
+		t.Errorf("after shrinking the budget got %q", got)
 	}
 }
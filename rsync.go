@@ -6,15 +6,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
-	"os/signal"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
-	"time"
 )
 
 // rsyncIgnoredErrors are rsync return values that are considered temporary
@@ -37,119 +36,264 @@ var rsyncIgnoredErrors = map[int]string{
 	35: "Timeout waiting for daemon connection",
 }
 
+// rsyncStats holds the numbers parsed from the output of rsync --stats. Values
+// rsync did not report are -1.
+type rsyncStats struct {
+	files       int64
+	transferred int64
+	deleted     int64
+}
+
+func newRsyncStats() *rsyncStats {
+	return &rsyncStats{-1, -1, -1}
+}
+
+// parseLine picks up the interesting numbers from a single line of rsync
+// output, e. g. "Number of files: 1,234 (reg: 1,000, dir: 234)".
+func (st *rsyncStats) parseLine(line string) {
+	kv := strings.SplitN(line, ":", 2)
+	if len(kv) != 2 {
+		return
+	}
+	var p *int64
+	switch kv[0] {
+	case "Number of files":
+		p = &st.files
+	case "Number of regular files transferred", "Number of files transferred":
+		p = &st.transferred
+	case "Number of deleted files":
+		p = &st.deleted
+	default:
+		return
+	}
+	fields := strings.Fields(kv[1])
+	if len(fields) == 0 {
+		return
+	}
+	n, err := strconv.ParseInt(strings.Replace(fields[0], ",", "", -1), 10, 64)
+	if err != nil {
+		debugf("could not parse rsync stats line \"%s\": %s", line, err)
+		return
+	}
+	*p = n
+}
+
+// unchanged returns true if the statistics show that nothing was transferred
+// or deleted, and the number of files is the same as in the base snapshot.
+// rsync does not count symlinks or files of which only the metadata changed
+// as transferred, so this is not enough to tell that nothing changed.
+func (st *rsyncStats) unchanged(baseFiles int64) bool {
+	return st.transferred == 0 && st.deleted <= 0 && st.files >= 0 && st.files == baseFiles
+}
+
 // createRsyncCommand returns an exec.Command structure that, when executed,
-// creates a snapshot using rsync. Takes an optional (non-nil) base to be used
-// with rsyncs --link-dest feature.
-func createRsyncCommand(sn *snapshot, base *snapshot) *exec.Cmd {
-	cmd := exec.Command(config.RsyncPath)
+// creates a snapshot using rsync. Takes an optional (non-zero) base, which
+// the storage tells rsync how to use, e. g. with rsyncs --link-dest feature.
+func (r *Repository) createRsyncCommand(sn snapshot, base snapshot) *exec.Cmd {
+	cmd := exec.Command(r.config.RsyncPath)
 	args := make([]string, 0, 256)
-	args = append(args, config.RsyncPath)
+	args = append(args, r.config.RsyncPath)
 	args = append(args, "--delete")
 	args = append(args, "-a")
 	args = append(args, "--stats")
-	args = append(args, config.RsyncOpts...)
-	if base != nil {
-		args = append(args, "--link-dest="+base.FullName())
-	}
-	args = append(args, config.Origin, sn.FullName())
+	args = append(args, r.config.RsyncOpts...)
+	args = append(args, r.store.rsyncArgs(baseName(base))...)
+	args = append(args, r.config.Origin, r.store.target(sn.Name()))
 	cmd.Args = args
-	cmd.Dir = filepath.Join(config.repository, dataSubdir)
-	log.Println("run:", args)
+	cmd.Dir = r.path(dataSubdir)
+	r.snapLog(sn).infof("run: %s", args)
 	return cmd
 }
 
 // runRsyncCommand executes the given command. On sucessful startup return an
-// error channel the caller can receive a return status from.
-func runRsyncCommand(cmd *exec.Cmd) (chan error, error) {
+// error channel the caller can receive a return status from. The statistics
+// printed by rsync are parsed into stats, which must not be used before the
+// return status was received.
+func (r *Repository) runRsyncCommand(cmd *exec.Cmd, stats *rsyncStats) (chan error, error) {
 	var err error
 	cmdOutput, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, err
 	}
 	cmd.Stderr = cmd.Stdout
-	debugf("starting rsync command")
+	r.log.debugf("starting rsync command")
 	err = cmd.Start()
 	if err != nil {
 		return nil, err
 	}
-	in := bufio.NewScanner(cmdOutput)
-	for in.Scan() {
-		log.Printf("(rsync) %s", in.Text())
-	}
-	if err := in.Err(); err != nil {
-		log.Printf("error scanning rsync output: %s", err)
-	}
-	done := make(chan error)
+	r.log.setRsyncPid(cmd.Process.Pid)
+	done := make(chan error, 1)
 	go func() {
-		time.Sleep(time.Second)
+		in := bufio.NewScanner(cmdOutput)
+		for in.Scan() {
+			r.log.infof("(rsync) %s", in.Text())
+			stats.parseLine(in.Text())
+		}
+		if err := in.Err(); err != nil {
+			r.log.warnf("error scanning rsync output: %s", err)
+		}
 		done <- cmd.Wait()
-		return
 	}()
 	return done, nil
 }
 
-// createSnapshot starts a potentially long running rsync command and returns a
-// Snapshot pointer on success.
+// startTransfer starts filling sn from the origin, with rsync or the native
+// copier, or from the client pushing it. It returns a channel the result is sent to and a function to kill
+// the transfer. The statistics are parsed into stats, which must not be used
+// before the result was received.
+func (r *Repository) startTransfer(sn, base snapshot, stats *rsyncStats) (chan error, func() error, error) {
+	if r.push != nil {
+		cmd := r.createPushCommand(sn, base)
+		done, err := r.runPushCommand(cmd)
+		if err != nil {
+			return nil, nil, err
+		}
+		return done, func() error { return cmd.Process.Signal(syscall.SIGTERM) }, nil
+	}
+	if r.config.Copier == "native" {
+		done, kill := r.runNativeCopier(sn, base, stats)
+		return done, kill, nil
+	}
+	cmd := r.createRsyncCommand(sn, base)
+	done, err := r.runRsyncCommand(cmd, stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	return done, func() error { return cmd.Process.Signal(syscall.SIGTERM) }, nil
+}
+
+// createSnapshot starts a potentially long running rsync command and returns
+// the new snapshot on success. If ctx is done before rsync has finished,
+// rsync is terminated.
 // For non-zero return values of rsync potentially restart the process if the
 // error was presumably volatile.
-func createSnapshot(base *snapshot) (*snapshot, error) {
-	cl := new(realClock)
-
-	newSn := lastReusableFromDisk(cl)
+func (r *Repository) createSnapshot(ctx context.Context, base snapshot) (snapshot, error) {
+	newSn := r.lastReusableFromDisk()
 
-	if newSn == nil {
-		newSn = newIncompleteSnapshot(cl)
+	var err error
+	if newSn.isZero() {
+		newSn = newIncompleteSnapshot(r.cl)
+		err = r.mutate(func() error {
+			return r.store.prepare(newSn.Name(), baseName(base))
+		})
+		if err != nil {
+			return snapshot{}, err
+		}
 	} else {
-		newSn.transIncomplete(cl)
+		newSn, err = r.transIncomplete(newSn)
+		if err != nil {
+			return snapshot{}, err
+		}
+		if r.push != nil {
+			if err := removeSymlinks(r.store.target(newSn.Name())); err != nil {
+				return snapshot{}, fmt.Errorf("could not prepare %s for reuse: %s", newSn.Name(), err)
+			}
+		}
 	}
-	cmd := createRsyncCommand(newSn, base)
-	done, err := runRsyncCommand(cmd)
+	r.log.startRun(newSn.Name())
+	r.state.startRsync(newSn.Name(), r.config.MaxRsyncTime)
+	defer r.log.endRun()
+	stats := newRsyncStats()
+	done, kill, err := r.startTransfer(newSn, base, stats)
 	if err != nil {
-		log.Println("could not start rsync command:", err)
-		return nil, err
+		r.log.errorf("could not start rsync command: %s", err)
+		return snapshot{}, err
 	}
-	debugf("rsync started")
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
-	for {
-		select {
-		case sig := <-sigc:
-			debugf("trying to kill rsync with signal %v", sig)
-			err := cmd.Process.Signal(sig)
-			if err != nil {
-				log.Fatal("failed to kill: ", err)
-			}
-			return nil, errors.New("rsync killed by request")
-		case err := <-done:
-			debugf("received something on done channel: %v", err)
-			if err != nil {
-				// At this stage rsync ran, but with errors.
-				failed := true
-				// First, get the error code
-				if exiterr, ok := err.(*exec.ExitError); ok { // The return code != 0)
-					if status, ok := exiterr.Sys().(syscall.WaitStatus); ok { // Finally get the actual status code
-						rsyncRet := status.ExitStatus()
-						debugf("The error code we got is: %v", rsyncRet)
-						if errmsg, ok := rsyncIgnoredErrors[rsyncRet]; ok == true {
-							log.Printf("ignoring rsync error %d: %s", rsyncRet, errmsg)
-							// 24 ("files vanished") happens too often and is usually harmless
-							if rsyncRet != 24 && config.Notify != "" {
-								RsyncIssueMail(err, rsyncRet)
-							}
-							failed = false
+	r.log.debugf("rsync started")
+	select {
+	case <-ctx.Done():
+		r.log.debugf("trying to kill rsync")
+		if err := kill(); err != nil {
+			r.log.errorf("failed to kill: %s", err)
+			os.Exit(1)
+		}
+		<-done
+		return snapshot{}, errors.New("rsync killed by request")
+	case err := <-done:
+		r.log.debugf("received something on done channel: %v", err)
+		if err != nil {
+			// At this stage rsync ran, but with errors.
+			failed := true
+			// First, get the error code
+			if exiterr, ok := err.(*exec.ExitError); ok { // The return code != 0)
+				if status, ok := exiterr.Sys().(syscall.WaitStatus); ok { // Finally get the actual status code
+					rsyncRet := status.ExitStatus()
+					r.log.debugf("The error code we got is: %v", rsyncRet)
+					if errmsg, ok := rsyncIgnoredErrors[rsyncRet]; ok == true && (r.push == nil || pushErrors[rsyncRet]) {
+						r.log.warnf("ignoring rsync error %d: %s", rsyncRet, errmsg)
+						// 24 ("files vanished") happens too often and is usually harmless
+						if rsyncRet != 24 && r.config.Notify != "" {
+							RsyncIssueMail(r.config, err, rsyncRet)
 						}
+						failed = false
 					}
 				}
-				if failed {
-					return nil, fmt.Errorf("rsync failed: %s", err)
+			}
+			if perr, ok := err.(*partialTransferError); ok {
+				r.log.warnf("ignoring copy errors: %s", perr)
+				if r.config.Notify != "" {
+					RsyncIssueMail(r.config, err, 23)
 				}
+				failed = false
+			}
+			if failed {
+				return snapshot{}, fmt.Errorf("rsync failed: %s", err)
 			}
-			err = newSn.transComplete(cl)
+		}
+		if r.config.SkipUnchanged && !base.isZero() && err == nil {
+			if sn, ok := r.discardUnchanged(ctx, newSn, base, stats); ok {
+				return sn, nil
+			}
+		}
+		newSn, err = r.transComplete(newSn)
+		if err != nil {
+			return snapshot{}, err
+		}
+		if stats.files >= 0 {
+			err = r.updateMeta(func(meta map[string]snapshotMeta) {
+				meta[metaKey(newSn)] = snapshotMeta{Files: stats.files}
+			})
 			if err != nil {
-				return nil, err
+				r.log.warnf("could not write snapshot metadata: %s", err)
 			}
-			log.Println("finished:", newSn.Name())
-			return newSn, nil
 		}
+		r.snapLog(newSn).infof("finished: %s", newSn.Name())
+		return newSn, nil
+	}
+}
+
+// discardUnchanged removes newSn if rsync found no changes compared to base,
+// and the trees of both look the same. Instead, base is recorded as verified
+// at the start time of newSn and returned as the new lastGood snapshot.
+func (r *Repository) discardUnchanged(ctx context.Context, newSn, base snapshot, stats *rsyncStats) (snapshot, bool) {
+	meta, err := r.readMeta()
+	if err != nil {
+		r.log.warnf("could not read snapshot metadata: %s", err)
+		return snapshot{}, false
+	}
+	if m, ok := meta[metaKey(base)]; !ok || !stats.unchanged(m.Files) {
+		return snapshot{}, false
+	}
+	same, err := sameTree(r.snapshotPath(base), r.store.target(newSn.Name()))
+	if err != nil {
+		r.snapLog(newSn).warnf("could not compare %s to %s: %s", newSn.Name(), base.Name(), err)
+	}
+	if !same {
+		return snapshot{}, false
+	}
+	err = r.updateMeta(func(meta map[string]snapshotMeta) {
+		m := meta[metaKey(base)]
+		m.Verified = newSn.startTime.Unix()
+		meta[metaKey(base)] = m
+	})
+	if err != nil {
+		r.log.warnf("could not write snapshot metadata: %s", err)
+		return snapshot{}, false
+	}
+	r.snapLog(newSn).infof("no changes since %s, discarding %s", base.Name(), newSn.Name())
+	if _, err := r.store.remove(ctx, newSn.Name(), nil); err != nil {
+		r.snapLog(newSn).warnf("could not remove %s: %s", newSn.Name(), err)
 	}
+	base.verified = newSn.startTime
+	return base, true
 }
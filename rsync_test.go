@@ -3,6 +3,8 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -12,14 +14,13 @@ import (
 
 func TestCreateRsyncCommand(t *testing.T) {
 	var testSnapshots = snapshotList{
-		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete},
-		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete},
-	}
-	// shadow global config
-	var config = config
-	config.repository = "testdata"
-	config.ReadCache()
-	cmd := createRsyncCommand(testSnapshots[1], testSnapshots[0])
+		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete, time.Time{}},
+		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete, time.Time{}},
+	}
+	c := &Config{repository: "testdata"}
+	c.ReadCache()
+	r := newRepository(c, schedules, new(realClock), rootLog.sub())
+	cmd := r.createRsyncCommand(testSnapshots[1], testSnapshots[0])
 	got := cmd.Args
 	wanted := []string{"/usr/bin/rsync", "--delete", "-a", "--stats",
 		"--link-dest=testdata/.data/1400337531-1400338693-complete",
@@ -32,17 +33,17 @@ func TestCreateRsyncCommand(t *testing.T) {
 
 func TestFakeRsyncOk(t *testing.T) {
 	var testSnapshots = snapshotList{
-		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete},
-		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete},
+		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete, time.Time{}},
+		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete, time.Time{}},
 	}
-	var config = config
-	config.repository = "/tmp/snaprd_dest"
-	mockRepository()
-	config.ReadCache()
+	c := &Config{repository: "/tmp/snaprd_dest"}
+	r := newRepository(c, schedules, new(realClock), rootLog.sub())
+	mockRepository(r)
+	c.ReadCache()
 	dir, _ := os.Getwd()
-	config.RsyncPath = filepath.Join(dir, "fake_rsync")
-	config.RsyncOpts.Set("--fake_exit=24")
-	_, err := createSnapshot(testSnapshots[0])
+	c.RsyncPath = filepath.Join(dir, "fake_rsync")
+	c.RsyncOpts.Set("--fake_exit=24")
+	_, err := r.createSnapshot(context.Background(), testSnapshots[0])
 	got := err
 	if got != nil {
 		t.Errorf("createSnapshot() returned an error, but it shouldn't: %v", got)
@@ -51,18 +52,137 @@ func TestFakeRsyncOk(t *testing.T) {
 
 func TestFakeRsyncFail(t *testing.T) {
 	var testSnapshots = snapshotList{
-		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete},
-		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete},
+		{time.Unix(1400337531, 0), time.Unix(1400338693, 0), stateComplete, time.Time{}},
+		{time.Unix(1400534523, 0), time.Unix(0, 0), stateIncomplete, time.Time{}},
 	}
-	var config = config
-	config.repository = "/tmp/snaprd_dest"
-	config.ReadCache()
+	c := &Config{repository: "/tmp/snaprd_dest"}
+	c.ReadCache()
+	r := newRepository(c, schedules, new(realClock), rootLog.sub())
 	dir, _ := os.Getwd()
-	config.RsyncPath = filepath.Join(dir, "fake_rsync")
-	config.RsyncOpts.Set("--fake_exit=3")
-	_, err := createSnapshot(testSnapshots[0])
+	c.RsyncPath = filepath.Join(dir, "fake_rsync")
+	c.RsyncOpts.Set("--fake_exit=3")
+	_, err := r.createSnapshot(context.Background(), testSnapshots[0])
 	got := err
 	if got == nil {
 		t.Errorf("createSnapshot() succeeded, but it should have failed: %v", got)
 	}
 }
+
+func TestParseRsyncStats(t *testing.T) {
+	output := []string{
+		"sending incremental file list",
+		"Number of files: 1,234 (reg: 1,000, dir: 234)",
+		"Number of created files: 0",
+		"Number of deleted files: 0",
+		"Number of regular files transferred: 0",
+		"Total file size: 12,345,678 bytes",
+	}
+	stats := newRsyncStats()
+	for _, l := range output {
+		stats.parseLine(l)
+	}
+	wanted := rsyncStats{1234, 0, 0}
+	if *stats != wanted {
+		t.Errorf("wanted %v, got %v", wanted, *stats)
+	}
+	if !stats.unchanged(1234) {
+		t.Errorf("stats %v should count as unchanged", *stats)
+	}
+	if stats.unchanged(1233) {
+		t.Errorf("stats %v should not count as unchanged for a different number of files", *stats)
+	}
+	if newRsyncStats().unchanged(-1) {
+		t.Errorf("empty stats should not count as unchanged")
+	}
+}
+
+func TestDiscardUnchanged(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	base := newSnapshot(time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateComplete)
+	newSn := newSnapshot(time.Unix(1400337781, 0), time.Time{}, stateIncomplete)
+	os.MkdirAll(r.snapshotPath(newSn), 0777)
+	r.updateMeta(func(meta map[string]snapshotMeta) {
+		meta[metaKey(base)] = snapshotMeta{Files: 10}
+	})
+	if _, ok := r.discardUnchanged(context.Background(), newSn, base, &rsyncStats{11, 1, 0}); ok {
+		t.Errorf("snapshot with changes was discarded")
+	}
+	sn, ok := r.discardUnchanged(context.Background(), newSn, base, &rsyncStats{10, 0, 0})
+	if !ok {
+		t.Fatalf("unchanged snapshot was not discarded")
+	}
+	if _, err := os.Stat(r.snapshotPath(newSn)); !os.IsNotExist(err) {
+		t.Errorf("%s still exists", r.snapshotPath(newSn))
+	}
+	if !sn.verified.Equal(newSn.startTime) {
+		t.Errorf("verified time is %v, wanted %v", sn.verified, newSn.startTime)
+	}
+	r.cl = newSkewClock(1400337790)
+	sl, _ := r.findSnapshots()
+	if got := sl.lastGood().effectiveTime(); !got.Equal(newSn.startTime) {
+		t.Errorf("lastGood from disk is effective at %v, wanted %v", got, newSn.startTime)
+	}
+}
+
+// mockSnapshotTree creates a file and a symlink to it in dir.
+func mockSnapshotTree(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1400337000, 0)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDiscardUnchangedMetadata checks that changes rsync does not count as
+// transferred files keep the new snapshot.
+func TestDiscardUnchangedMetadata(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name    string
+		change  func(dir string) error
+		discard bool
+	}{
+		{"nothing", func(dir string) error { return nil }, true},
+		{"symlink retargeted", func(dir string) error {
+			link := filepath.Join(dir, "link")
+			if err := os.Remove(link); err != nil {
+				return err
+			}
+			return os.Symlink("other", link)
+		}, false},
+		{"chmod", func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "file"), 0600)
+		}, false},
+		{"mtime", func(dir string) error {
+			return os.Chtimes(filepath.Join(dir, "file"), time.Now(), time.Now())
+		}, false},
+	} {
+		r := mockConfig()
+		base := newSnapshot(time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateComplete)
+		newSn := newSnapshot(time.Unix(1400337781, 0), time.Time{}, stateIncomplete)
+		mockSnapshotTree(t, r.snapshotPath(base))
+		mockSnapshotTree(t, r.snapshotPath(newSn))
+		if err := tc.change(r.snapshotPath(newSn)); err != nil {
+			t.Fatal(err)
+		}
+		r.updateMeta(func(meta map[string]snapshotMeta) {
+			meta[metaKey(base)] = snapshotMeta{Files: 3}
+		})
+		if _, ok := r.discardUnchanged(context.Background(), newSn, base, &rsyncStats{3, 0, 0}); ok != tc.discard {
+			t.Errorf("%s: discardUnchanged() gave %v, wanted %v", tc.name, ok, tc.discard)
+		}
+		os.RemoveAll(r.path())
+	}
+}
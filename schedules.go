@@ -8,8 +8,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -25,6 +27,9 @@ const (
 	long   = year * 100
 )
 
+// maxDuration is the longest duration that can be represented.
+const maxDuration = time.Duration(math.MaxInt64)
+
 type intervalList []time.Duration
 
 // offset returns how long ago the given interval started
@@ -43,9 +48,141 @@ func (il intervalList) goal(i int) int {
 	return int(il[i+1] / il[i])
 }
 
+// check returns an error if the intervals can not be used for pruning. There
+// must be at least one, and each one must be positive and longer than the one
+// before.
+func (il intervalList) check() error {
+	if len(il) == 0 {
+		return fmt.Errorf("no intervals")
+	}
+	for i, d := range il {
+		if d <= 0 {
+			return fmt.Errorf("interval %d is not positive", i+1)
+		}
+		if i > 0 && d <= il[i-1] {
+			return fmt.Errorf("interval %d (%s) is not longer than the one before (%s)", i+1, formatDuration(d), formatDuration(il[i-1]))
+		}
+	}
+	return nil
+}
+
+// String formats the interval list using the same compact units that are
+// accepted in schedule files, e.g. "[6h 1d 1w 1M long]".
+func (il intervalList) String() string {
+	a := make([]string, len(il))
+	for i, d := range il {
+		a[i] = formatDuration(d)
+	}
+	return "[" + strings.Join(a, " ") + "]"
+}
+
 type scheduleList map[string]intervalList
 
-type jsonInterval []map[string]time.Duration
+// durationUnits lists the units known in schedule files, largest first.
+var durationUnits = []struct {
+	short string
+	d     time.Duration
+}{
+	{"y", year},
+	{"M", month},
+	{"w", week},
+	{"d", day},
+	{"h", hour},
+	{"m", minute},
+	{"s", second},
+}
+
+// parseDuration parses a compact duration string like "1d12h", "2w" or
+// "long". Units are the short names from durationUnits, "l" or "long" stand
+// for eternity.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "l" || s == "long" {
+		return long, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var duration time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("malformed duration: %s", s)
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil {
+			return 0, fmt.Errorf("malformed duration: %s", s)
+		}
+		found := false
+		for _, u := range durationUnits {
+			if u.short == rest[i:i+1] {
+				if time.Duration(n) > (maxDuration-duration)/u.d {
+					return 0, fmt.Errorf("duration too long: %s", s)
+				}
+				duration += time.Duration(n) * u.d
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown unit %q in duration: %s", rest[i:i+1], s)
+		}
+		rest = rest[i+1:]
+	}
+	return duration, nil
+}
+
+// formatDuration is the inverse of parseDuration. It returns the shortest
+// compact representation of d, e.g. "1w" instead of "168h0m0s".
+func formatDuration(d time.Duration) string {
+	if d >= long {
+		return "long"
+	}
+	if d < second {
+		return "0s"
+	}
+	var s string
+	for _, u := range durationUnits {
+		if n := d / u.d; n > 0 {
+			s += strconv.FormatInt(int64(n), 10) + u.short
+			d -= n * u.d
+		}
+	}
+	return s
+}
+
+// jsonDuration is a single interval as found in a schedule file. It is either
+// a compact string (see parseDuration) or an object with unit/count pairs.
+type jsonDuration time.Duration
+
+type jsonInterval []jsonDuration
+
+// UnmarshalJSON implements json.Unmarshaler for both notations of an
+// interval.
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		v, err := parseDuration(s)
+		if err != nil {
+			return err
+		}
+		*d = jsonDuration(v)
+		return nil
+	}
+	var units map[string]time.Duration
+	if err := json.Unmarshal(b, &units); err != nil {
+		return err
+	}
+	v, err := unitsDuration(units)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
 
 func (schl *scheduleList) String() string {
 	a := []string{}
@@ -58,12 +195,19 @@ func (schl *scheduleList) String() string {
 // schedules is a list of available snapshot schedules. Defines how often
 // snapshots are made or purged. The span of an interval is always the snapshot
 // distance of the next interval.
-var schedules = scheduleList{
-	"longterm":  {hour * 6, day, week, month, long},
-	"shortterm": {minute * 10, hour * 2, day, week, month, long},
+var schedules = builtinSchedules()
+
+// builtinSchedules returns the schedules that are always available.
+func builtinSchedules() scheduleList {
+	return scheduleList{
+		"longterm":  {hour * 6, day, week, month, long},
+		"shortterm": {minute * 10, hour * 2, day, week, month, long},
+	}
 }
 
-// addFromFile adds an external JSON file to the list of available scheds
+// addFromFile adds an external JSON file to the list of available scheds.
+// Intervals can be given as objects or as compact strings. If any schedule in
+// the file is invalid, none of them is added.
 func (schl scheduleList) addFromFile(file string) error {
 	// If we are using the default file name, and it doesn't exist, no problem, just return
 	if _, err := os.Stat(file); os.IsNotExist(err) && file == defaultSchedFileName {
@@ -78,6 +222,11 @@ func (schl scheduleList) addFromFile(file string) error {
 	if err != nil {
 		return fmt.Errorf("Error parsing schedule file: %v", err)
 	}
+	for k, v := range readData {
+		if err := v.intervalList().check(); err != nil {
+			return fmt.Errorf("Error in schedule %s: %v", k, err)
+		}
+	}
 	for k, v := range readData {
 		schl[k] = v.intervalList()
 	}
@@ -99,40 +248,54 @@ func (schl scheduleList) list() {
 // Transform a JSON formatted intervalList like this:
 // [
 //   { "day" : 1, "hour" : 12 },
-//   { "week" : 2 },
+//   "2w",
 //   { "month" : 1, "week" : 2}
-//   { "long" : 1}
+//   "long"
 // ]
 // and it makes it equivalent to
 // { 1*day + 12*hour, 2*week, 1*month + 2*week, long }
 
 func (json jsonInterval) intervalList() intervalList {
 	il := make(intervalList, len(json))
-	for i, interval := range json {
-		var duration time.Duration
-	Loop:
-		for k, v := range interval {
-			switch k {
-			case "s", "second":
-				duration += v * second
-			case "m", "minute":
-				duration += v * minute
-			case "h", "hour":
-				duration += v * hour
-			case "d", "day":
-				duration += v * day
-			case "w", "week":
-				duration += v * week
-			case "M", "month":
-				duration += v * month
-			case "y", "year":
-				duration += v * year
-			case "l", "long":
-				duration = long
-				break Loop
-			}
-		}
-		il[i] = duration
+	for i, d := range json {
+		il[i] = time.Duration(d)
 	}
 	return il
 }
+
+// unitsDuration sums up an interval given as unit/count pairs, like
+// { "day" : 1, "hour" : 12 }.
+func unitsDuration(interval map[string]time.Duration) (time.Duration, error) {
+	var duration time.Duration
+	for k, v := range interval {
+		var unit time.Duration
+		switch k {
+		case "s", "second":
+			unit = second
+		case "m", "minute":
+			unit = minute
+		case "h", "hour":
+			unit = hour
+		case "d", "day":
+			unit = day
+		case "w", "week":
+			unit = week
+		case "M", "month":
+			unit = month
+		case "y", "year":
+			unit = year
+		case "l", "long":
+			return long, nil
+		default:
+			continue
+		}
+		if v < 0 {
+			return 0, fmt.Errorf("negative count in duration: %d %s", int64(v), k)
+		}
+		if v > (maxDuration-duration)/unit {
+			return 0, fmt.Errorf("duration too long: %d %s", int64(v), k)
+		}
+		duration += v * unit
+	}
+	return duration, nil
+}
@@ -3,6 +3,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -68,3 +71,84 @@ func TestSchedulesAddFromFile(t *testing.T) {
 		t.Errorf("wanted %v, got %v", wanted, got)
 	}
 }
+
+func TestSchedulesAddFromFileBad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "schedules")
+	for _, tc := range []string{
+		`{"bad": []}`,
+		`{"bad": ["0s", "1d", "long"]}`,
+		`{"bad": ["1d", "0d", "long"]}`,
+		`{"bad": [{"d": 0}, "long"]}`,
+		`{"bad": [{"d": -1}, "long"]}`,
+		`{"bad": ["1d", "1d", "long"]}`,
+		`{"bad": ["1w", "1d", "long"]}`,
+		`{"bad": ["1d", "long", "1w"]}`,
+		`{"bad": ["99999999999y", "long"]}`,
+		`{"bad": [{"y": 99999999999}, "long"]}`,
+		`{"bad": [{"y": 200, "d": 200000}, "long"]}`,
+		`{"good": ["1d", "long"], "bad": ["1d", "0s"]}`,
+	} {
+		if err := ioutil.WriteFile(file, []byte(tc), 0644); err != nil {
+			t.Fatal(err)
+		}
+		scheds := builtinSchedules()
+		if err := scheds.addFromFile(file); err == nil {
+			t.Errorf("addFromFile() accepted %s", tc)
+		}
+		if len(scheds) != len(builtinSchedules()) {
+			t.Errorf("addFromFile() added schedules from %s: %v", tc, scheds)
+		}
+	}
+}
+
+type durationTestPair struct {
+	s string
+	d time.Duration
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []durationTestPair{
+		{"5s", second * 5},
+		{"1d12h", day + hour*12},
+		{"2w", week * 2},
+		{"1M2w", month + week*2},
+		{"long", long},
+		{"l", long},
+	}
+	for _, pair := range tests {
+		d, err := parseDuration(pair.s)
+		if err != nil {
+			t.Errorf("parseDuration(%v) gave error %v", pair.s, err)
+		}
+		if d != pair.d {
+			t.Errorf("parseDuration(%v) got %v, expected %v", pair.s, d, pair.d)
+		}
+	}
+	testsBad := []string{"", "d", "12", "1x", "1d12", "99999999999y", "292y1000000d"}
+	for _, s := range testsBad {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%v) did not fail, but it should", s)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []durationTestPair{
+		{"0s", 0},
+		{"2m20s", second * 140},
+		{"1d12h", day + hour*12},
+		{"1w", hour * 168},
+		{"1M2w", month + week*2},
+		{"long", long},
+	}
+	for _, pair := range tests {
+		if s := formatDuration(pair.d); s != pair.s {
+			t.Errorf("formatDuration(%v) got %v, expected %v", pair.d, s, pair.s)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Readiness, status and watchdog notifications for systemd (sd_notify)
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier sends messages to the service manager over $NOTIFY_SOCKET. A nil
+// notifier silently drops all messages, so it can be used unconditionally.
+type notifier struct {
+	conn *net.UnixConn
+}
+
+// newNotifier connects to the socket given in $NOTIFY_SOCKET. If the variable
+// is not set, snaprd does not run under systemd and nil is returned.
+func newNotifier() (*notifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, nil
+	}
+	// a leading @ means a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to notify socket: %s", err)
+	}
+	return &notifier{conn}, nil
+}
+
+// notify sends the given assignments, like "READY=1", in one message.
+func (n *notifier) notify(state ...string) {
+	if n == nil {
+		return
+	}
+	if _, err := n.conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		debugf("could not notify service manager: %s", err)
+	}
+}
+
+func (n *notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+
+// watchdogInterval returns the watchdog timeout requested by the service
+// manager, or zero if there is none.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Stages of the create loop
+const (
+	stageWaiting = "waiting"
+	stageRsync   = "rsync"
+	stagePruning = "pruning"
+)
+
+// loopState records what the create loop is doing, to report it to the
+// service manager and to detect when it hangs.
+type loopState struct {
+	mu       sync.Mutex
+	stage    string
+	since    time.Time
+	until    time.Time // when the next snapshot is due, if known
+	snapshot string
+	// maxRsync is how long rsync may run before the loop counts as hanging,
+	// zero for no limit
+	maxRsync time.Duration
+	cl       clock
+	// purgeQ is reported in the status, if set
+	purgeQ *purgeQueue
+}
+
+func newLoopState(cl clock) *loopState {
+	return &loopState{stage: stageWaiting, since: cl.Now(), cl: cl}
+}
+
+func (ls *loopState) set(stage, snapshot string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.stage = stage
+	ls.since = ls.cl.Now()
+	ls.snapshot = snapshot
+	ls.maxRsync = 0
+}
+
+// startRsync records that rsync started making snapshot, and may run for max
+// or without limit if max is zero.
+func (ls *loopState) startRsync(snapshot string, max time.Duration) {
+	ls.set(stageRsync, snapshot)
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.maxRsync = max
+}
+
+// waitUntil records when the next snapshot is due.
+func (ls *loopState) waitUntil(t time.Time) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.until = t
+}
+
+// status describes the current state for humans.
+func (ls *loopState) status() string {
+	st := ls.stageStatus()
+	if ls.purgeQ != nil {
+		if n := ls.purgeQ.len(); n > 0 {
+			st += fmt.Sprintf(", %d snapshots to purge", n)
+		}
+	}
+	return st
+}
+
+// stageStatus describes the stage of the create loop.
+func (ls *loopState) stageStatus() string {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.cl.Now()
+	switch ls.stage {
+	case stageWaiting:
+		if ls.until.After(now) {
+			return fmt.Sprintf("waiting %s until next snapshot", formatDuration(ls.until.Sub(now).Round(time.Second)))
+		}
+		return "waiting for next snapshot"
+	case stageRsync:
+		return fmt.Sprintf("rsync running for %s (%s)", formatDuration(now.Sub(ls.since)), ls.snapshot)
+	}
+	return fmt.Sprintf("%s for %s", ls.stage, formatDuration(now.Sub(ls.since)))
+}
+
+// healthy returns false if the create loop seems to hang, i. e. it is still
+// waiting more than limit after the next snapshot was due, rsync runs for
+// longer than allowed, or it spent more than limit in any other stage.
+func (ls *loopState) healthy(limit time.Duration) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	now := ls.cl.Now()
+	switch ls.stage {
+	case stageWaiting:
+		// nothing is known before the first wait
+		return ls.until.IsZero() || now.Sub(ls.until) < limit
+	case stageRsync:
+		return ls.maxRsync <= 0 || now.Sub(ls.since) < ls.maxRsync
+	}
+	return now.Sub(ls.since) < limit
+}
+
+// superviseLoop periodically sends the status of the create loop and, if the
+// service manager asked for it, watchdog pings as long as the loop is
+// healthy. It returns when done is closed.
+func superviseLoop(n *notifier, ls *loopState, cl clock, watchdog time.Duration, done <-chan struct{}) {
+	interval := time.Minute
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	for {
+		state := []string{"STATUS=" + ls.status()}
+		if watchdog > 0 {
+			if ls.healthy(watchdog) {
+				state = append(state, "WATCHDOG=1")
+			} else {
+				warnf("create loop seems to hang: %s", ls.status())
+			}
+		}
+		n.notify(state...)
+		select {
+		case <-done:
+			return
+		case <-cl.After(interval):
+		}
+	}
+}
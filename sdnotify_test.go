@@ -0,0 +1,192 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenNotify creates a stand-in for the notify socket of the service
+// manager and points $NOTIFY_SOCKET to it.
+func listenNotify(t *testing.T) (*net.UnixConn, func()) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NOTIFY_SOCKET", socket)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 4096)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	n.notify("READY=1", "STATUS=waiting")
+	if got := readNotify(t, conn); got != "READY=1\nSTATUS=waiting" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestNotifierUnset(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	n, err := newNotifier()
+	if n != nil || err != nil {
+		t.Errorf("expected no notifier, got %v, %v", n, err)
+	}
+	// must not panic
+	n.notify("READY=1")
+	n.Close()
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if got := watchdogInterval(); got != 30*time.Second {
+		t.Errorf("got %s, wanted 30s", got)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if got := watchdogInterval(); got != 0 {
+		t.Errorf("watchdog for other pid should be ignored, got %s", got)
+	}
+}
+
+func TestLoopState(t *testing.T) {
+	cl := newSkewClock(startAt)
+	ls := newLoopState(cl)
+	ls.waitUntil(cl.Now().Add(5 * time.Minute))
+	if got := ls.status(); got != "waiting 5m until next snapshot" {
+		t.Errorf("got status %q", got)
+	}
+	ls.set(stageRsync, "1400337722-0-incomplete")
+	cl.forward(2 * time.Hour)
+	if got := ls.status(); !strings.HasPrefix(got, "rsync running for 2h") {
+		t.Errorf("got status %q", got)
+	}
+	if !ls.healthy(time.Minute) {
+		t.Errorf("a long rsync run is not a hang")
+	}
+	ls.startRsync("1400337722-0-incomplete", 3*time.Hour)
+	cl.forward(2 * time.Hour)
+	if !ls.healthy(time.Minute) {
+		t.Errorf("rsync within its limit is not a hang")
+	}
+	cl.forward(2 * time.Hour)
+	if ls.healthy(time.Minute) {
+		t.Errorf("rsync running for longer than its limit should not be healthy")
+	}
+	ls.set(stageWaiting, "")
+	ls.waitUntil(cl.Now().Add(time.Hour))
+	cl.forward(time.Hour)
+	if !ls.healthy(time.Minute) {
+		t.Errorf("waiting until the next snapshot is due is not a hang")
+	}
+	cl.forward(2 * time.Minute)
+	if ls.healthy(time.Minute) {
+		t.Errorf("waiting long after the next snapshot was due should not be healthy")
+	}
+	ls.set(stagePruning, "")
+	if !ls.healthy(time.Minute) {
+		t.Errorf("pruning just started, should be healthy")
+	}
+	cl.forward(2 * time.Minute)
+	if ls.healthy(time.Minute) {
+		t.Errorf("pruning for too long should not be healthy")
+	}
+}
+
+func TestSuperviseLoop(t *testing.T) {
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	ls := newLoopState(new(realClock))
+	done := make(chan struct{})
+	go superviseLoop(n, ls, new(realClock), 20*time.Millisecond, done)
+	for i := 0; i < 2; i++ {
+		got := readNotify(t, conn)
+		if got != "STATUS=waiting for next snapshot\nWATCHDOG=1" {
+			t.Errorf("got %q", got)
+		}
+	}
+	ls.set(stagePruning, "")
+	time.Sleep(30 * time.Millisecond)
+	close(done)
+	// drain, the last message must not contain a watchdog ping
+	var last string
+	for {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		b := make([]byte, 4096)
+		n, err := conn.Read(b)
+		if err != nil {
+			break
+		}
+		last = string(b[:n])
+	}
+	if strings.Contains(last, "WATCHDOG=1") {
+		t.Errorf("watchdog ping sent for hanging loop: %q", last)
+	}
+}
+
+// TestSuperviseLoopFrozen checks that the watchdog pings stop if the create
+// loop does not start the snapshot that is due.
+func TestSuperviseLoopFrozen(t *testing.T) {
+	conn, cleanup := listenNotify(t)
+	defer cleanup()
+	n, err := newNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	ls := newLoopState(new(realClock))
+	ls.waitUntil(time.Now())
+	done := make(chan struct{})
+	defer close(done)
+	go superviseLoop(n, ls, new(realClock), 20*time.Millisecond, done)
+	time.Sleep(30 * time.Millisecond)
+	// drop the messages sent before the loop was late
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+		if _, err := conn.Read(make([]byte, 4096)); err != nil {
+			break
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if got := readNotify(t, conn); strings.Contains(got, "WATCHDOG=1") {
+			t.Errorf("watchdog ping sent for frozen loop: %q", got)
+		}
+	}
+}
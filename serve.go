@@ -0,0 +1,229 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Receiving snapshots pushed by rsync clients over ssh
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// pushOptions are the long options a pushing rsync client may pass to the
+// receiving rsync. None of them takes an argument, so everything that could
+// make it write outside of the new snapshot, like --link-dest, --backup-dir
+// or --temp-dir, is left out.
+var pushOptions = map[string]bool{
+	"--numeric-ids":      true,
+	"--force":            true,
+	"--ignore-errors":    true,
+	"--partial":          true,
+	"--fake-super":       true,
+	"--no-inc-recursive": true,
+	"--no-i-r":           true,
+	"--delete":           true,
+	"--delete-before":    true,
+	"--delete-during":    true,
+	"--delete-delay":     true,
+	"--delete-after":     true,
+	"--delete-excluded":  true,
+}
+
+// pushShortOptions are the letters of the short options a pushing rsync
+// client may pass to the receiving rsync, in one or more clusters like
+// "-logDtpr". As for pushOptions, options taking an argument, like -T or -M,
+// are left out. The only exception is -e, which rsync uses in server mode to
+// pass the capabilities of the client, like in "-e.iLsfxCIvu", see
+// pushCapabilities. -K is left out as well, it would make rsync follow
+// symlinks to directories on the receiving side.
+const pushShortOptions = "vqlogDtprzcuxnWHAXSI"
+
+// pushCapabilities are the letters the capabilities passed with -e may
+// consist of.
+const pushCapabilities = "iLsfxCIvu"
+
+// pushErrors are the rsync errors that still complete a pushed snapshot.
+// Other errors ignored for pulled snapshots usually mean the client went
+// away.
+var pushErrors = map[int]bool{
+	23: true,
+	24: true,
+}
+
+// pushClient is an rsync client pushing a snapshot into the repository.
+type pushClient struct {
+	// opts are the options the client passed to the receiving rsync
+	opts []string
+	// in and out are connected to the client
+	in  io.Reader
+	out io.Writer
+}
+
+// parsePushCommand checks the command an rsync client wants to run on the
+// server, e. g. "rsync --server -logDtpre.iLsfxCIvu --delete . dest/", and
+// returns its options. Only receiving rsync commands are accepted. The
+// destination is ignored, pushed snapshots always go into the repository.
+func parsePushCommand(command string) ([]string, error) {
+	args := strings.Fields(command)
+	if len(args) < 2 || filepath.Base(args[0]) != "rsync" || args[1] != "--server" {
+		return nil, fmt.Errorf("only rsync can push snapshots, not: %s", command)
+	}
+	var opts []string
+	for i, arg := range args[2:] {
+		switch {
+		case arg == ".":
+			if i+3 >= len(args) {
+				return nil, fmt.Errorf("no destination in rsync command: %s", command)
+			}
+			return opts, nil
+		case arg == "--sender":
+			return nil, errors.New("snapshots can only be pushed, not read")
+		case strings.HasPrefix(arg, "--"):
+			if !pushOptions[arg] {
+				return nil, fmt.Errorf("rsync option not allowed for pushing: %s", arg)
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			if err := checkShortOptions(arg); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected argument in rsync command: %s", arg)
+		}
+		opts = append(opts, arg)
+	}
+	return nil, fmt.Errorf("incomplete rsync command: %s", command)
+}
+
+// checkShortOptions checks that a cluster of short options contains only
+// letters of pushShortOptions, optionally followed by the capabilities.
+func checkShortOptions(arg string) error {
+	for i, c := range arg[1:] {
+		switch {
+		case c == 'e':
+			caps := arg[i+2:]
+			if !strings.HasPrefix(caps, ".") || strings.Trim(caps[1:], pushCapabilities) != "" {
+				return fmt.Errorf("rsync capabilities not allowed for pushing: %s", arg)
+			}
+			return nil
+		case !strings.ContainsRune(pushShortOptions, c):
+			return fmt.Errorf("rsync option not allowed for pushing: -%c in %s", c, arg)
+		}
+	}
+	return nil
+}
+
+// removeSymlinks removes all symlinks below dir, a snapshot left incomplete
+// by an earlier push that is about to be reused. The client could have left
+// them there to make the next push write outside of the snapshot.
+func removeSymlinks(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// createPushCommand returns an exec.Command structure that, when executed,
+// receives snapshot sn from the pushing client, based on the optional
+// (non-zero) base.
+func (r *Repository) createPushCommand(sn snapshot, base snapshot) *exec.Cmd {
+	cmd := exec.Command(r.config.RsyncPath)
+	args := []string{r.config.RsyncPath, "--server"}
+	args = append(args, r.push.opts...)
+	args = append(args, r.store.rsyncArgs(baseName(base))...)
+	args = append(args, ".", r.store.target(sn.Name()))
+	cmd.Args = args
+	cmd.Dir = r.path(dataSubdir)
+	cmd.Stdin = r.push.in
+	cmd.Stdout = r.push.out
+	cmd.Stderr = os.Stderr
+	r.snapLog(sn).infof("run: %s", args)
+	return cmd
+}
+
+// runPushCommand executes the given command. On sucessful startup return an
+// error channel the caller can receive a return status from.
+func (r *Repository) runPushCommand(cmd *exec.Cmd) (chan error, error) {
+	r.log.debugf("starting rsync server")
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	r.log.setRsyncPid(cmd.Process.Pid)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	return done, nil
+}
+
+// subcmdServe receives a single snapshot pushed by an rsync client. It is
+// meant to be the forced command of the ssh key of the client, so command is
+// what the client wanted to run and in and out are connected to it. After
+// the snapshot is complete, the repository is pruned and obsolete snapshots
+// are purged, like subcmdRun does it after every snapshot.
+func subcmdServe(r *Repository, command string, in io.Reader, out io.Writer) error {
+	if command == "" {
+		return errors.New("serve must be run as forced command by sshd, SSH_ORIGINAL_COMMAND is not set")
+	}
+	opts, err := parsePushCommand(command)
+	if err != nil {
+		return err
+	}
+	r.push = &pushClient{opts: opts, in: in, out: out}
+	pl := newPidLocker(r.path(".pid"))
+	if err := pl.Lock(); err != nil {
+		return err
+	}
+	defer pl.Unlock()
+
+	ctx, cancel := r.cancelOnSignal()
+	defer cancel()
+
+	sn, err := r.createSnapshot(ctx, r.lastGoodFromDisk())
+	if err != nil {
+		return err
+	}
+	r.log.infof("received %s", sn.Name())
+	r.state.set(stagePruning, "")
+	r.prune(r.purgeQ)
+	if r.config.NoPurge {
+		r.claimFreeSpace(ctx)
+		return nil
+	}
+	r.rescanPurge(r.purgeQ)
+	r.purgeAll(ctx, r.purgeQ)
+	return nil
+}
+
+// cancelOnSignal returns a context that is canceled when snaprd is told to
+// exit by a signal. The returned function must be called when it is no
+// longer needed.
+func (r *Repository) cancelOnSignal() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		select {
+		case sig := <-sigc:
+			r.log.infof("-> Got signal %s, exiting", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigc)
+		cancel()
+	}
+}
@@ -0,0 +1,121 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePushCommand(t *testing.T) {
+	for _, tc := range []struct {
+		command string
+		opts    string
+		ok      bool
+	}{
+		{"rsync --server -logDtpre.iLsfxCIvu --delete . /backup/", "-logDtpre.iLsfxCIvu --delete", true},
+		{"/usr/bin/rsync --server -vlogDtprze.iLsfxC --numeric-ids . .", "-vlogDtprze.iLsfxC --numeric-ids", true},
+		{"rsync --server --sender -logDtpre.iLsfxCIvu . /backup/", "", false},
+		{"rsync --server -logDtpre.iLsfxCIvu --link-dest=/etc . /backup/", "", false},
+		{"rsync --server -logDtpre.iLsfxCIvu --temp-dir=/tmp . /backup/", "", false},
+		{"rsync --server -vlogDtpr -e.LsfxC --delete-after . /backup/", "-vlogDtpr -e.LsfxC --delete-after", true},
+		{"rsync --server -T/tmp -logDtpre.iLsfxCIvu . /backup/", "", false},
+		{"rsync --server -M--link-dest=/ -logDtpre.iLsfxCIvu . /backup/", "", false},
+		{"rsync --server -logDtprT/tmp . /backup/", "", false},
+		{"rsync --server -logDtpre.iLsfx/tmp . /backup/", "", false},
+		{"rsync --server -logDtpre . /backup/", "", false},
+		{"rsync --server -logDtprK . /backup/", "", false},
+		{"rsync --server -logDtpre.iLsfxCIvu .", "", false},
+		{"rsync --server -logDtpre.iLsfxCIvu /etc . /backup/", "", false},
+		{"rsync -a /etc /backup/", "", false},
+		{"sh -c 'rm -rf /'", "", false},
+	} {
+		opts, err := parsePushCommand(tc.command)
+		if (err == nil) != tc.ok || strings.Join(opts, " ") != tc.opts {
+			t.Errorf("parsePushCommand(%q) gave %v, %v", tc.command, opts, err)
+		}
+	}
+}
+
+func TestSubcmdServe(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	argsFile := filepath.Join(r.path(), "args")
+	r.config.RsyncPath = fakeRsync(t, r.path(), `echo "$@" > "`+argsFile+`"`)
+	var out bytes.Buffer
+	if err := subcmdServe(r, "", nil, &out); err == nil {
+		t.Errorf("subcmdServe() accepted an empty command")
+	}
+	if err := subcmdServe(r, "rsync --server --sender -logDtpre.iLsfxCIvu . /", nil, &out); err == nil {
+		t.Errorf("subcmdServe() accepted a sending rsync")
+	}
+	err := subcmdServe(r, "rsync --server -logDtpre.iLsfxCIvu --delete . /etc/", strings.NewReader(""), &out)
+	if err != nil {
+		t.Fatalf("subcmdServe() gave error %v", err)
+	}
+	if !strings.Contains(out.String(), "Number of files") {
+		t.Errorf("rsync output did not go to the client: %q", out.String())
+	}
+	b, _ := ioutil.ReadFile(argsFile)
+	args := strings.TrimSpace(string(b))
+	want := "--server -logDtpre.iLsfxCIvu --delete --link-dest=" + r.path(dataSubdir, "1400337721-1400337722-complete") +
+		" . " + r.path(dataSubdir, "1400337722-0-incomplete")
+	if args != want {
+		t.Errorf("rsync was run with %q, wanted %q", args, want)
+	}
+	sl, err := r.findSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := sl.lastGood(); last.startTime.Unix() != startAt {
+		t.Errorf("pushed snapshot is not complete, the last one is %s", last.Name())
+	}
+	if n := len(sl.state(stateIncomplete+stateObsolete+statePurging, none)); n != 0 {
+		t.Errorf("%d incomplete or obsolete snapshots left: %v", n, sl)
+	}
+	if _, err := os.Stat(r.path(".pid")); !os.IsNotExist(err) {
+		t.Errorf("pid file was not removed")
+	}
+}
+
+func TestSubcmdServeClientGone(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	os.MkdirAll(r.path(dataSubdir), 0755)
+	// error in rsync protocol data stream
+	r.config.RsyncPath = fakeRsync(t, r.path(), `mkdir "$dst"; exit 12`)
+	err := subcmdServe(r, "rsync --server -logDtpre.iLsfxCIvu . .", strings.NewReader(""), ioutil.Discard)
+	if err == nil {
+		t.Errorf("subcmdServe() succeeded, but the client went away")
+	}
+	if sn := r.lastReusableFromDisk(); sn.isZero() {
+		t.Errorf("no incomplete snapshot left for reuse")
+	}
+}
+
+func TestSubcmdServeReuse(t *testing.T) {
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	outside := r.path("outside")
+	os.Mkdir(outside, 0755)
+	// left behind by an earlier push of the same client
+	reused := r.path(dataSubdir, "1400337720-0-incomplete")
+	os.Mkdir(reused, 0755)
+	if err := os.Symlink(outside, filepath.Join(reused, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	r.config.RsyncPath = fakeRsync(t, r.path(), `mkdir -p "$dst/escape" && touch "$dst/escape/file"`)
+	err := subcmdServe(r, "rsync --server -logDtpre.iLsfxCIvu . .", strings.NewReader(""), ioutil.Discard)
+	if err != nil {
+		t.Fatalf("subcmdServe() gave error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Errorf("pushed file was written through a symlink outside of the snapshot")
+	}
+}
@@ -7,13 +7,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"github.com/sstark/snaprd/repo"
 	"sort"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -25,6 +20,9 @@ const (
 	stateComplete
 	stateObsolete
 	statePurging
+	// stateQuarantined is for snapshots that could not be purged. They are
+	// left alone until the administrator takes care of them.
+	stateQuarantined
 	any = (1 << iota) - 1
 )
 
@@ -38,32 +36,56 @@ func (st snapshotState) String() string {
 		return "Obsolete"
 	case statePurging:
 		return "Purging"
+	case stateQuarantined:
+		return "Quarantined"
 	}
 	return "Unknown"
 }
 
+// snapshot describes a snapshot directory. Snapshots are values and never
+// changed once created, so they can be passed between goroutines freely. A
+// state transition returns a new snapshot. The zero snapshot stands for no
+// snapshot at all.
 type snapshot struct {
 	startTime time.Time
 	endTime   time.Time
 	state     snapshotState
+	// verified is the last time the origin was found to be unchanged
+	// compared to this snapshot, zero if never.
+	verified time.Time
 }
 
-func newSnapshot(startTime, endTime time.Time, state snapshotState) *snapshot {
-	return &snapshot{startTime, endTime, state}
+func newSnapshot(startTime, endTime time.Time, state snapshotState) snapshot {
+	return snapshot{startTime, endTime, state, time.Time{}}
 }
 
-func newIncompleteSnapshot(cl clock) *snapshot {
-	return &snapshot{cl.Now(), time.Time{}, stateIncomplete}
+func newIncompleteSnapshot(cl clock) snapshot {
+	return snapshot{cl.Now(), time.Time{}, stateIncomplete, time.Time{}}
 }
 
-func (s *snapshot) String() string {
+// isZero returns true for the zero snapshot.
+func (s snapshot) isZero() bool {
+	return s.startTime.IsZero()
+}
+
+// effectiveTime returns the latest point in time the receiver is known to
+// represent the origin. This is the start time, unless a later snapshot
+// found no changes and was discarded.
+func (s snapshot) effectiveTime() time.Time {
+	if s.verified.After(s.startTime) {
+		return s.verified
+	}
+	return s.startTime
+}
+
+func (s snapshot) String() string {
 	stime := s.startTime.Unix()
 	etime := s.endTime.Unix()
 	return fmt.Sprintf("%d-%d %s", stime, etime, s.state.String())
 }
 
 // Name returns the relative pathname for the receiver snapshot.
-func (s *snapshot) Name() string {
+func (s snapshot) Name() string {
 	stime := s.startTime.Unix()
 	etime := s.endTime.Unix()
 	switch s.state {
@@ -75,114 +97,123 @@ func (s *snapshot) Name() string {
 		return fmt.Sprintf("%d-%d-obsolete", stime, etime)
 	case statePurging:
 		return fmt.Sprintf("%d-%d-purging", stime, etime)
+	case stateQuarantined:
+		return fmt.Sprintf("%d-%d-quarantined", stime, etime)
 	}
 	return fmt.Sprintf("%d-%d-unknown", stime, etime)
 }
 
-// FullName returns the full pathname for the receiver snapshot.
-func (s *snapshot) FullName() string {
-	return filepath.Join(config.repository, dataSubdir, s.Name())
-}
-
-// transComplete transitions the receiver to complete state.
-func (s *snapshot) transComplete(cl clock) error {
-	oldName := s.FullName()
-	etime := cl.Now()
+// transComplete transitions s to complete state and returns the complete
+// snapshot.
+func (r *Repository) transComplete(s snapshot) (snapshot, error) {
+	etime := r.cl.Now()
 	if etime.Before(s.startTime) {
-		return errors.New("endTime before startTime!")
+		return s, errors.New("endTime before startTime!")
 	}
 	// make all snapshots at least 1 second long
 	if etime.Sub(s.startTime).Seconds() < 1 {
 		etime = etime.Add(time.Second)
 	}
-	s.endTime = etime
-	s.state = stateComplete
-	newName := s.FullName()
-	debugf("renaming complete snapshot %s -> %s", oldName, newName)
-	if oldName != newName {
-		err := os.Rename(oldName, newName)
-		if err != nil {
+	n := s
+	n.endTime = etime
+	n.state = stateComplete
+	err := r.mutate(func() error {
+		r.log.withFields(logFields{
+			"snapshot": n.Name(),
+			"state":    s.state.String() + " -> " + n.state.String(),
+		}).debugf("completing snapshot %s -> %s", s.Name(), n.Name())
+		if err := r.store.complete(s.Name(), n.Name()); err != nil {
 			return err
 		}
+		r.updateSymlinks()
+		r.updateLatest(n)
+		return nil
+	})
+	if err != nil {
+		return s, err
 	}
-	updateSymlinks()
-	overwriteSymlink(filepath.Join(dataSubdir, s.Name()), filepath.Join(config.repository, "latest"))
-	return nil
+	return n, nil
 }
 
-// transObsolete transitions the receiver to obsolete state.
-func (s *snapshot) transObsolete() error {
-	oldName := s.FullName()
-	s.state = stateObsolete
-	newName := s.FullName()
-	if oldName != newName {
-		err := os.Rename(oldName, newName)
-		if err != nil {
+// transObsolete transitions s to obsolete state and returns the obsolete
+// snapshot.
+func (r *Repository) transObsolete(s snapshot) (snapshot, error) {
+	n := s
+	n.state = stateObsolete
+	err := r.mutate(func() error {
+		if err := r.rename(s, n); err != nil {
 			return err
 		}
+		r.updateSymlinks()
+		return nil
+	})
+	if err != nil {
+		return s, err
 	}
-	updateSymlinks()
-	return nil
+	return n, nil
 }
 
-// transPurging transitions the receiver to purging state.
-func (s *snapshot) transPurging() error {
-	oldName := s.FullName()
-	s.state = statePurging
-	newName := s.FullName()
-	if oldName != newName {
-		err := os.Rename(oldName, newName)
-		if err != nil {
-			return err
-		}
+// transPurging transitions s to purging state and returns the purging
+// snapshot.
+func (r *Repository) transPurging(s snapshot) (snapshot, error) {
+	n := s
+	n.state = statePurging
+	if err := r.mutate(func() error { return r.rename(s, n) }); err != nil {
+		return s, err
 	}
-	return nil
+	return n, nil
+}
+
+// transQuarantined transitions s to quarantined state and returns the
+// quarantined snapshot.
+func (r *Repository) transQuarantined(s snapshot) (snapshot, error) {
+	n := s
+	n.state = stateQuarantined
+	if err := r.mutate(func() error { return r.rename(s, n) }); err != nil {
+		return s, err
+	}
+	return n, nil
 }
 
 // transIncomplete generates a new incomplete snapshot based on a previous one.
 // Can be used to try to use previous incomplete snapshots, or even to reuse
 // obsolete ones.
-func (s *snapshot) transIncomplete(cl clock) error {
-	oldName := s.FullName()
-	s.startTime = cl.Now()
-	s.endTime = time.Time{}
-	s.state = stateIncomplete
-	newName := s.FullName()
-	debugf("renaming incomplete snapshot %s -> %s", oldName, newName)
-	if oldName != newName {
-		err := os.Rename(oldName, newName)
-		if err != nil {
-			return err
-		}
+func (r *Repository) transIncomplete(s snapshot) (snapshot, error) {
+	n := s
+	n.startTime = r.cl.Now()
+	n.endTime = time.Time{}
+	n.state = stateIncomplete
+	if err := r.mutate(func() error { return r.rename(s, n) }); err != nil {
+		return s, err
 	}
-	return nil
+	return n, nil
 }
 
-// purge deletes the receiver snapshot from disk.
-func (s *snapshot) purge() {
-	err := s.transPurging()
-	if err != nil {
-		log.Printf("error peparing %s for purging: %s", s.Name(), err)
-	}
-	path := s.FullName()
-	log.Println("purging", s.Name())
-	err = os.RemoveAll(path)
-	if err != nil {
-		log.Printf("error when purging \"%s\" (ignored): %s", s.Name(), err)
+// rename renames snapshot from to the name of snapshot to. It must only be
+// called by the owner of the repository.
+func (r *Repository) rename(from, to snapshot) error {
+	oldName, newName := from.Name(), to.Name()
+	r.log.withFields(logFields{
+		"snapshot": to.Name(),
+		"state":    from.state.String() + " -> " + to.state.String(),
+	}).debugf("renaming snapshot %s -> %s", oldName, newName)
+	if oldName != newName {
+		return r.store.rename(oldName, newName)
 	}
-	log.Println("finished purging", s.Name())
+	return nil
 }
 
-func (s *snapshot) matchFilter(f snapshotState) bool {
+func (s snapshot) matchFilter(f snapshotState) bool {
 	//log.Println("filter:", strconv.FormatInt(int64(s.state), 2), strconv.FormatInt(int64(f), 2), strconv.FormatBool(s.state & f == s.state))
 	//log.Println(strconv.FormatInt(int64(any), 2))
 	return (s.state & f) == s.state
 }
 
-type snapshotList []*snapshot
+type snapshotList []snapshot
 
-// Find the last snapshot to use as a basis for the next one.
-func (sl snapshotList) lastGood() *snapshot {
+// Find the last snapshot to use as a basis for the next one. Returns the zero
+// snapshot if there is none.
+func (sl snapshotList) lastGood() snapshot {
 	var t time.Time
 	var ix = -1
 	for i, sn := range sl {
@@ -192,13 +223,14 @@ func (sl snapshotList) lastGood() *snapshot {
 		}
 	}
 	if ix == -1 {
-		return nil
+		return snapshot{}
 	}
 	return sl[ix]
 }
 
-// Find the last snapshot in a given list.
-func (sl snapshotList) last() *snapshot {
+// Find the last snapshot in a given list. Returns the zero snapshot if the
+// list is empty.
+func (sl snapshotList) last() snapshot {
 	var t time.Time
 	var ix = -1
 	for i, sn := range sl {
@@ -208,45 +240,33 @@ func (sl snapshotList) last() *snapshot {
 		}
 	}
 	if ix == -1 {
-		return nil
+		return snapshot{}
 	}
 	return sl[ix]
 }
 
+// repoStates maps the states of the repo package to snapshot states.
+var repoStates = map[repo.State]snapshotState{
+	repo.Incomplete:  stateIncomplete,
+	repo.Complete:    stateComplete,
+	repo.Obsolete:    stateObsolete,
+	repo.Purging:     statePurging,
+	repo.Quarantined: stateQuarantined,
+}
+
 // parseSnapshotName split the given string up into the various values needed
-// for creating a Snapshot struct.
+// for creating a Snapshot struct. The parsing is left to the repo package, so
+// other programs read snapshot names exactly like snaprd.
 func parseSnapshotName(s string) (time.Time, time.Time, snapshotState, error) {
-	sa := strings.Split(s, "-")
-	var zero time.Time
-	if len(sa) != 3 {
-		return zero, zero, 0, errors.New("malformed snapshot name: " + s)
-	}
-	stime, err := strconv.ParseInt(sa[0], 10, 64)
-	if err != nil {
-		return zero, zero, 0, err
-	}
-	etime, err := strconv.ParseInt(sa[1], 10, 64)
+	sn, err := repo.ParseName(s)
 	if err != nil {
-		return zero, zero, 0, err
+		return time.Time{}, time.Time{}, 0, err
 	}
-	var state snapshotState
-	switch sa[2] {
-	case "complete":
-		state = stateComplete
-	case "incomplete":
-		state = stateIncomplete
-	case "obsolete":
-		state = stateObsolete
-	case "purging":
-		state = statePurging
+	etime := sn.End
+	if sn.State == repo.Incomplete {
+		etime = time.Unix(0, 0)
 	}
-	if state == 0 {
-		return time.Unix(stime, 0), time.Unix(etime, 0), state, errors.New("could not parse state: " + s)
-	}
-	if state == stateIncomplete && etime != 0 {
-		return zero, zero, 0, errors.New("incomplete state but non-zero end time: " + s)
-	}
-	return time.Unix(stime, 0), time.Unix(etime, 0), state, nil
+	return sn.Start, etime, repoStates[sn.State], nil
 }
 
 type snapshotListByStartTime snapshotList
@@ -261,40 +281,41 @@ func (sl snapshotListByStartTime) Less(i, j int) bool {
 	return sl[i].startTime.Before(sl[j].startTime)
 }
 
-// findSnapshots() reads the repository directory and returns a list of
-// Snapshot pointers for all valid snapshots it could find.
-func findSnapshots(cl clock) (snapshotList, error) {
+// findSnapshots lists the storage of the repository and returns a list of all
+// valid snapshots it could find.
+func (r *Repository) findSnapshots() (snapshotList, error) {
 	snapshots := make(snapshotList, 0, 256)
-	dataPath := filepath.Join(config.repository, dataSubdir, "")
-	files, err := ioutil.ReadDir(dataPath)
+	names, err := r.store.list()
 	if err != nil {
-		return nil, errors.New("Repository " + dataPath + " does not exist")
+		return nil, err
 	}
-	for _, f := range files {
-		if !f.IsDir() {
-			continue
-		}
-		stime, etime, state, err := parseSnapshotName(f.Name())
+	for _, name := range names {
+		stime, etime, state, err := parseSnapshotName(name)
 		if err != nil {
-			log.Println(err)
+			r.log.warnf("%s", err)
 			continue
 		}
-		if stime.After(cl.Now()) {
-			log.Println("ignoring snapshot with startTime in future:", f.Name())
+		if stime.After(r.cl.Now()) {
+			r.log.warnf("ignoring snapshot with startTime in future: %s", name)
 			continue
 		}
 		sn := newSnapshot(stime, etime, state)
 		snapshots = append(snapshots, sn)
 	}
 	sort.Sort(snapshotListByStartTime(snapshots))
+	if err := r.loadMeta(snapshots); err != nil {
+		r.log.warnf("could not read snapshot metadata: %s", err)
+	}
 	return snapshots, nil
 }
 
 // Return a new list of snapshots that fall into the given time period.
+// Snapshots that were verified as unchanged count for the time of their last
+// verification.
 func (sl snapshotList) period(after, before time.Time) snapshotList {
 	slNew := make(snapshotList, 0, len(sl))
 	for _, sn := range sl {
-		if sn.startTime.After(after) && sn.startTime.Before(before) {
+		if t := sn.effectiveTime(); t.After(after) && t.Before(before) {
 			slNew = append(slNew, sn)
 		}
 	}
@@ -321,40 +342,41 @@ func (sl snapshotList) state(include, exclude snapshotState) snapshotList {
 	return slNew
 }
 
-// findDangling returns a list of obsolete or purged snapshots.
-func findDangling(cl clock) snapshotList {
-	snapshots, err := findSnapshots(cl)
+// findDangling returns a list of obsolete or purged snapshots. Quarantined
+// snapshots are not included, they are never purged automatically.
+func (r *Repository) findDangling() snapshotList {
+	snapshots, err := r.findSnapshots()
 	if err != nil {
-		log.Println(err)
+		r.log.errorf("%s", err)
 	}
 	slNew := make(snapshotList, 0, len(snapshots))
 	for _, sn := range snapshots.state(stateObsolete+statePurging, stateComplete) {
-		debugf("found dangling snapshot: %s", sn)
+		r.log.debugf("found dangling snapshot: %s", sn)
 		slNew = append(slNew, sn)
 	}
 	return slNew
 }
 
-// lastGoodFromDisk lists the snapshots in the repository and returns a pointer
-// to the youngest complete snapshot.
-func lastGoodFromDisk(cl clock) *snapshot {
-	snapshots, err := findSnapshots(cl)
+// lastGoodFromDisk lists the snapshots in the repository and returns the
+// youngest complete snapshot, or the zero snapshot.
+func (r *Repository) lastGoodFromDisk() snapshot {
+	snapshots, err := r.findSnapshots()
 	if err != nil {
-		log.Println(err)
+		r.log.errorf("%s", err)
 	}
 	sn := snapshots.state(stateComplete, none).lastGood()
-	if sn == nil {
-		log.Println("lastgood: could not find suitable base snapshot")
+	if sn.isZero() {
+		r.log.warnf("lastgood: could not find suitable base snapshot")
 	}
 	return sn
 }
 
-// lastIncompleteFromDisk lists the snapshots in the repository and returns a pointer
-// to the youngest incomplete snapshot, for possible reuse.
-func lastReusableFromDisk(cl clock) *snapshot {
-	snapshots, err := findSnapshots(cl)
+// lastReusableFromDisk lists the snapshots in the repository and returns the
+// youngest incomplete snapshot for possible reuse, or the zero snapshot.
+func (r *Repository) lastReusableFromDisk() snapshot {
+	snapshots, err := r.findSnapshots()
 	if err != nil {
-		log.Println(err)
+		r.log.errorf("%s", err)
 	}
 	sn := snapshots.state(stateIncomplete, none).last()
 	return sn
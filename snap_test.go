@@ -3,9 +3,10 @@
 package main
 
 import (
+	"github.com/sstark/snaprd/repo"
 	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -36,9 +37,9 @@ var mockSnapshotsDangling = []string{
 	"1400337721-1400337722-complete",
 }
 
-func mockRepositoryDangling() {
+func mockRepositoryDangling(r *Repository) {
 	for _, s := range mockSnapshotsDangling {
-		os.MkdirAll(filepath.Join(config.repository, dataSubdir, s), 0777)
+		os.MkdirAll(r.path(dataSubdir, s), 0777)
 	}
 }
 
@@ -48,16 +49,16 @@ type danglingTestPair struct {
 }
 
 func TestFindDangling(t *testing.T) {
+	t.Parallel()
 	var tests = []danglingTestPair{
 		{0, "1400337651-1400337652 Purging"},
 		{1, "1400337711-1400337712 Obsolete"},
 	}
-	mockConfig()
-	mockRepositoryDangling()
-	defer os.RemoveAll(config.repository)
-	cl := newSkewClock(startAt)
+	r := mockConfig()
+	mockRepositoryDangling(r)
+	defer os.RemoveAll(r.path())
 
-	sl := findDangling(cl)
+	sl := r.findDangling()
 	lgot, lwant := len(sl), len(tests)
 	if lgot != lwant {
 		t.Errorf("FindDangling() found %v, should be %v", lgot, lwant)
@@ -70,20 +71,22 @@ func TestFindDangling(t *testing.T) {
 }
 
 func TestLastGood(t *testing.T) {
-	mockConfig()
-	mockRepositoryDangling()
-	defer os.RemoveAll(config.repository)
+	t.Parallel()
+	r := mockConfig()
+	mockRepositoryDangling(r)
+	defer os.RemoveAll(r.path())
 	cl := newSkewClock(startAt)
+	r.cl = cl
 
-	sl, _ := findSnapshots(cl)
+	sl, _ := r.findSnapshots()
 	if s := sl.lastGood().String(); s != lastGood {
 		t.Errorf("lastGood() found %v, should be %v", s, lastGood)
 	}
 	// Advance to next snapshot the is not (yet) complete, see if this is
 	// omitted as it should
-	os.Mkdir(filepath.Join(config.repository, dataSubdir, "1400337727-0-incomplete"), 0777)
-	cl.skew -= schedules["testing2"][0]
-	sl, _ = findSnapshots(cl)
+	os.Mkdir(r.path(dataSubdir, "1400337727-0-incomplete"), 0777)
+	cl.forward(r.schedules["testing2"][0])
+	sl, _ = r.findSnapshots()
 	if s := sl.lastGood().String(); s != lastGood {
 		t.Errorf("lastGood() found %v, should be %v", s, lastGood)
 	}
@@ -97,33 +100,33 @@ type snStateTestPair struct {
 
 func TestSnapshotState(t *testing.T) {
 	slIn := &snapshotList{
-		{time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete},
-		{time.Unix(1400337611, 0), time.Unix(1400337612, 0), stateComplete},
-		{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging},
-		{time.Unix(1400337671, 0), time.Unix(1400337672, 0), stateComplete},
-		{time.Unix(1400337691, 0), time.Unix(1400337692, 0), stateComplete},
-		{time.Unix(1400337706, 0), time.Unix(1400337707, 0), stateComplete},
-		{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete},
-		{time.Unix(1400337716, 0), time.Unix(1400337717, 0), stateComplete},
-		{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateIncomplete},
+		{time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337611, 0), time.Unix(1400337612, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging, time.Time{}},
+		{time.Unix(1400337671, 0), time.Unix(1400337672, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337691, 0), time.Unix(1400337692, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337706, 0), time.Unix(1400337707, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete, time.Time{}},
+		{time.Unix(1400337716, 0), time.Unix(1400337717, 0), stateComplete, time.Time{}},
+		{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateIncomplete, time.Time{}},
 	}
 	tests := []snStateTestPair{
 		{
 			statePurging, 0, &snapshotList{
-				&snapshot{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging},
+				{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging, time.Time{}},
 			},
 		},
 		{
 			statePurging + stateObsolete, 0, &snapshotList{
-				&snapshot{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging},
-				&snapshot{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete},
+				{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging, time.Time{}},
+				{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete, time.Time{}},
 			},
 		},
 		{
 			any, stateComplete, &snapshotList{
-				&snapshot{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging},
-				&snapshot{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete},
-				&snapshot{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateIncomplete},
+				{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging, time.Time{}},
+				{time.Unix(1400337711, 0), time.Unix(1400337712, 0), stateObsolete, time.Time{}},
+				{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateIncomplete, time.Time{}},
 			},
 		},
 	}
@@ -155,20 +158,20 @@ func TestParseSnapshotName(t *testing.T) {
 	testsGood := []snParseTestPair{
 		{
 			"1400337531-1400337532-complete",
-			&snapshot{time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete},
+			&snapshot{time.Unix(1400337531, 0), time.Unix(1400337532, 0), stateComplete, time.Time{}},
 		},
 		{
 			"1400337651-1400337652-purging",
-			&snapshot{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging},
+			&snapshot{time.Unix(1400337651, 0), time.Unix(1400337652, 0), statePurging, time.Time{}},
 		},
 		{
 			"1400337721-1400337722-obsolete",
-			&snapshot{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateObsolete},
+			&snapshot{time.Unix(1400337721, 0), time.Unix(1400337722, 0), stateObsolete, time.Time{}},
 		},
 	}
 	for _, pair := range testsGood {
 		stime, etime, state, err := parseSnapshotName(pair.in)
-		sOut := &snapshot{stime, etime, state}
+		sOut := &snapshot{stime, etime, state, time.Time{}}
 		if err != nil {
 			t.Errorf("parseSnapshotName(%v) gave error %v", pair.in, err)
 		}
@@ -189,3 +192,35 @@ func TestParseSnapshotName(t *testing.T) {
 		}
 	}
 }
+
+// The public package must agree with snaprd about snapshot names.
+func TestParseSnapshotNameRepo(t *testing.T) {
+	for _, name := range append(mockSnapshotsDangling, "1400337727-0-incomplete") {
+		stime, etime, state, _ := parseSnapshotName(name)
+		sn, err := repo.ParseName(name)
+		if state == stateIncomplete {
+			etime = time.Time{}
+		}
+		if err != nil || !sn.Start.Equal(stime) || !sn.End.Equal(etime) || sn.State.String() != strings.ToLower(state.String()) {
+			t.Errorf("repo.ParseName(%q) gave %+v, %v", name, sn, err)
+		}
+	}
+}
+
+func TestIntervalVerified(t *testing.T) {
+	t.Parallel()
+	r := mockConfig()
+	mockRepository(r)
+	defer os.RemoveAll(r.path())
+	r.updateMeta(func(meta map[string]snapshotMeta) {
+		meta["1400337721"] = snapshotMeta{Files: 10, Verified: startAt + 60}
+	})
+	cl := newSkewClock(startAt + 62)
+	r.cl = cl
+	intervals := r.intervals()
+	sl, _ := r.findSnapshots()
+	iv := sl.interval(intervals, 0, cl)
+	if len(iv) != 1 || iv[0].String() != lastGood {
+		t.Errorf("verified snapshot should be in interval 0, found %v", iv)
+	}
+}
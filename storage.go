@@ -0,0 +1,163 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Different ways of keeping snapshots on disk
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// storageNames are the possible arguments to -storage.
+var storageNames = []string{"hardlink", "btrfs", "zfs"}
+
+// storage keeps the snapshots of a repository. Snapshots are addressed by
+// their names, which are the same for all storages, so listing and pruning
+// work the same for all of them. A state transition of a snapshot is a
+// rename.
+type storage interface {
+	// list returns the names of everything in the storage. Names that are
+	// not snapshot names are ignored by the caller.
+	list() ([]string, error)
+	// path returns the absolute path the snapshot name can be read from.
+	path(name string) string
+	// target returns the absolute path rsync writes the new snapshot name
+	// into.
+	target(name string) string
+	// prepare is called for a new snapshot before rsync runs. base is the
+	// snapshot the new one is based on, empty if there is none.
+	prepare(name, base string) error
+	// rsyncArgs returns the options rsync needs to fill a snapshot based on
+	// base, which may be empty.
+	rsyncArgs(base string) []string
+	// rename renames a snapshot.
+	rename(from, to string) error
+	// complete renames the incomplete snapshot from to the complete snapshot
+	// to, after rsync has finished.
+	complete(from, to string) error
+	// remove deletes a snapshot. progress is called from time to time with
+	// the number of files removed so far, if the storage counts them.
+	// Returns the number of files removed, zero if unknown.
+	remove(ctx context.Context, name string, progress func(files int64)) (int64, error)
+	// free returns the number of bytes available for new snapshots and the
+	// total size of the storage.
+	free() (freeBytes, sizeBytes uint64, err error)
+}
+
+// unlinkedStorage is implemented by storages whose snapshots can not be
+// reached through symlinks in the repository, so none are made.
+type unlinkedStorage interface {
+	unlinked()
+}
+
+// checkStorage returns an error if the storage name can not be used.
+func checkStorage(name string) error {
+	switch name {
+	case "hardlink", "zfs":
+		return nil
+	case "btrfs":
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("-storage=btrfs is only supported on linux")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown storage: %s, use one of %s", name, strings.Join(storageNames, ","))
+}
+
+// newStorage returns the storage selected in c for its repository. The
+// storage name must have been checked with checkStorage, anything unknown
+// is treated like the default.
+func newStorage(c *Config) storage {
+	hl := &hardlinkStorage{
+		root:    filepath.Join(c.repository, dataSubdir),
+		walkers: c.PurgeWalkers,
+		rate:    c.PurgeRate,
+		nice:    c.PurgeNice,
+	}
+	switch c.Storage {
+	case "btrfs":
+		return &btrfsStorage{hardlinkStorage: hl, command: "btrfs"}
+	case "zfs":
+		return &zfsStorage{command: "zfs", root: hl.root}
+	}
+	return hl
+}
+
+// hardlinkStorage keeps snapshots as plain directories below root. Files
+// that did not change since the base snapshot are hard links created by
+// rsync --link-dest.
+type hardlinkStorage struct {
+	root    string
+	walkers int
+	rate    int
+	nice    bool
+}
+
+// list returns the names of all directories.
+func (hl *hardlinkStorage) list() ([]string, error) {
+	files, err := ioutil.ReadDir(hl.root)
+	if err != nil {
+		return nil, fmt.Errorf("Repository %s does not exist", hl.root)
+	}
+	var names []string
+	for _, f := range files {
+		if f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+func (hl *hardlinkStorage) path(name string) string {
+	return filepath.Join(hl.root, name)
+}
+
+func (hl *hardlinkStorage) target(name string) string {
+	return hl.path(name)
+}
+
+// prepare does nothing, rsync creates the directory.
+func (hl *hardlinkStorage) prepare(name, base string) error {
+	return nil
+}
+
+func (hl *hardlinkStorage) rsyncArgs(base string) []string {
+	if base == "" {
+		return nil
+	}
+	return []string{"--link-dest=" + hl.path(base)}
+}
+
+func (hl *hardlinkStorage) rename(from, to string) error {
+	return os.Rename(hl.path(from), hl.path(to))
+}
+
+func (hl *hardlinkStorage) complete(from, to string) error {
+	return hl.rename(from, to)
+}
+
+func (hl *hardlinkStorage) remove(ctx context.Context, name string, progress func(files int64)) (int64, error) {
+	tr := &treeRemover{
+		walkers:          hl.walkers,
+		rate:             hl.rate,
+		nice:             hl.nice,
+		progress:         progress,
+		progressInterval: purgeProgressInterval,
+	}
+	return tr.removeAll(ctx, hl.path(name))
+}
+
+func (hl *hardlinkStorage) free() (uint64, uint64, error) {
+	return diskSpace(hl.root)
+}
+
+// purgeProgressInterval is how often the progress of purging a snapshot is
+// logged.
+const purgeProgressInterval = time.Minute
@@ -0,0 +1,65 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Snapshots as btrfs subvolumes
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// btrfsStorage keeps every snapshot in a btrfs subvolume below the data
+// directory. A new snapshot starts as a writable btrfs snapshot of its base,
+// and rsync only changes what is different in place. Complete snapshots are
+// made read-only. Snapshots that are plain directories, e. g. the ones made
+// before switching to btrfs storage, are handled like hardlinkStorage does.
+type btrfsStorage struct {
+	*hardlinkStorage
+	// command is the btrfs program
+	command string
+}
+
+// run runs the btrfs command with args.
+func (bs *btrfsStorage) run(args ...string) error {
+	out, err := exec.Command(bs.command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %s: %s", bs.command, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// prepare creates a writable snapshot of base, or an empty subvolume if
+// there is no base or the base is not a subvolume.
+func (bs *btrfsStorage) prepare(name, base string) error {
+	if base != "" && isSubvolume(bs.path(base)) {
+		return bs.run("subvolume", "snapshot", bs.path(base), bs.path(name))
+	}
+	return bs.run("subvolume", "create", bs.path(name))
+}
+
+// rsyncArgs makes rsync change only the blocks that differ, so the new
+// snapshot shares as much as possible with its base.
+func (bs *btrfsStorage) rsyncArgs(base string) []string {
+	return []string{"--inplace", "--no-whole-file"}
+}
+
+// complete renames the snapshot and makes it read-only.
+func (bs *btrfsStorage) complete(from, to string) error {
+	if err := bs.rename(from, to); err != nil {
+		return err
+	}
+	if !isSubvolume(bs.path(to)) {
+		return nil
+	}
+	return bs.run("property", "set", "-ts", bs.path(to), "ro", "true")
+}
+
+func (bs *btrfsStorage) remove(ctx context.Context, name string, progress func(files int64)) (int64, error) {
+	if !isSubvolume(bs.path(name)) {
+		return bs.hardlinkStorage.remove(ctx, name, progress)
+	}
+	return 0, bs.run("subvolume", "delete", bs.path(name))
+}
@@ -0,0 +1,135 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeBtrfs writes a btrfs command to dir that only records its arguments
+// in dir/calls.
+func fakeBtrfs(t *testing.T, dir string) string {
+	script := "#!/bin/sh\necho \"$@\" >> \"" + filepath.Join(dir, "calls") + "\"\n"
+	path := filepath.Join(dir, "btrfs")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBtrfsStorageCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bs := &btrfsStorage{hardlinkStorage: &hardlinkStorage{root: dir}, command: fakeBtrfs(t, dir)}
+	// not on btrfs, so nothing is a subvolume
+	os.Mkdir(filepath.Join(dir, "base"), 0755)
+	if err := bs.prepare("new", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.complete("base", "done"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.remove(context.Background(), "done", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bs.path("done")); !os.IsNotExist(err) {
+		t.Errorf("plain directory %s was not removed", bs.path("done"))
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if got, want := string(b), "subvolume create "+filepath.Join(dir, "new")+"\n"; got != want {
+		t.Errorf("btrfs was called with %q, wanted %q", got, want)
+	}
+	if args := strings.Join(bs.rsyncArgs("base"), " "); args != "--inplace --no-whole-file" {
+		t.Errorf("wrong rsync arguments: %s", args)
+	}
+}
+
+// mountBtrfs mounts a loopback btrfs image and returns the mount point and a
+// function to unmount it. The test is skipped if that is not possible.
+func mountBtrfs(t *testing.T) (string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting btrfs requires root")
+	}
+	for _, cmd := range []string{"btrfs", "mkfs.btrfs", "mount", "umount"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s not available", cmd)
+		}
+	}
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := filepath.Join(dir, "btrfs.img")
+	mnt := filepath.Join(dir, "mnt")
+	os.Mkdir(mnt, 0755)
+	f, err := os.Create(image)
+	if err == nil {
+		err = f.Truncate(256 << 20)
+		f.Close()
+	}
+	if err == nil {
+		err = exec.Command("mkfs.btrfs", "-q", image).Run()
+	}
+	if err == nil {
+		err = exec.Command("mount", "-o", "loop", image, mnt).Run()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("could not mount a btrfs image: %s", err)
+	}
+	return mnt, func() {
+		exec.Command("umount", mnt).Run()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBtrfsStorage(t *testing.T) {
+	mnt, umount := mountBtrfs(t)
+	defer umount()
+	st := newStorage(&Config{repository: mnt, Storage: "btrfs"})
+	os.Mkdir(filepath.Join(mnt, dataSubdir), 0755)
+	if err := st.prepare("first-incomplete", ""); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(st.path("first-incomplete"), "file"), []byte("data"), 0644)
+	if err := st.complete("first-incomplete", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(st.path("first"), "other"), nil, 0644); err == nil {
+		t.Errorf("complete snapshot is writable")
+	}
+	if err := st.prepare("second", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(st.path("second"), "file")); err != nil || string(b) != "data" {
+		t.Errorf("new snapshot does not contain the base: %q, %v", b, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(st.path("second"), "other"), nil, 0644); err != nil {
+		t.Errorf("new snapshot is not writable: %v", err)
+	}
+	// snapshots are renamed when their state changes
+	if err := st.rename("first", "renamed"); err != nil {
+		t.Fatalf("could not rename a read-only snapshot: %v", err)
+	}
+	names, err := st.list()
+	if err != nil || strings.Join(names, " ") != "renamed second" {
+		t.Errorf("list() gave %v, %v", names, err)
+	}
+	for _, name := range []string{"renamed", "second"} {
+		if _, err := st.remove(context.Background(), name, nil); err != nil {
+			t.Errorf("remove(%s) gave error %v", name, err)
+		}
+		if _, err := os.Stat(st.path(name)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", name)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage keeps the names of snapshots in memory, nothing is written to
+// disk. Every snapshot takes snapshotSize of the size bytes available.
+type memStorage struct {
+	mu           sync.Mutex
+	root         string
+	snapshots    map[string]bool
+	completed    int
+	snapshotSize uint64
+	size         uint64
+	// removing, if not nil, is sent the name of every snapshot to be
+	// removed, which then waits until release is closed.
+	removing chan string
+	release  chan struct{}
+}
+
+// mockMemStorage switches r to a memStorage holding the snapshots names.
+func mockMemStorage(r *Repository, names []string) *memStorage {
+	ms := &memStorage{
+		root:      r.path(dataSubdir),
+		snapshots: make(map[string]bool),
+	}
+	for _, name := range names {
+		ms.snapshots[name] = true
+	}
+	r.store = ms
+	return ms
+}
+
+func (ms *memStorage) list() ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var names []string
+	for name := range ms.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ms *memStorage) path(name string) string {
+	return filepath.Join(ms.root, name)
+}
+
+func (ms *memStorage) target(name string) string {
+	return ms.path(name)
+}
+
+func (ms *memStorage) prepare(name, base string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.snapshots[name] = true
+	return nil
+}
+
+func (ms *memStorage) rsyncArgs(base string) []string {
+	return nil
+}
+
+func (ms *memStorage) rename(from, to string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.snapshots[from] {
+		return fmt.Errorf("no such snapshot: %s", from)
+	}
+	if ms.snapshots[to] {
+		return fmt.Errorf("snapshot exists: %s", to)
+	}
+	delete(ms.snapshots, from)
+	ms.snapshots[to] = true
+	return nil
+}
+
+func (ms *memStorage) complete(from, to string) error {
+	if err := ms.rename(from, to); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.completed++
+	return nil
+}
+
+func (ms *memStorage) remove(ctx context.Context, name string, progress func(files int64)) (int64, error) {
+	if ms.removing != nil {
+		ms.removing <- name
+		<-ms.release
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.snapshots, name)
+	return 0, nil
+}
+
+func (ms *memStorage) free() (uint64, uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.size - uint64(len(ms.snapshots))*ms.snapshotSize, ms.size, nil
+}
+
+// unlinked keeps the repository from making symlinks to the snapshots, they
+// are not on disk.
+func (ms *memStorage) unlinked() {}
+
+// count returns the number of snapshots in state, and how many were
+// completed so far.
+func (ms *memStorage) count(state snapshotState) (int, int) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n := 0
+	for name := range ms.snapshots {
+		if _, _, st, err := parseSnapshotName(name); err == nil && st == state {
+			n++
+		}
+	}
+	return n, ms.completed
+}
+
+func TestPruneMemStorage(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	mockMemStorage(r, mockSnapshots)
+	cl := newSkewClock(startAt)
+	r.cl = cl
+	q := newPurgeQueue()
+	// the same as the second step of TestPrune
+	cl.forward(r.intervals()[0])
+	r.prune(q)
+	assertPurgeQueueLen(t, q, 1)
+	if sn, _ := r.onDisk(mustParseSnapshot(t, "1400337706-1400337707-complete")); sn.state != stateObsolete {
+		t.Errorf("prune() left %s", sn.Name())
+	}
+	if _, err := os.Stat(r.path(dataSubdir)); !os.IsNotExist(err) {
+		t.Errorf("prune() created the data directory")
+	}
+}
+
+func TestClaimFreeSpace(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	ms := mockMemStorage(r, mockSnapshots)
+	ms.snapshotSize, ms.size = 10, 100
+	for _, name := range mockSnapshots[:4] {
+		sn, _ := r.onDisk(mustParseSnapshot(t, name))
+		if _, err := r.transObsolete(sn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.config.MinPercSpace = 35
+	r.claimFreeSpace(context.Background())
+	if n, _ := ms.count(stateObsolete); n != 1 {
+		t.Errorf("%d obsolete snapshots left, wanted 1", n)
+	}
+	if free, size, _ := ms.free(); free*100/size < 35 {
+		t.Errorf("only %d of %d bytes free after claiming space", free, size)
+	}
+}
+
+// mustParseSnapshot returns the snapshot called name.
+func mustParseSnapshot(t *testing.T, name string) snapshot {
+	stime, etime, state, err := parseSnapshotName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newSnapshot(stime, etime, state)
+}
+
+// TestRunLoopsMemStorage runs the snapshot loops until they are told to stop
+// gracefully.
+func TestRunLoopsMemStorage(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	ms := mockMemStorage(r, nil)
+	// rsync runs in the data directory, but does not write to it
+	os.Mkdir(r.path(dataSubdir), 0755)
+	r.config.Origin = "/tmp/"
+	r.config.RsyncPath = "true"
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- r.runLoops(context.Background(), stop, nil)
+	}()
+	timeout := time.After(10 * time.Second)
+	for _, completed := ms.count(stateComplete); completed < 10; _, completed = ms.count(stateComplete) {
+		select {
+		case err := <-done:
+			t.Fatalf("runLoops() returned early: %v", err)
+		case <-timeout:
+			t.Fatalf("only %d snapshots made", completed)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("runLoops() gave error %v", err)
+		}
+	case <-timeout:
+		t.Fatalf("runLoops() did not stop")
+	}
+	if n, _ := ms.count(stateIncomplete); n != 0 {
+		t.Errorf("%d incomplete snapshots left", n)
+	}
+	if n, _ := ms.count(stateComplete); n == 0 || n > 12 {
+		t.Errorf("%d complete snapshots, the schedule was not applied", n)
+	}
+	// only the metadata is kept on disk
+	files, _ := ioutil.ReadDir(r.path())
+	for _, f := range files {
+		if f.Name() != dataSubdir && r.path(f.Name()) != r.metaFile() {
+			t.Errorf("%s written to the repository", f.Name())
+		}
+	}
+	if files, _ := ioutil.ReadDir(r.path(dataSubdir)); len(files) != 0 {
+		t.Errorf("%d files written to the data directory", len(files))
+	}
+}
@@ -0,0 +1,150 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Snapshots as ZFS dataset snapshots
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// zfsStorage keeps the snapshots as ZFS snapshots of the dataset mounted on
+// the data directory. rsync updates the dataset in place, and completing a
+// snapshot takes a ZFS snapshot of it. The dataset itself is the incomplete
+// snapshot being made, so incomplete snapshots are never listed. Complete
+// snapshots are read through the .zfs/snapshot directory of the dataset.
+type zfsStorage struct {
+	// command is the zfs program
+	command string
+	// root is the mountpoint of the dataset
+	root string
+	mu   sync.Mutex
+	// dataset is the name of the dataset, looked up when first needed
+	dataset string
+}
+
+// run runs the zfs command with args and returns its output.
+func (zs *zfsStorage) run(args ...string) (string, error) {
+	cmd := exec.Command(zs.command, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s failed: %s: %s", zs.command, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// name returns the name of the dataset mounted on root.
+func (zs *zfsStorage) name() (string, error) {
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+	if zs.dataset != "" {
+		return zs.dataset, nil
+	}
+	out, err := zs.run("list", "-H", "-o", "name,mountpoint", zs.root)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Split(strings.TrimSpace(out), "\t")
+	if len(fields) != 2 || filepath.Clean(fields[1]) != filepath.Clean(zs.root) {
+		return "", fmt.Errorf("%s is not the mountpoint of a ZFS dataset", zs.root)
+	}
+	zs.dataset = fields[0]
+	return zs.dataset, nil
+}
+
+// snapshot returns the full ZFS name of the snapshot name.
+func (zs *zfsStorage) snapshot(name string) (string, error) {
+	ds, err := zs.name()
+	if err != nil {
+		return "", err
+	}
+	return ds + "@" + name, nil
+}
+
+// list returns the names of the snapshots of the dataset.
+func (zs *zfsStorage) list() ([]string, error) {
+	ds, err := zs.name()
+	if err != nil {
+		return nil, err
+	}
+	out, err := zs.run("list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", ds)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, "@"); i >= 0 {
+			names = append(names, line[i+1:])
+		}
+	}
+	return names, nil
+}
+
+func (zs *zfsStorage) path(name string) string {
+	return filepath.Join(zs.root, ".zfs", "snapshot", name)
+}
+
+// target is always the dataset itself.
+func (zs *zfsStorage) target(name string) string {
+	return zs.root
+}
+
+// prepare does nothing, the dataset still contains the latest snapshot.
+func (zs *zfsStorage) prepare(name, base string) error {
+	return nil
+}
+
+// rsyncArgs makes rsync change only the blocks that differ, so the dataset
+// shares as much as possible with its snapshots.
+func (zs *zfsStorage) rsyncArgs(base string) []string {
+	return []string{"--inplace", "--no-whole-file", "--exclude=/.zfs"}
+}
+
+func (zs *zfsStorage) rename(from, to string) error {
+	oldName, err := zs.snapshot(from)
+	if err != nil {
+		return err
+	}
+	newName, err := zs.snapshot(to)
+	if err != nil {
+		return err
+	}
+	_, err = zs.run("rename", oldName, newName)
+	return err
+}
+
+// complete takes a snapshot of the dataset.
+func (zs *zfsStorage) complete(from, to string) error {
+	sn, err := zs.snapshot(to)
+	if err != nil {
+		return err
+	}
+	_, err = zs.run("snapshot", sn)
+	return err
+}
+
+// remove destroys the snapshot. Removing an incomplete snapshot does
+// nothing, it is the dataset itself.
+func (zs *zfsStorage) remove(ctx context.Context, name string, progress func(files int64)) (int64, error) {
+	if _, _, state, err := parseSnapshotName(name); err == nil && state == stateIncomplete {
+		return 0, nil
+	}
+	sn, err := zs.snapshot(name)
+	if err != nil {
+		return 0, err
+	}
+	_, err = zs.run("destroy", sn)
+	return 0, err
+}
+
+// free returns the space of the dataset, as ZFS reports it to statfs.
+func (zs *zfsStorage) free() (uint64, uint64, error) {
+	return diskSpace(zs.root)
+}
@@ -0,0 +1,68 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mockZfs switches r to ZFS storage using the fake_zfs script.
+func mockZfs(t *testing.T, r *Repository) *zfsStorage {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(r.path(dataSubdir), 0755)
+	r.config.Storage = "zfs"
+	zs := newStorage(r.config).(*zfsStorage)
+	zs.command = filepath.Join(wd, "fake_zfs")
+	r.store = zs
+	return zs
+}
+
+func TestZfsStorage(t *testing.T) {
+	r := mockConfig()
+	defer os.RemoveAll(r.path())
+	zs := mockZfs(t, r)
+	r.config.RsyncPath = fakeRsync(t, r.path(), `echo data > "$dst/file"`)
+	sn, err := r.createSnapshot(context.Background(), snapshot{})
+	if err != nil {
+		t.Fatalf("createSnapshot() gave error %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(r.path(), "calls")); string(b) != zs.root+"\n" {
+		t.Errorf("rsync wrote to %q, wanted the dataset %s", b, zs.root)
+	}
+	snapshots, err := r.findSnapshots()
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name() != sn.Name() {
+		t.Fatalf("findSnapshots() gave %v, %v, wanted %s", snapshots, err, sn.Name())
+	}
+	target, _ := os.Readlink(r.path("latest"))
+	if want := filepath.Join(dataSubdir, ".zfs", "snapshot", sn.Name()); target != want {
+		t.Errorf("latest points to %s, wanted %s", target, want)
+	}
+	if b, err := ioutil.ReadFile(r.path("latest", "file")); err != nil || string(b) != "data\n" {
+		t.Errorf("snapshot does not contain the data: %q, %v", b, err)
+	}
+	sn, err = r.transObsolete(sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.purge(context.Background(), sn)
+	if snapshots, err := r.findSnapshots(); err != nil || len(snapshots) != 0 {
+		t.Errorf("snapshots left after purging: %v, %v", snapshots, err)
+	}
+	if _, err := os.Stat(zs.path(sn.Name())); !os.IsNotExist(err) {
+		t.Errorf("ZFS snapshot %s was not destroyed", sn.Name())
+	}
+	if _, err := os.Stat(filepath.Join(zs.root, "file")); err != nil {
+		t.Errorf("purging removed the dataset contents: %v", err)
+	}
+	zs = &zfsStorage{command: zs.command, root: r.path("missing")}
+	if _, err := zs.list(); err == nil {
+		t.Errorf("list() of a missing dataset gave no error")
+	}
+}
@@ -0,0 +1,149 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Show snapshots as a tree of intervals, years, months and days
+
+package main
+
+import (
+	"fmt"
+	"github.com/daviddengcn/go-colortext"
+	"io"
+	"sort"
+	"time"
+)
+
+// treeLeaf is a snapshot or a gap in the tree view.
+type treeLeaf struct {
+	t     time.Time
+	entry *listEntry // nil for gaps
+	gapTo time.Time
+}
+
+// findGaps divides the interval into buckets of the interval's duration and
+// returns a gap leaf for each bucket without a snapshot. The highest interval
+// is not divided.
+func findGaps(iv listInterval, now time.Time) []treeLeaf {
+	var gaps []treeLeaf
+	if iv.from == 0 {
+		return gaps
+	}
+	to := now.Add(-iv.from)
+	for b := 0; b < iv.goal; b++ {
+		from := to
+		to = from.Add(iv.duration)
+		found := false
+		for _, e := range iv.entries {
+			t := e.sn.effectiveTime()
+			if !t.Before(from) && t.Before(to) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			gaps = append(gaps, treeLeaf{t: from, gapTo: to})
+		}
+	}
+	return gaps
+}
+
+// forecast predicts what will happen next to the snapshots in the listing:
+// the oldest snapshot of each interval will be promoted into the next higher
+// interval, or obsoleted by prune() when it arrives there. Returns a note for
+// each affected snapshot, keyed by name.
+func (r *Repository) forecast(listing []listInterval, now time.Time) map[string]string {
+	notes := make(map[string]string)
+	intervals := r.intervals()
+	byIndex := make(map[int]listInterval)
+	for _, iv := range listing {
+		byIndex[iv.index] = iv
+	}
+	when := func(t time.Time) string {
+		if d := t.Sub(now).Round(second); d > 0 {
+			return "in " + formatDuration(d)
+		}
+		return "now"
+	}
+	for n := 0; n < len(intervals)-2; n++ {
+		iv := byIndex[n]
+		if len(iv.entries) == 0 {
+			continue
+		}
+		oldest := iv.entries[0].sn
+		t := oldest.effectiveTime().Add(intervals.offset(n + 1))
+		next := byIndex[n+1].entries
+		if len(next) >= 2 && oldest.effectiveTime().Sub(next[len(next)-1].sn.effectiveTime()) < intervals[n+1] {
+			notes[oldest.Name()] = "obsolete " + when(t)
+			continue
+		}
+		notes[oldest.Name()] = fmt.Sprintf("promoted to interval %d %s", n+1, when(t))
+		// a promotion into the highest interval may push out its oldest
+		// snapshot
+		if n+1 == len(intervals)-2 && r.config.MaxKeep != 0 && len(next) >= 2 && len(next)+1 > r.config.MaxKeep {
+			notes[next[0].sn.Name()] = "obsolete " + when(t) + " (maxKeep)"
+		}
+	}
+	return notes
+}
+
+// listTree writes the listing to w as a tree of intervals, years, months and
+// days.
+func (r *Repository) listTree(w io.Writer, listing []listInterval, now time.Time) {
+	notes := r.forecast(listing, now)
+	for _, iv := range listing {
+		ct.Foreground(ct.Yellow, false)
+		if iv.from != 0 {
+			fmt.Fprintf(w, "interval %d (%s), from %s ago, %d/%d\n", iv.index, formatDuration(iv.duration), formatDuration(iv.from), len(iv.entries), iv.goal)
+		} else if iv.goal != 0 {
+			fmt.Fprintf(w, "interval %d (%s), from past, %d/%d\n", iv.index, formatDuration(iv.duration), len(iv.entries), iv.goal)
+		} else {
+			fmt.Fprintf(w, "interval %d (%s), from past, %d/∞\n", iv.index, formatDuration(iv.duration), len(iv.entries))
+		}
+		ct.ResetColor()
+		leaves := findGaps(iv, now)
+		counts := make(map[string]int)
+		for i := range iv.entries {
+			e := &iv.entries[i]
+			leaves = append(leaves, treeLeaf{t: e.sn.startTime, entry: e})
+			for _, layout := range []string{"2006", "2006-01", "2006-01-02"} {
+				counts[e.sn.startTime.Format(layout)]++
+			}
+		}
+		sort.SliceStable(leaves, func(i, j int) bool {
+			return leaves[i].t.Before(leaves[j].t)
+		})
+		var year, month, day string
+		for _, l := range leaves {
+			if y := l.t.Format("2006"); y != year {
+				year = y
+				month = ""
+				fmt.Fprintf(w, "  %s (%d)\n", year, counts[year])
+			}
+			if m := l.t.Format("2006-01"); m != month {
+				month = m
+				day = ""
+				fmt.Fprintf(w, "    %s (%d)\n", l.t.Format("01 January"), counts[month])
+			}
+			if d := l.t.Format("2006-01-02"); d != day {
+				day = d
+				fmt.Fprintf(w, "      %s (%d)\n", l.t.Format("02 Monday"), counts[day])
+			}
+			if l.entry == nil {
+				ct.Foreground(ct.Red, false)
+				fmt.Fprintf(w, "        %s gap, no snapshot for %s\n", l.t.Format("15:04:05"), formatDuration(l.gapTo.Sub(l.t)))
+				ct.ResetColor()
+				continue
+			}
+			sn := l.entry.sn
+			fmt.Fprintf(w, "        %s (%s)", sn.startTime.Format("15:04:05"), l.entry.duration())
+			if sn.state != stateComplete {
+				fmt.Fprintf(w, " %s", sn.state)
+			}
+			if note, ok := notes[sn.Name()]; ok {
+				ct.Foreground(ct.Cyan, false)
+				fmt.Fprintf(w, " -> %s", note)
+				ct.ResetColor()
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Trigger snapshots by changes in the origin instead of by the clock alone
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// isLocalOrigin returns false if rsync would treat origin as a remote
+// location, like "host:/path" or "rsync://host/module".
+func isLocalOrigin(origin string) bool {
+	if strings.Contains(origin, "://") {
+		return false
+	}
+	colon := strings.Index(origin, ":")
+	if colon == -1 {
+		return true
+	}
+	slash := strings.Index(origin, "/")
+	return slash != -1 && slash < colon
+}
+
+// waitForChange blocks until something arrived on changes and no further
+// change happened for at least the debounce time. It returns early on a
+// signal on force, when stale fires or when ctx is done.
+func waitForChange(ctx context.Context, changes <-chan struct{}, force <-chan os.Signal, cl clock, debounce time.Duration, stale <-chan time.Time) {
+	select {
+	case <-changes:
+		debugf("origin changed, waiting for it to settle")
+	case <-stale:
+		infof("no changes in origin for too long, making a snapshot anyway")
+		return
+	case <-force:
+		infof("Snapshot forced by signal, skipping wait time.")
+		return
+	case <-ctx.Done():
+		return
+	}
+	// Instead of restarting the timer on every change, only note that
+	// something changed and check again when the timer fires. The quiet
+	// period is therefore between debounce and twice the debounce time.
+	dirty := false
+	quiet := cl.After(debounce)
+	for {
+		select {
+		case <-changes:
+			dirty = true
+		case <-quiet:
+			if !dirty {
+				return
+			}
+			dirty = false
+			quiet = cl.After(debounce)
+		case <-stale:
+			infof("origin keeps changing, making a snapshot anyway")
+			return
+		case <-force:
+			infof("Snapshot forced by signal, skipping wait time.")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// changeTicker can be used instead of lastGoodTicker. After the minimum
+// spacing given by cal it waits until the origin has changed before
+// outputting the snapshot, but no longer than maxStale after the last
+// snapshot started.
+func (r *Repository) changeTicker(ctx context.Context, in <-chan snapshot, out chan<- snapshot, cal *calendar, changes <-chan struct{}, debounce, maxStale time.Duration) {
+	r.runTicker(ctx, in, out, func(sn snapshot, force <-chan os.Signal) {
+		if !r.waitForSchedule(ctx, sn, cal, force) && !sn.isZero() && ctx.Err() == nil {
+			r.log.infof("waiting for changes in origin")
+			r.state.waitUntil(sn.effectiveTime().Add(maxStale))
+			stale := r.cl.After(sn.effectiveTime().Add(maxStale).Sub(r.cl.Now()))
+			waitForChange(ctx, changes, force, r.cl, debounce, stale)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+// Watch a local origin directory tree using inotify
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// originWatcher sends on changed whenever something below root changes.
+// Multiple changes are coalesced, the channel never holds more than one
+// element.
+type originWatcher struct {
+	changed chan struct{}
+	// done is closed when the watcher stopped reading events
+	done chan struct{}
+	fd   int
+	// file wraps fd, which is nonblocking, so reading it goes through the
+	// runtime poller and closing it wakes up a blocked reader.
+	file    *os.File
+	mu      sync.Mutex
+	watches map[int32]string
+}
+
+// newOriginWatcher recursively adds inotify watches for all directories
+// below root. New directories are added as they appear.
+func newOriginWatcher(root string) (*originWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize inotify: %s", err)
+	}
+	w := &originWatcher{
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]string),
+	}
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	infof("watching %d directories in %s for changes", len(w.watches), root)
+	go w.readEvents()
+	return w, nil
+}
+
+// addTree adds watches for dir and all directories below it.
+func (w *originWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// vanished while walking, or not readable. Not our problem.
+			debugf("not watching %s: %s", path, err)
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err == syscall.ENOSPC {
+			return fmt.Errorf("too many directories to watch in %s, raise fs.inotify.max_user_watches", dir)
+		}
+		if err != nil {
+			debugf("not watching %s: %s", path, err)
+			return nil
+		}
+		w.mu.Lock()
+		w.watches[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// readEvents parses inotify events until the watcher is closed.
+func (w *originWatcher) readEvents() {
+	defer close(w.done)
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if n <= 0 || err != nil {
+			debugf("stopped watching: %v", err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(ev.Len)]), "\x00")
+			off = nameStart + int(ev.Len)
+			w.handle(ev.Wd, ev.Mask, name)
+		}
+	}
+}
+
+// handle reacts on a single inotify event.
+func (w *originWatcher) handle(wd int32, mask uint32, name string) {
+	w.mu.Lock()
+	dir, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mu.Unlock()
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		warnf("inotify queue overflow, some changes may not be watched")
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+	if ok && mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := w.addTree(filepath.Join(dir, name)); err != nil {
+			errorf("%s", err)
+		}
+	}
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops watching. A pending read is interrupted, so the goroutine
+// reading events returns.
+func (w *originWatcher) Close() error {
+	return w.file.Close()
+}
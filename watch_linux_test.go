@@ -0,0 +1,61 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func assertChanged(t *testing.T, w *originWatcher, what string) {
+	select {
+	case <-w.changed:
+	case <-time.After(time.Second * 2):
+		t.Errorf("no change reported after %s", what)
+	}
+}
+
+func TestOriginWatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "snaprd_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	w, err := newOriginWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sub := filepath.Join(root, "sub")
+	os.Mkdir(sub, 0777)
+	assertChanged(t, w, "mkdir")
+	// give the watcher a moment to add the new directory
+	time.Sleep(time.Millisecond * 100)
+	ioutil.WriteFile(filepath.Join(sub, "file"), []byte("data"), 0666)
+	assertChanged(t, w, "creating a file in a new directory")
+}
+
+func TestOriginWatcherClose(t *testing.T) {
+	root, err := ioutil.TempDir("", "snaprd_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	w, err := newOriginWatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// give the reader time to block in read
+	time.Sleep(time.Millisecond * 100)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-w.done:
+	case <-time.After(time.Second * 2):
+		t.Errorf("reading events did not stop after Close()")
+	}
+}
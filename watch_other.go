@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"errors"
+)
+
+type originWatcher struct {
+	changed chan struct{}
+}
+
+func newOriginWatcher(root string) (*originWatcher, error) {
+	return nil, errors.New("-watch is only supported on linux")
+}
+
+func (w *originWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,57 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIsLocalOrigin(t *testing.T) {
+	var tests = map[string]bool{
+		"/tmp/snaprd_test/":        true,
+		"relative/dir":             true,
+		"./host:dir":               true,
+		"/dir/with:colon":          true,
+		"fileserver:/export/homes": false,
+		"fileserver:homes":         false,
+		"rsync://fileserver/homes": false,
+	}
+	for origin, want := range tests {
+		if got := isLocalOrigin(origin); got != want {
+			t.Errorf("isLocalOrigin(%v) got %v, expected %v", origin, got, want)
+		}
+	}
+}
+
+func TestWaitForChangeStale(t *testing.T) {
+	changes := make(chan struct{}, 1)
+	force := make(chan os.Signal)
+	stale := make(chan time.Time, 1)
+	stale <- time.Now()
+	// must return without any changes
+	waitForChange(context.Background(), changes, force, new(realClock), time.Hour, stale)
+}
+
+func TestWaitForChangeDebounce(t *testing.T) {
+	changes := make(chan struct{}, 1)
+	force := make(chan os.Signal)
+	debounce := time.Millisecond * 50
+	go func() {
+		for i := 0; i < 5; i++ {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+			time.Sleep(debounce / 2)
+		}
+	}()
+	start := time.Now()
+	waitForChange(context.Background(), changes, force, new(realClock), debounce, nil)
+	// the last change happens after 4*debounce/2, plus the quiet period
+	if elapsed := time.Since(start); elapsed < debounce*3 {
+		t.Errorf("waitForChange returned after %v, before the origin settled", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of src to dst, which includes
+// POSIX ACLs. Unless running as root only the user namespace and the ACLs
+// can be copied, like with rsync -X -A.
+func copyXattrs(src, dst string) error {
+	names, err := xattrNames(src)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	root := os.Geteuid() == 0
+	for _, name := range names {
+		if !root && !strings.HasPrefix(name, "user.") && !strings.HasPrefix(name, "system.posix_acl_") {
+			continue
+		}
+		value, err := xattrValue(src, name)
+		if err != nil {
+			return &os.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+		if err := syscall.Setxattr(dst, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: dst, Err: err}
+		}
+	}
+	return nil
+}
+
+// xattrNames returns the names of the extended attributes of path. A
+// filesystem without extended attributes has none.
+func xattrNames(path string) ([]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// xattrValue returns the value of the extended attribute name of path.
+func xattrValue(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
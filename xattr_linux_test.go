@@ -0,0 +1,31 @@
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snaprd_testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	ioutil.WriteFile(src, nil, 0644)
+	ioutil.WriteFile(dst, nil, 0644)
+	if err := syscall.Setxattr(src, "user.snaprd", []byte("value"), 0); err != nil {
+		t.Skipf("extended attributes not supported: %s", err)
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		t.Fatalf("copyXattrs() gave error %v", err)
+	}
+	if value, err := xattrValue(dst, "user.snaprd"); err != nil || string(value) != "value" {
+		t.Errorf("attribute was copied as %q, %v", value, err)
+	}
+}
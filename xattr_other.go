@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+/* See the file "LICENSE.txt" for the full license governing this code. */
+
+package main
+
+// copyXattrs does nothing, extended attributes are only copied on linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}